@@ -2,18 +2,58 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/dehimb/cake/internal/config"
 	"github.com/dehimb/cake/internal/server"
 	"github.com/dehimb/cake/internal/store"
+	"github.com/dehimb/cake/internal/trace"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// Exit code is 2 for invalid config and 1 when server or store fails,
+// deferred calls run before exit
+func run() int {
+	cfg, printOnly, err := config.Load(os.Args[1:], os.Environ())
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if printOnly {
+		fmt.Print(cfg)
+		return 0
+	}
+
 	logger := logrus.New()
-	logger.SetLevel(logrus.DebugLevel)
+	cfg.ConfigureLogger(logger)
+
+	serverConfig, err := cfg.ServerConfig()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	shutdownTracing, err := trace.Setup(context.Background(), cfg.TraceConfig())
+	if err != nil {
+		logger.Fatal("Can't set up tracing: ", err)
+	}
+	defer func() {
+		// spans of the last requests are flushed after server is stopped
+		ctx, cancel := context.WithTimeout(context.Background(), serverConfig.ShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("Can't flush trace spans: ", err)
+		}
+	}()
 
 	// Catch interrupt signals
 	c := make(chan os.Signal, 1)
@@ -32,5 +72,8 @@ func main() {
 	 *   syscall.Kill(syscall.Getpid(), syscall.SIGINT)
 	 * }() */
 
-	server.Start(ctx, store.New(ctx, logger, "cake.db"), logger)
+	if err = server.Start(ctx, store.New(logger, cfg.StoreConfig()), logger, serverConfig); err != nil {
+		return 1
+	}
+	return 0
 }
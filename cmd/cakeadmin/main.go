@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dehimb/cake/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+const usage = `Usage: cakeadmin [-db cake.db] <command> [flags]
+
+Commands:
+  operator-create -name NAME                  register operator
+  key-create -operator NAME -scopes S1,S2     create API key, the key is printed only once
+  key-list [-operator NAME]                   list API keys
+  key-revoke -id ID                           revoke API key
+`
+
+func main() {
+	dbName := flag.String("db", "cake.db", "database file")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger := logrus.New()
+	admin, err := store.NewAdmin(logger, *dbName)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	err = run(admin, flag.Arg(0), flag.Args()[1:])
+	admin.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(admin *store.Admin, command string, args []string) error {
+	commandFlags := flag.NewFlagSet(command, flag.ExitOnError)
+	switch command {
+	case "operator-create":
+		name := commandFlags.String("name", "", "operator name")
+		commandFlags.Parse(args)
+		if err := admin.CreateOperator(*name); err != nil {
+			return err
+		}
+		fmt.Printf("Operator %s created\n", *name)
+	case "key-create":
+		operator := commandFlags.String("operator", "", "operator name")
+		scopeList := commandFlags.String("scopes", "", "comma separated scopes")
+		commandFlags.Parse(args)
+		scopes, err := store.ParseScopes(*scopeList)
+		if err != nil {
+			return err
+		}
+		key, apiKey, err := admin.CreateAPIKey(*operator, scopes)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("API key %d created, store it now, it can't be shown again:\n%s\n", apiKey.ID, key)
+	case "key-list":
+		operator := commandFlags.String("operator", "", "show keys of the operator only")
+		commandFlags.Parse(args)
+		keys, err := admin.ListAPIKeys(*operator)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tOPERATOR\tPREFIX\tSCOPES\tCREATED\tLAST USED\tREVOKED")
+		for _, k := range keys {
+			scopes := make([]string, len(k.Scopes))
+			for i, scope := range k.Scopes {
+				scopes[i] = string(scope)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Operator, k.Prefix, strings.Join(scopes, ","),
+				formatTime(k.Created), formatTime(k.LastUsedAt), formatTime(k.RevokedAt))
+		}
+		w.Flush()
+	case "key-revoke":
+		id := commandFlags.Uint64("id", 0, "API key id")
+		commandFlags.Parse(args)
+		if err := admin.RevokeAPIKey(*id); err != nil {
+			return err
+		}
+		fmt.Printf("API key %d revoked\n", *id)
+	default:
+		return fmt.Errorf("Unknown command: %s\n\n%s", command, usage)
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
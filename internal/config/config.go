@@ -0,0 +1,387 @@
+// Package config loads settings of the apiserver.
+//
+// Every setting has a default, which can be overridden by YAML or JSON file
+// given by -config flag, then by CAKE_* environment variable and finally by
+// command line flag. Environment variable name is the flag name in upper case
+// with "CAKE_" prefix and dashes replaced by underscores, e.g. -log-level can
+// be set by CAKE_LOG_LEVEL.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/dehimb/cake/internal/server"
+	"github.com/dehimb/cake/internal/store"
+	"github.com/dehimb/cake/internal/trace"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const envPrefix = "CAKE_"
+
+type Config struct {
+	Addr      string    `yaml:"addr"`
+	DBPath    string    `yaml:"dbPath"`
+	Log       Log       `yaml:"log"`
+	HTTP      HTTP      `yaml:"http"`
+	Store     Store     `yaml:"store"`
+	CORS      CORS      `yaml:"cors"`
+	Limits    Limits    `yaml:"limits"`
+	Providers Providers `yaml:"providers"`
+	Trace     Trace     `yaml:"trace"`
+}
+
+type Log struct {
+	// logrus level name
+	Level string `yaml:"level"`
+	// text or json
+	Format string `yaml:"format"`
+	// Log request bodies with redacted secrets
+	Bodies bool `yaml:"bodies"`
+}
+
+type HTTP struct {
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	IdleTimeout  time.Duration `yaml:"idleTimeout"`
+	// Store operations of request are abandoned after this time
+	RequestTimeout time.Duration `yaml:"requestTimeout"`
+	// Time given to requests in progress on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	// Time readiness fails before listener is closed
+	ShutdownDelay time.Duration `yaml:"shutdownDelay"`
+}
+
+// See store.Config
+type Store struct {
+	FlushInterval   time.Duration `yaml:"flushInterval"`
+	Persistence     string        `yaml:"persistence"`
+	Recovery        string        `yaml:"recovery"`
+	HoldTTL         time.Duration `yaml:"holdTTL"`
+	BonusWagering   int           `yaml:"bonusWagering"`
+	BonusBetOrder   string        `yaml:"bonusBetOrder"`
+	BonusTTL        time.Duration `yaml:"bonusTTL"`
+	LimitCoolingOff time.Duration `yaml:"limitCoolingOff"`
+	TokenTTL        time.Duration `yaml:"tokenTTL"`
+}
+
+type CORS struct {
+	// "*" allows any origin
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+}
+
+type Limits struct {
+	Rate        server.RateLimits `yaml:"rate"`
+	MaxInFlight int               `yaml:"maxInFlight"`
+	MaxBodySize int64             `yaml:"maxBodySize"`
+}
+
+type Trace struct {
+	// "stdout" or "otlp", tracing is disabled when empty.
+	// For backward compatibility "stdout" is implied when only File is set.
+	Exporter string `yaml:"exporter"`
+	// File which stdout exporter appends spans to, "-" is stdout
+	File string `yaml:"file"`
+	// host:port of OTLP HTTP collector, OTEL_EXPORTER_OTLP_* variables are used when empty
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool   `yaml:"insecure"`
+	// Fraction of new traces which are recorded, caller decision is followed for others
+	SampleRatio float64 `yaml:"sampleRatio"`
+}
+
+type Providers struct {
+	// JSON file with secrets, see server.LoadProviderSecrets
+	SecretsFile     string        `yaml:"secretsFile"`
+	SignatureWindow time.Duration `yaml:"signatureWindow"`
+}
+
+func Default() *Config {
+	rateLimits, _ := server.ParseRateLimits(server.DefaultRateLimits)
+	return &Config{
+		Addr:   server.DefaultAddr,
+		DBPath: "cake.db",
+		Log:    Log{Level: "debug", Format: "text"},
+		HTTP: HTTP{
+			ReadTimeout:     server.DefaultReadTimeout,
+			WriteTimeout:    server.DefaultWriteTimeout,
+			IdleTimeout:     server.DefaultIdleTimeout,
+			RequestTimeout:  server.DefaultRequestTimeout,
+			ShutdownTimeout: server.DefaultShutdownTimeout,
+		},
+		Store: Store{
+			FlushInterval:   store.DefaultFlushInterval,
+			Persistence:     string(store.WriteBehind),
+			Recovery:        string(store.RecoveryRepair),
+			HoldTTL:         store.DefaultHoldTTL,
+			BonusWagering:   store.DefaultBonusWagering,
+			BonusBetOrder:   string(store.CashFirst),
+			BonusTTL:        store.DefaultBonusTTL,
+			LimitCoolingOff: store.DefaultLimitCoolingOff,
+			TokenTTL:        store.DefaultTokenTTL,
+		},
+		CORS: CORS{AllowedOrigins: []string{"*"}},
+		Limits: Limits{
+			Rate:        rateLimits,
+			MaxInFlight: server.DefaultMaxInFlight,
+			MaxBodySize: server.DefaultMaxBodySize,
+		},
+		Providers: Providers{SignatureWindow: server.DefaultSignatureWindow},
+	}
+}
+
+// Register flag of every setting, flag values are written to c
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "listen address")
+	fs.StringVar(&c.DBPath, "db", c.DBPath, "path to sqlite database file")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "log level: trace, debug, info, warn, error")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "log format: text or json")
+	fs.BoolVar(&c.Log.Bodies, "log-bodies", c.Log.Bodies, "log request bodies, secrets are redacted")
+	fs.DurationVar(&c.HTTP.ReadTimeout, "read-timeout", c.HTTP.ReadTimeout, "max time to read request")
+	fs.DurationVar(&c.HTTP.WriteTimeout, "write-timeout", c.HTTP.WriteTimeout, "max time to write response")
+	fs.DurationVar(&c.HTTP.IdleTimeout, "idle-timeout", c.HTTP.IdleTimeout, "max time to wait for the next request on keep-alive connection")
+	fs.DurationVar(&c.HTTP.RequestTimeout, "request-timeout", c.HTTP.RequestTimeout, "max time of store operations of request")
+	fs.DurationVar(&c.HTTP.ShutdownTimeout, "shutdown-timeout", c.HTTP.ShutdownTimeout, "time given to requests in progress on shutdown")
+	fs.DurationVar(&c.HTTP.ShutdownDelay, "shutdown-delay", c.HTTP.ShutdownDelay, "time readiness probe fails before listener is closed on shutdown")
+	fs.DurationVar(&c.Store.FlushInterval, "flush-interval", c.Store.FlushInterval, "period of balance flush and expiration tasks")
+	fs.StringVar(&c.Store.Persistence, "persistence", c.Store.Persistence, "balance persistence mode: write-behind or write-through")
+	fs.StringVar(&c.Store.Recovery, "recovery", c.Store.Recovery, "startup balance recovery policy: repair or refuse")
+	fs.DurationVar(&c.Store.HoldTTL, "hold-ttl", c.Store.HoldTTL, "time after which authorized hold is released")
+	fs.IntVar(&c.Store.BonusWagering, "bonus-wagering", c.Store.BonusWagering, "bonus wagering requirement multiplier")
+	fs.StringVar(&c.Store.BonusBetOrder, "bonus-bet-order", c.Store.BonusBetOrder, "wallet which pays for bets first: cash-first or bonus-first")
+	fs.DurationVar(&c.Store.BonusTTL, "bonus-ttl", c.Store.BonusTTL, "time after the last grant when unconverted bonus expires")
+	fs.DurationVar(&c.Store.LimitCoolingOff, "limit-cooling-off", c.Store.LimitCoolingOff, "delay before increased or removed responsible gaming limit takes effect")
+	fs.DurationVar(&c.Store.TokenTTL, "token-ttl", c.Store.TokenTTL, "lifetime of user session tokens")
+	fs.Var((*listValue)(&c.CORS.AllowedOrigins), "cors-origins", "comma separated origins allowed by CORS, * allows any")
+	fs.Var((*rateLimitsValue)(&c.Limits.Rate), "rate-limits", "requests per second and burst of every client by route: default=50:100,/transaction=20:40")
+	fs.IntVar(&c.Limits.MaxInFlight, "max-in-flight", c.Limits.MaxInFlight, "balance changing requests of one user processed at the same time, 0 disables the limit")
+	fs.Int64Var(&c.Limits.MaxBodySize, "max-body-size", c.Limits.MaxBodySize, "max size of request body in bytes")
+	fs.StringVar(&c.Providers.SecretsFile, "provider-secrets", c.Providers.SecretsFile, "JSON file with secrets of game providers: {\"provider\": [\"secret\", \"next secret\"]}")
+	fs.DurationVar(&c.Providers.SignatureWindow, "signature-window", c.Providers.SignatureWindow, "max age of signed provider requests")
+	fs.StringVar(&c.Trace.Exporter, "trace-exporter", c.Trace.Exporter, "trace exporter: stdout or otlp, tracing is disabled when empty")
+	fs.StringVar(&c.Trace.File, "trace-file", c.Trace.File, "file which stdout exporter writes spans to, - for stdout")
+	fs.StringVar(&c.Trace.Endpoint, "trace-endpoint", c.Trace.Endpoint, "host:port of OTLP HTTP collector, OTEL_EXPORTER_OTLP_ENDPOINT is used when empty")
+	fs.BoolVar(&c.Trace.Insecure, "trace-insecure", c.Trace.Insecure, "send spans to OTLP collector without TLS")
+	fs.Float64Var(&c.Trace.SampleRatio, "trace-sample-ratio", c.Trace.SampleRatio, "fraction of new traces which are recorded, 0 records all")
+}
+
+// Build config from defaults, file, environment and command line arguments.
+// printOnly is set by -print-config flag.
+func Load(args []string, environ []string) (c *Config, printOnly bool, err error) {
+	// flags are parsed first to find config file, but applied last
+	flags := flag.NewFlagSet("apiserver", flag.ContinueOnError)
+	Default().bind(flags)
+	configFile := flags.String("config", "", "YAML or JSON config file")
+	flags.BoolVar(&printOnly, "print-config", false, "print effective config and exit")
+	if err = flags.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	c = Default()
+	if *configFile != "" {
+		data, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return nil, false, err
+		}
+		// JSON is valid YAML
+		if err = yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, false, fmt.Errorf("Can't parse %s: %s", *configFile, err)
+		}
+	}
+
+	settings := flag.NewFlagSet("settings", flag.ContinueOnError)
+	c.bind(settings)
+	env := make(map[string]string)
+	for _, item := range environ {
+		if i := strings.Index(item, "="); i > 0 {
+			env[item[:i]] = item[i+1:]
+		}
+	}
+	var errs []string
+	settings.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := env[name]; ok {
+			if err := settings.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+			}
+		}
+	})
+	flags.Visit(func(f *flag.Flag) {
+		if settings.Lookup(f.Name) != nil {
+			settings.Set(f.Name, f.Value.String())
+		}
+	})
+	if len(errs) > 0 {
+		return nil, false, errors.New(strings.Join(errs, "\n"))
+	}
+	return c, printOnly, c.Validate()
+}
+
+// Report every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.Addr != "", "addr is required")
+	check(c.DBPath != "", "dbPath is required")
+	_, err := logrus.ParseLevel(c.Log.Level)
+	check(err == nil, "log.level: %s", err)
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format must be text or json")
+	for name, d := range map[string]time.Duration{
+		"http.readTimeout":          c.HTTP.ReadTimeout,
+		"http.writeTimeout":         c.HTTP.WriteTimeout,
+		"http.idleTimeout":          c.HTTP.IdleTimeout,
+		"http.requestTimeout":       c.HTTP.RequestTimeout,
+		"http.shutdownTimeout":      c.HTTP.ShutdownTimeout,
+		"store.flushInterval":       c.Store.FlushInterval,
+		"store.holdTTL":             c.Store.HoldTTL,
+		"store.bonusTTL":            c.Store.BonusTTL,
+		"store.limitCoolingOff":     c.Store.LimitCoolingOff,
+		"store.tokenTTL":            c.Store.TokenTTL,
+		"providers.signatureWindow": c.Providers.SignatureWindow,
+	} {
+		check(d > 0, "%s must be positive", name)
+	}
+	_, err = store.ParsePersistenceMode(c.Store.Persistence)
+	check(err == nil, "store.persistence: %s", err)
+	_, err = store.ParseRecoveryPolicy(c.Store.Recovery)
+	check(err == nil, "store.recovery: %s", err)
+	_, err = store.ParseBonusBetOrder(c.Store.BonusBetOrder)
+	check(err == nil, "store.bonusBetOrder: %s", err)
+	check(c.Store.BonusWagering > 0, "store.bonusWagering must be positive")
+	check(len(c.CORS.AllowedOrigins) > 0, "cors.allowedOrigins is required")
+	for route, limit := range c.Limits.Rate {
+		check(limit.Rate > 0 && limit.Burst > 0, "limits.rate of %s must have positive rate and burst", route)
+	}
+	check(c.HTTP.ShutdownDelay >= 0, "http.shutdownDelay can't be negative")
+	check(c.Limits.MaxInFlight >= 0, "limits.maxInFlight can't be negative")
+	check(c.Limits.MaxBodySize > 0, "limits.maxBodySize must be positive")
+	switch c.Trace.Exporter {
+	case "", trace.ExporterStdout, trace.ExporterOTLP:
+	default:
+		check(false, "trace.exporter must be stdout or otlp")
+	}
+	check(c.Trace.SampleRatio >= 0 && c.Trace.SampleRatio <= 1, "trace.sampleRatio must be between 0 and 1")
+	if c.Providers.SecretsFile != "" {
+		_, err = server.LoadProviderSecrets(c.Providers.SecretsFile)
+		check(err == nil, "providers.secretsFile: %s", err)
+	}
+	if len(errs) > 0 {
+		return errors.New("Invalid config:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// Config must be valid
+func (c *Config) TraceConfig() trace.Config {
+	exporter := c.Trace.Exporter
+	if exporter == "" && c.Trace.File != "" {
+		exporter = trace.ExporterStdout
+	}
+	return trace.Config{
+		Exporter:    exporter,
+		File:        c.Trace.File,
+		Endpoint:    c.Trace.Endpoint,
+		Insecure:    c.Trace.Insecure,
+		SampleRatio: c.Trace.SampleRatio,
+	}
+}
+
+// Config must be valid
+func (c *Config) StoreConfig() store.Config {
+	persistence, _ := store.ParsePersistenceMode(c.Store.Persistence)
+	recovery, _ := store.ParseRecoveryPolicy(c.Store.Recovery)
+	betOrder, _ := store.ParseBonusBetOrder(c.Store.BonusBetOrder)
+	return store.Config{
+		DBName:          c.DBPath,
+		Persistence:     persistence,
+		Recovery:        recovery,
+		HoldTTL:         c.Store.HoldTTL,
+		BonusWagering:   c.Store.BonusWagering,
+		BonusBetOrder:   betOrder,
+		BonusTTL:        c.Store.BonusTTL,
+		LimitCoolingOff: c.Store.LimitCoolingOff,
+		TokenTTL:        c.Store.TokenTTL,
+		FlushInterval:   c.Store.FlushInterval,
+	}
+}
+
+// Config must be valid, provider secrets are read from file
+func (c *Config) ServerConfig() (server.Config, error) {
+	config := server.Config{
+		Addr:            c.Addr,
+		ReadTimeout:     c.HTTP.ReadTimeout,
+		WriteTimeout:    c.HTTP.WriteTimeout,
+		IdleTimeout:     c.HTTP.IdleTimeout,
+		RequestTimeout:  c.HTTP.RequestTimeout,
+		ShutdownTimeout: c.HTTP.ShutdownTimeout,
+		ShutdownDelay:   c.HTTP.ShutdownDelay,
+		CORSOrigins:     c.CORS.AllowedOrigins,
+		SignatureWindow: c.Providers.SignatureWindow,
+		RateLimits:      c.Limits.Rate,
+		MaxInFlight:     c.Limits.MaxInFlight,
+		MaxBodySize:     c.Limits.MaxBodySize,
+		LogBodies:       c.Log.Bodies,
+	}
+	if c.Providers.SecretsFile != "" {
+		var err error
+		if config.Providers, err = server.LoadProviderSecrets(c.Providers.SecretsFile); err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+// Configure logger level and format, config must be valid
+func (c *Config) ConfigureLogger(logger *logrus.Logger) {
+	level, _ := logrus.ParseLevel(c.Log.Level)
+	logger.SetLevel(level)
+	if c.Log.Format == "json" {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	}
+}
+
+// YAML of the effective config
+func (c *Config) String() string {
+	data, _ := yaml.Marshal(c)
+	return string(data)
+}
+
+// Comma separated list flag
+type listValue []string
+
+func (v *listValue) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *listValue) Set(s string) error {
+	*v = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
+
+type rateLimitsValue server.RateLimits
+
+func (v *rateLimitsValue) String() string {
+	return server.RateLimits(*v).String()
+}
+
+func (v *rateLimitsValue) Set(s string) error {
+	limits, err := server.ParseRateLimits(s)
+	if err != nil {
+		return err
+	}
+	*v = rateLimitsValue(limits)
+	return nil
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dehimb/cake/internal/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cake-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	yamlFile := writeFile(t, dir, "cake.yaml", `
+addr: ":9000"
+log:
+  level: warn
+http:
+  readTimeout: 3s
+cors:
+  allowedOrigins: [https://a.example]
+limits:
+  rate:
+    /transaction: {rate: 5, burst: 10}
+`)
+	jsonFile := writeFile(t, dir, "cake.json", `{"dbPath": "file.db", "store": {"flushInterval": "30s"}}`)
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     []string
+		check   func(t *testing.T, c *Config)
+		printed bool
+	}{
+		{
+			name: "Defaults",
+			check: func(t *testing.T, c *Config) {
+				assert.Equal(t, Default(), c)
+			},
+		},
+		{
+			name: "YAML file",
+			args: []string{"-config", yamlFile},
+			check: func(t *testing.T, c *Config) {
+				assert.Equal(t, ":9000", c.Addr)
+				assert.Equal(t, "warn", c.Log.Level)
+				assert.Equal(t, 3*time.Second, c.HTTP.ReadTimeout)
+				assert.Equal(t, server.DefaultWriteTimeout, c.HTTP.WriteTimeout)
+				assert.Equal(t, []string{"https://a.example"}, c.CORS.AllowedOrigins)
+				assert.Equal(t, server.RateLimit{Rate: 5, Burst: 10}, c.Limits.Rate["/transaction"])
+			},
+		},
+		{
+			name: "JSON file",
+			args: []string{"-config", jsonFile},
+			check: func(t *testing.T, c *Config) {
+				assert.Equal(t, "file.db", c.DBPath)
+				assert.Equal(t, 30*time.Second, c.Store.FlushInterval)
+			},
+		},
+		{
+			name: "Environment overrides file",
+			args: []string{"-config", yamlFile},
+			env:  []string{"CAKE_ADDR=:9001", "CAKE_CORS_ORIGINS=https://b.example,https://c.example", "OTHER=1"},
+			check: func(t *testing.T, c *Config) {
+				assert.Equal(t, ":9001", c.Addr)
+				assert.Equal(t, "warn", c.Log.Level)
+				assert.Equal(t, []string{"https://b.example", "https://c.example"}, c.CORS.AllowedOrigins)
+			},
+		},
+		{
+			name: "Flags override environment",
+			args: []string{"-config", yamlFile, "-addr", ":9002", "-rate-limits", "default=1:2", "-print-config"},
+			env:  []string{"CAKE_ADDR=:9001", "CAKE_LOG_LEVEL=error"},
+			check: func(t *testing.T, c *Config) {
+				assert.Equal(t, ":9002", c.Addr)
+				assert.Equal(t, "error", c.Log.Level)
+				assert.Equal(t, server.RateLimits{"default": {Rate: 1, Burst: 2}}, c.Limits.Rate)
+			},
+			printed: true,
+		},
+		{
+			name: "Trace file implies stdout exporter",
+			args: []string{"-trace-file", "spans.json", "-trace-sample-ratio", "0.5"},
+			check: func(t *testing.T, c *Config) {
+				assert.Equal(t, "stdout", c.TraceConfig().Exporter)
+				assert.Equal(t, "spans.json", c.TraceConfig().File)
+				assert.Equal(t, 0.5, c.TraceConfig().SampleRatio)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, printOnly, err := Load(test.args, test.env)
+			if assert.NoError(t, err) {
+				test.check(t, c)
+				assert.Equal(t, test.printed, printOnly)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	unknownField := writeFile(t, dir, "unknown.yaml", "adress: :9000\n")
+
+	tests := []struct {
+		name   string
+		args   []string
+		env    []string
+		errors []string
+	}{
+		{name: "Unknown flag", args: []string{"-adress", ":9000"}, errors: []string{"flag provided but not defined"}},
+		{name: "Missing file", args: []string{"-config", "missing.yaml"}, errors: []string{"missing.yaml"}},
+		{name: "Unknown file field", args: []string{"-config", unknownField}, errors: []string{"field adress not found"}},
+		{name: "Invalid environment", env: []string{"CAKE_READ_TIMEOUT=soon"}, errors: []string{"CAKE_READ_TIMEOUT"}},
+		{
+			name: "All invalid settings are reported",
+			args: []string{"-log-level", "loud", "-log-format", "xml", "-write-timeout", "0s", "-persistence", "never", "-max-body-size", "0"},
+			errors: []string{
+				"log.level", "log.format", "http.writeTimeout must be positive", "store.persistence", "limits.maxBodySize must be positive",
+			},
+		},
+		{
+			name:   "Invalid trace settings",
+			args:   []string{"-trace-exporter", "zipkin", "-trace-sample-ratio", "2"},
+			errors: []string{"trace.exporter", "trace.sampleRatio"},
+		},
+		{name: "Missing secrets file", args: []string{"-provider-secrets", "missing.json"}, errors: []string{"providers.secretsFile"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := Load(test.args, test.env)
+			if assert.Error(t, err) {
+				for _, message := range test.errors {
+					assert.Contains(t, err.Error(), message)
+				}
+			}
+		})
+	}
+}
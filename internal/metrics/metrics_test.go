@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("requests_total", "Handled requests.", "route", "status")
+	users := r.NewGauge("cached_users", "Users in cache.")
+	latency := r.NewHistogram("latency_seconds", "Request latency\nin seconds.", []float64{0.1, 1}, "route")
+
+	requests.Inc("/user", "200")
+	requests.Add(2, "/user", "200")
+	requests.Inc(`/a"b\`, "500")
+	users.Set(10)
+	users.Dec()
+	latency.Observe(0.05, "/user")
+	latency.Observe(0.1, "/user")
+	latency.Observe(3, "/user")
+
+	var b bytes.Buffer
+	n, err := r.WriteTo(&b)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(b.Len()), n)
+	assert.Equal(t, `# HELP requests_total Handled requests.
+# TYPE requests_total counter
+requests_total{route="/a\"b\\",status="500"} 1
+requests_total{route="/user",status="200"} 3
+# HELP cached_users Users in cache.
+# TYPE cached_users gauge
+cached_users 9
+# HELP latency_seconds Request latency\nin seconds.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/user",le="0.1"} 2
+latency_seconds_bucket{route="/user",le="1"} 2
+latency_seconds_bucket{route="/user",le="+Inf"} 3
+latency_seconds_sum{route="/user"} 3.15
+latency_seconds_count{route="/user"} 3
+`, b.String())
+
+	assert.Equal(t, float64(3), requests.Value("/user", "200"))
+	assert.Equal(t, float64(0), requests.Value("/user", "404"))
+	assert.Equal(t, uint64(3), latency.Count("/user"))
+}
+
+func TestMisuse(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("total", "Total.", "route")
+	assert.Panics(t, func() { r.NewGauge("total", "Duplicate.") })
+	assert.Panics(t, func() { c.Inc() })
+	assert.Panics(t, func() { c.Add(-1, "/user") })
+	assert.Panics(t, func() { r.NewHistogram("h", "Unsorted.", []float64{1, 0.1}) })
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("total", "Total.").Inc()
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, contentType, rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), "total 1\n")
+}
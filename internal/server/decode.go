@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/dehimb/cake/internal/store"
+	"github.com/dehimb/cake/internal/trace"
+)
+
+// Request body is read once by readBody middleware and kept in the context.
+// Auth middlewares take token and user from it, handlers decode it strictly:
+// unknown and duplicate fields are rejected and decoded value is validated.
+
+const DefaultMaxBodySize = 64 << 10
+
+type requestBody struct {
+	raw []byte
+	// Top level fields, nil when body is not JSON object
+	fields map[string]json.RawMessage
+}
+
+func newRequestBody(raw []byte) *requestBody {
+	body := &requestBody{raw: raw}
+	// malformed body is reported by handler
+	json.Unmarshal(raw, &body.fields)
+	return body
+}
+
+// Decode top level field, report whether it is present and valid
+func (b *requestBody) field(name string, dst interface{}) bool {
+	value, ok := b.fields[name]
+	return ok && json.Unmarshal(value, dst) == nil
+}
+
+// Value of "userId" field, 0 when it is missing or invalid.
+// Field is decoded by the same rules as request types in decodeBody, so keys
+// like "UserID" which encoding/json matches case-insensitively give the user
+// handler acts on.
+func bodyUserID(b *requestBody) uint64 {
+	var request struct {
+		UserID json.Number `json:"userId"`
+	}
+	json.Unmarshal(b.raw, &request)
+	id, _ := strconv.ParseUint(request.UserID.String(), 10, 64)
+	return id
+}
+
+// Body without deprecated "token" field, which is not a part of request types
+func (b *requestBody) payload() []byte {
+	if _, ok := b.fields["token"]; !ok {
+		return b.raw
+	}
+	fields := make(map[string]json.RawMessage, len(b.fields))
+	for name, value := range b.fields {
+		if name != "token" {
+			fields[name] = value
+		}
+	}
+	payload, _ := json.Marshal(fields)
+	return payload
+}
+
+// Body read by readBody. Requests which didn't pass the middleware,
+// like in handler tests, are read here.
+func bodyFrom(r *http.Request) *requestBody {
+	if body, ok := r.Context().Value(bodyKey).(*requestBody); ok {
+		return body
+	}
+	if r.Body == nil {
+		return newRequestBody(nil)
+	}
+	raw, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewBuffer(raw))
+	return newRequestBody(raw)
+}
+
+// Failure of request decoding or validation
+type requestError struct {
+	Message string
+	Code    store.ErrorCode
+	Status  int
+	Details []FieldError
+}
+
+func (e *requestError) Error() string {
+	return e.Message
+}
+
+func (e *requestError) response() *ErrorResponse {
+	return &ErrorResponse{Error: e.Message, Code: e.Code, Details: e.Details}
+}
+
+func fieldsError(details []FieldError) *requestError {
+	return &requestError{Message: details[0].Message, Code: store.CodeInvalidField, Status: http.StatusBadRequest, Details: details}
+}
+
+// Check Content-Type and size of POST and PUT bodies and keep body in the context
+func (m *middleware) readBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" && r.Method != "PUT" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			sendErrorResponseWithCode(w, "Content-Type must be application/json", store.CodeUnsupportedMediaType, http.StatusUnsupportedMediaType)
+			return
+		}
+		raw, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, m.maxBodySize))
+		if err != nil {
+			if strings.Contains(err.Error(), "request body too large") {
+				sendErrorResponseWithCode(w, fmt.Sprintf("Body is larger than %d bytes", m.maxBodySize), store.CodeRequestTooLarge, http.StatusRequestEntityTooLarge)
+				return
+			}
+			m.log(r).Error("Failed to read request body: ", err)
+			sendErrorResponse(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if field := duplicateField(raw); field != "" {
+			sendError(w, http.StatusBadRequest, fieldsError([]FieldError{{Field: field, Message: "Duplicate field"}}).response())
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewBuffer(raw))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), bodyKey, newRequestBody(raw))))
+	})
+}
+
+// Decode request body into dst and validate it, see validateRequest
+func (h *handler) decodeBody(r *http.Request, dst interface{}) error {
+	_, span := trace.Start(r.Context(), "decode body")
+	defer span.End()
+	body := bodyFrom(r)
+	dec := json.NewDecoder(bytes.NewReader(body.payload()))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return decodeError(body, dst, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return &requestError{Message: "Body must contain single JSON object", Code: store.CodeInvalidRequest, Status: http.StatusBadRequest}
+	}
+	if details := validateRequest(dst); len(details) > 0 {
+		return fieldsError(details)
+	}
+	return nil
+}
+
+// Find field which failed decoding when possible
+func decodeError(body *requestBody, dst interface{}, err error) error {
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &typeError) && typeError.Field != "" {
+		return fieldsError([]FieldError{{Field: typeError.Field, Message: "Invalid value, " + typeError.Value + " is not allowed"}})
+	}
+	if strings.HasPrefix(err.Error(), "json: unknown field ") {
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return fieldsError([]FieldError{{Field: field, Message: "Unknown field"}})
+	}
+	// errors of custom types like store.Money don't include field, so fields are tried one by one
+	for name, value := range body.fields {
+		single, _ := json.Marshal(map[string]json.RawMessage{name: value})
+		if fieldErr := json.Unmarshal(single, reflect.New(reflect.TypeOf(dst).Elem()).Interface()); fieldErr != nil {
+			return fieldsError([]FieldError{{Field: name, Message: fieldErr.Error()}})
+		}
+	}
+	return &requestError{Message: "Invalid JSON: " + err.Error(), Code: store.CodeInvalidRequest, Status: http.StatusBadRequest}
+}
+
+// Return dotted path of the first field which occurs twice in the same object
+func duplicateField(raw []byte) string {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	field, _ := scanDuplicates(dec, "")
+	return field
+}
+
+func scanDuplicates(dec *json.Decoder, path string) (string, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	switch token {
+	case json.Delim('{'):
+		seen := make(map[string]bool)
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return "", err
+			}
+			name := key.(string)
+			if path != "" {
+				name = path + "." + name
+			}
+			if seen[name] {
+				return name, nil
+			}
+			seen[name] = true
+			if field, err := scanDuplicates(dec, name); field != "" || err != nil {
+				return field, err
+			}
+		}
+		_, err = dec.Token()
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if field, err := scanDuplicates(dec, path+"["+strconv.Itoa(i)+"]"); field != "" || err != nil {
+				return field, err
+			}
+		}
+		_, err = dec.Token()
+	}
+	return "", err
+}
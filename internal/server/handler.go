@@ -1,10 +1,13 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dehimb/cake/internal/store"
 	"github.com/gorilla/mux"
@@ -15,38 +18,187 @@ type handler struct {
 	router       *mux.Router
 	storeHandler store.StoreHandler
 	logger       *logrus.Logger
+	// Nil when number of requests in flight is not limited
+	inFlight *inFlightLimiter
+	// Closed when shutdown begins, see readyz
+	shutdown <-chan struct{}
 }
 
 func (h *handler) initRouter(m MiddlewareDispatcher) {
 	// Provide all middlewares from one method
 	h.router.Use(m.populate()...)
 
-	h.router.HandleFunc("/user", h.userPost).Methods("POST")
-	h.router.HandleFunc("/user", h.userGet).Methods("GET")
-	h.router.HandleFunc("/user/deposit", h.depositPost).Methods("POST")
-	h.router.HandleFunc("/transaction", h.transactionPost).Methods("POST")
+	// Every route except ping requires scope, see store.Scope.
+	// Routes which change balance are limited by number of user requests in flight.
+	h.router.HandleFunc("/user", h.requireScope(store.ScopeUsersCreate, h.userPost)).Methods("POST")
+	h.router.HandleFunc("/user", h.requireScope(store.ScopeUsersRead, h.userGet)).Methods("GET")
+	h.router.HandleFunc("/user/deposit", h.requireScope(store.ScopeDepositsWrite, h.limitInFlight(h.depositPost))).Methods("POST")
+	h.router.HandleFunc("/user/history", h.requireScope(store.ScopeUsersRead, h.historyGet)).Methods("GET")
+	h.router.HandleFunc("/user/withdrawal", h.requireScope(store.ScopeWithdrawalsWrite, h.limitInFlight(h.withdrawalPost))).Methods("POST")
+	h.router.HandleFunc("/user/limits", h.requireScope(store.ScopeUsersRead, h.limitsGet)).Methods("GET")
+	h.router.HandleFunc("/user/limits", h.requireScope(store.ScopeUsersWrite, h.limitsPost)).Methods("POST")
+	h.router.HandleFunc("/user/status", h.requireScope(store.ScopeUsersWrite, h.statusPost)).Methods("POST")
+	h.router.HandleFunc("/admin/withdrawal/approve", h.requireScope(store.ScopeAdmin, h.withdrawalApprovePost)).Methods("POST")
+	h.router.HandleFunc("/admin/withdrawal/reject", h.requireScope(store.ScopeAdmin, h.withdrawalRejectPost)).Methods("POST")
+	h.router.HandleFunc("/admin/bonus", h.requireScope(store.ScopeAdmin, h.limitInFlight(h.bonusPost))).Methods("POST")
+	h.router.HandleFunc("/admin/user/status", h.requireScope(store.ScopeAdmin, h.adminStatusPost)).Methods("POST")
+	h.router.HandleFunc("/session", h.requireScope(store.ScopeUsersWrite, h.sessionPost)).Methods("POST")
+	h.router.HandleFunc("/session/refresh", h.requireScope(store.ScopeUsersWrite, h.sessionRefreshPost)).Methods("POST")
+	h.router.HandleFunc("/session/revoke", h.requireScope(store.ScopeUsersWrite, h.sessionRevokePost)).Methods("POST")
+	h.router.HandleFunc("/transaction", h.requireScope(store.ScopeTransactionsWrite, h.limitInFlight(h.transactionPost))).Methods("POST")
+	h.router.HandleFunc("/transaction/rollback", h.requireScope(store.ScopeTransactionsWrite, h.limitInFlight(h.rollbackPost))).Methods("POST")
+	h.router.HandleFunc("/hold", h.requireScope(store.ScopeTransactionsWrite, h.limitInFlight(h.holdPost))).Methods("POST")
+	h.router.HandleFunc("/hold/capture", h.requireScope(store.ScopeTransactionsWrite, h.limitInFlight(h.holdCapturePost))).Methods("POST")
+	h.router.HandleFunc("/hold/release", h.requireScope(store.ScopeTransactionsWrite, h.limitInFlight(h.holdReleasePost))).Methods("POST")
 	h.router.HandleFunc("/ping", h.ping).Methods("GET", "POST", "PUT")
+
+	// Wallet callbacks of game providers, requests are signed instead of token
+	provider := h.router.PathPrefix(strings.TrimSuffix(providerPathPrefix, "/")).Subrouter()
+	provider.Use(m.populateProvider()...)
+	provider.HandleFunc("/transaction", h.requireScope(store.ScopeTransactionsWrite, h.limitInFlight(h.transactionPost))).Methods("POST")
+	provider.HandleFunc("/transaction/rollback", h.requireScope(store.ScopeTransactionsWrite, h.limitInFlight(h.rollbackPost))).Methods("POST")
+	provider.HandleFunc("/hold", h.requireScope(store.ScopeTransactionsWrite, h.limitInFlight(h.holdPost))).Methods("POST")
+	provider.HandleFunc("/hold/capture", h.requireScope(store.ScopeTransactionsWrite, h.limitInFlight(h.holdCapturePost))).Methods("POST")
+	provider.HandleFunc("/hold/release", h.requireScope(store.ScopeTransactionsWrite, h.limitInFlight(h.holdReleasePost))).Methods("POST")
 	h.router.PathPrefix("/").HandlerFunc(h.defaultHandler)
 }
 
+// Allow request only when principal resolved by checkToken has scope
+func (h *handler) requireScope(scope store.Scope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal := principalFrom(r.Context())
+		if principal == nil {
+			sendErrorResponseWithCode(w, "Token is required", store.CodeUnauthenticated, http.StatusUnauthorized)
+			return
+		}
+		if !principal.HasScope(scope) {
+			sendErrorResponseWithCode(w, "Scope "+string(scope)+" is required", store.CodeForbidden, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Request scoped log entry, see middleware.requestID
+func (h *handler) log(r *http.Request) *logrus.Entry {
+	return store.LoggerFrom(r.Context(), h.logger)
+}
+
+// Name of the operator which made request, empty for user sessions
+func operatorOf(r *http.Request) string {
+	if principal := principalFrom(r.Context()); principal != nil {
+		return principal.Operator
+	}
+	return ""
+}
+
 func (h *handler) transactionPost(w http.ResponseWriter, r *http.Request) {
 	var t store.Transaction
-	err := h.parseRequestBody(r, &t)
+	err := h.decodeBody(r, &t)
 	if err != nil {
-		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		h.processError(w, r, err)
 		return
 	}
-	balance, err := h.storeHandler.CreateTransaction(&t)
+	t.Operator = operatorOf(r)
+	balance, err := h.storeHandler.CreateTransaction(r.Context(), &t)
 	if err != nil {
-		h.processError(w, err)
+		h.processError(w, r, err)
+		return
+	}
+	h.sendResponse(w, http.StatusOK, &DepositResponse{
+		Balance: balance,
+		Errror:  "",
+	})
+}
+
+// Rollback bet referenced by originalTransactionId
+func (h *handler) rollbackPost(w http.ResponseWriter, r *http.Request) {
+	var t store.Transaction
+	err := h.decodeBody(r, &t)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	t.Operator = operatorOf(r)
+	t.Type = store.Rollback
+	balance, err := h.storeHandler.CreateTransaction(r.Context(), &t)
+	if err != nil {
+		h.processError(w, r, err)
 		return
 	}
 	h.sendResponse(w, http.StatusOK, &DepositResponse{
 		Balance: balance,
 		Errror:  "",
 	})
-	w.WriteHeader(http.StatusOK)
 }
+
+// Reserve funds for the bet which outcome is not known yet
+func (h *handler) holdPost(w http.ResponseWriter, r *http.Request) {
+	var hold store.Hold
+	err := h.decodeBody(r, &hold)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	hold.Operator = operatorOf(r)
+	available, err := h.storeHandler.AuthorizeHold(r.Context(), &hold)
+	status, code := http.StatusOK, store.ErrorCode("")
+	if balance, ok := replayed(err); ok {
+		available, status, code, err = balance, http.StatusAlreadyReported, store.CodeOf(err), nil
+	}
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	h.sendResponse(w, status, &HoldResponse{
+		HoldID:           hold.ID,
+		Status:           hold.Status,
+		AvailableBalance: available,
+		ExpiresAt:        hold.ExpiresAt.UTC(),
+		Code:             code,
+	})
+}
+
+// Turn hold into bet, responds with the new balance
+func (h *handler) holdCapturePost(w http.ResponseWriter, r *http.Request) {
+	var hold store.Hold
+	err := h.decodeBody(r, &hold)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	hold.Operator = operatorOf(r)
+	balance, err := h.storeHandler.CaptureHold(r.Context(), &hold)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	h.sendResponse(w, http.StatusOK, &DepositResponse{
+		Balance: balance,
+		Errror:  "",
+	})
+}
+
+func (h *handler) holdReleasePost(w http.ResponseWriter, r *http.Request) {
+	var hold store.Hold
+	err := h.decodeBody(r, &hold)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	hold.Operator = operatorOf(r)
+	available, err := h.storeHandler.ReleaseHold(r.Context(), &hold)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	h.sendResponse(w, http.StatusOK, &HoldResponse{
+		HoldID:           hold.ID,
+		Status:           hold.Status,
+		AvailableBalance: available,
+	})
+}
+
 func (h *handler) defaultHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 }
@@ -58,14 +210,15 @@ func (h *handler) ping(w http.ResponseWriter, r *http.Request) {
 
 func (h *handler) depositPost(w http.ResponseWriter, r *http.Request) {
 	var d store.Deposit
-	err := h.parseRequestBody(r, &d)
+	err := h.decodeBody(r, &d)
 	if err != nil {
-		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		h.processError(w, r, err)
 		return
 	}
-	balance, err := h.storeHandler.CreateDeposit(&d)
+	d.Operator = operatorOf(r)
+	balance, err := h.storeHandler.CreateDeposit(r.Context(), &d)
 	if err != nil {
-		h.processError(w, err)
+		h.processError(w, r, err)
 		return
 	}
 	h.sendResponse(w, http.StatusOK, &DepositResponse{
@@ -74,62 +227,337 @@ func (h *handler) depositPost(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// Create pending withdrawal, funds are reserved until approval or rejection
+func (h *handler) withdrawalPost(w http.ResponseWriter, r *http.Request) {
+	var withdrawal store.Withdrawal
+	err := h.decodeBody(r, &withdrawal)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	withdrawal.Operator = operatorOf(r)
+	balance, err := h.storeHandler.CreateWithdrawal(r.Context(), &withdrawal)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	h.sendResponse(w, http.StatusOK, &DepositResponse{
+		Balance: balance,
+		Errror:  "",
+	})
+}
+
+func (h *handler) withdrawalApprovePost(w http.ResponseWriter, r *http.Request) {
+	h.resolveWithdrawal(w, r, h.storeHandler.ApproveWithdrawal)
+}
+
+func (h *handler) withdrawalRejectPost(w http.ResponseWriter, r *http.Request) {
+	h.resolveWithdrawal(w, r, h.storeHandler.RejectWithdrawal)
+}
+
+func (h *handler) resolveWithdrawal(w http.ResponseWriter, r *http.Request, resolve func(ctx context.Context, id uint64, operator string) (*store.Withdrawal, error)) {
+	var withdrawal store.Withdrawal
+	err := h.decodeBody(r, &withdrawal)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	withdrawal.Operator = operatorOf(r)
+	result, err := resolve(r.Context(), withdrawal.ID, withdrawal.Operator)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	h.sendResponse(w, http.StatusOK, &WithdrawalResponse{
+		Withdrawal: *result,
+	})
+}
+
+// Credit user bonus wallet, responds with the new bonus balance
+func (h *handler) bonusPost(w http.ResponseWriter, r *http.Request) {
+	var b store.Bonus
+	err := h.decodeBody(r, &b)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	b.Operator = operatorOf(r)
+	bonusBalance, err := h.storeHandler.GrantBonus(r.Context(), &b)
+	status, code := http.StatusOK, store.ErrorCode("")
+	if balance, ok := replayed(err); ok {
+		bonusBalance, status, code, err = balance, http.StatusAlreadyReported, store.CodeOf(err), nil
+	}
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	h.sendResponse(w, status, &BonusResponse{
+		BonusBalance: bonusBalance,
+		Code:         code,
+	})
+}
+
+func (h *handler) limitsGet(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil || userID == 0 {
+		sendFieldError(w, "id", "Invalid user id")
+		return
+	}
+	limits, err := h.storeHandler.GetLimits(r.Context(), userID)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	if limits == nil {
+		limits = []store.Limit{}
+	}
+	h.sendResponse(w, http.StatusOK, &LimitsResponse{Limits: limits})
+}
+
+// Set user limit. Increase and removal (zero amount) take effect after cooling-off
+// period, so response may contain pending change.
+// Fields of store.Limit which client sets, usage and pending change are owned by store
+type LimitRequest struct {
+	UserID uint64            `json:"userId"`
+	Type   store.LimitType   `json:"type"`
+	Period store.LimitPeriod `json:"period"`
+	Amount store.Money       `json:"amount"`
+}
+
+func (h *handler) limitsPost(w http.ResponseWriter, r *http.Request) {
+	var l LimitRequest
+	err := h.decodeBody(r, &l)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	limit, err := h.storeHandler.SetLimit(r.Context(), &store.Limit{UserID: l.UserID, Type: l.Type, Period: l.Period, Amount: l.Amount})
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	h.sendResponse(w, http.StatusOK, &LimitResponse{Limit: limit})
+}
+
+// Self-exclusion or closure requested by the user
+func (h *handler) statusPost(w http.ResponseWriter, r *http.Request) {
+	h.changeStatus(w, r, false)
+}
+
+// Any status change made by operator
+func (h *handler) adminStatusPost(w http.ResponseWriter, r *http.Request) {
+	h.changeStatus(w, r, true)
+}
+
+func (h *handler) changeStatus(w http.ResponseWriter, r *http.Request, admin bool) {
+	var c store.StatusChange
+	err := h.decodeBody(r, &c)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	c.Admin = admin
+	user, err := h.storeHandler.SetAccountStatus(r.Context(), &c)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	h.sendResponse(w, http.StatusOK, &StatusResponse{
+		UserID:      user.ID,
+		Status:      user.Status,
+		StatusUntil: statusUntil(user),
+	})
+}
+
+// End of self-exclusion for responses, nil for other statuses
+func statusUntil(user *store.User) *time.Time {
+	if user.Status != store.StatusSelfExcluded {
+		return nil
+	}
+	until := user.StatusUntil.UTC()
+	return &until
+}
+
 func (h *handler) userGet(w http.ResponseWriter, r *http.Request) {
 	userID, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
 	if err != nil || userID == 0 {
-		sendErrorResponse(w, "Invalid user id", http.StatusBadRequest)
+		sendFieldError(w, "id", "Invalid user id")
 		return
 	}
-	user, statistic, err := h.storeHandler.GetUser(userID)
+	user, statistic, err := h.storeHandler.GetUser(r.Context(), userID)
 	if err != nil {
-		h.processError(w, err)
+		h.processError(w, r, err)
 		return
 	}
 	h.sendResponse(w, http.StatusOK, &UserResponse{
-		UserID:        user.ID,
-		Balance:       user.Balance,
-		DepositeCount: statistic.DepositeCount,
-		DepositSum:    statistic.DepositSum,
-		BetCount:      statistic.BetCount,
-		BetSum:        statistic.BetSum,
-		WinCount:      statistic.WinCount,
-		WinSum:        statistic.WinSum,
+		UserID:           user.ID,
+		Balance:          user.Balance,
+		AvailableBalance: user.Available(),
+		DepositeCount:    statistic.DepositeCount,
+		DepositSum:       statistic.DepositSum,
+		BetCount:         statistic.BetCount,
+		BetSum:           statistic.BetSum,
+		WinCount:         statistic.WinCount,
+		WinSum:           statistic.WinSum,
+
+		WithdrawalCount:        statistic.WithdrawalCount,
+		WithdrawalSum:          statistic.WithdrawalSum,
+		PendingWithdrawalCount: statistic.PendingWithdrawalCount,
+		PendingWithdrawalSum:   statistic.PendingWithdrawalSum,
+
+		BonusBalance:      user.Bonus,
+		WageringLeft:      user.WageringLeft,
+		BetBonusSum:       statistic.BetBonusSum,
+		WinBonusSum:       statistic.WinBonusSum,
+		BonusGrantedSum:   statistic.BonusGrantedSum,
+		BonusConvertedSum: statistic.BonusConvertedSum,
+		BonusExpiredSum:   statistic.BonusExpiredSum,
+
+		Status:      user.Status,
+		StatusUntil: statusUntil(user),
+	})
+}
+
+// List user deposits and transactions, newest first.
+// Supports filters by type (comma separated), date range (RFC3339) and amount range.
+func (h *handler) historyGet(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	userID, err := strconv.ParseUint(params.Get("id"), 10, 64)
+	if err != nil || userID == 0 {
+		sendFieldError(w, "id", "Invalid user id")
+		return
+	}
+	q := &store.HistoryQuery{
+		UserID: userID,
+		Cursor: params.Get("cursor"),
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit <= 0 {
+			sendFieldError(w, "limit", "Invalid limit")
+			return
+		}
+	}
+	if types := params.Get("type"); types != "" {
+		for _, t := range strings.Split(types, ",") {
+			q.Types = append(q.Types, store.TransactionType(t))
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if value := params.Get(p.name); value != "" {
+			if *p.dst, err = time.Parse(time.RFC3339, value); err != nil {
+				sendFieldError(w, p.name, "Invalid "+p.name+" date")
+				return
+			}
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  *store.Money
+	}{{"minAmount", &q.MinAmount}, {"maxAmount", &q.MaxAmount}} {
+		if value := params.Get(p.name); value != "" {
+			if *p.dst, err = store.ParseMoney(value); err != nil {
+				sendFieldError(w, p.name, "Invalid "+p.name)
+				return
+			}
+		}
+	}
+	entries, cursor, err := h.storeHandler.GetHistory(r.Context(), q)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	h.sendResponse(w, http.StatusOK, &HistoryResponse{
+		Entries:    entries,
+		NextCursor: cursor,
 	})
 }
 
 // Create new user
 func (h *handler) userPost(w http.ResponseWriter, r *http.Request) {
 	var u store.User
-	err := h.parseRequestBody(r, &u)
+	err := h.decodeBody(r, &u)
+	if err != nil {
+		h.log(r).Info("Bad request for user create: ", err)
+		h.processError(w, r, err)
+		return
+	}
+	err = h.storeHandler.CreateUser(r.Context(), &u)
 	if err != nil {
-		h.logger.Info("Bad request for user create: ", err)
-		h.sendResponse(w, http.StatusBadRequest, &ErrorResponse{Error: "Invalid request"})
+		h.processError(w, r, err)
 		return
 	}
-	err = h.storeHandler.CreateUser(&u)
+	session, err := h.storeHandler.CreateSession(r.Context(), u.ID)
 	if err != nil {
-		h.processError(w, err)
+		h.processError(w, r, err)
 		return
 	}
-	h.sendResponse(w, http.StatusOK, &UserCreateResponse{})
+	expiresAt := session.ExpiresAt.UTC()
+	h.sendResponse(w, http.StatusOK, &UserCreateResponse{
+		Token:     session.Token,
+		ExpiresAt: &expiresAt,
+	})
 }
 
-func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.router.ServeHTTP(w, r)
+// Issue additional token for user of the request token.
+// Operators issue tokens for user from "userId" body field.
+func (h *handler) sessionPost(w http.ResponseWriter, r *http.Request) {
+	principal := principalFrom(r.Context())
+	userID := principal.UserID
+	if principal.Operator != "" {
+		var request struct {
+			UserID uint64 `json:"userId"`
+		}
+		if err := h.decodeBody(r, &request); err != nil {
+			h.processError(w, r, err)
+			return
+		}
+		if request.UserID == 0 {
+			sendFieldError(w, "userId", "Must be positive")
+			return
+		}
+		userID = request.UserID
+	}
+	session, err := h.storeHandler.CreateSession(r.Context(), userID)
+	if err != nil {
+		h.processError(w, r, err)
+		return
+	}
+	h.sendSession(w, session)
 }
 
-func (h *handler) parseRequestBody(r *http.Request, dst interface{}) error {
-	// TODO move content type check to middleware
-	if r.Header.Get("Content-Type") != "application/json" {
-		return errors.New("Invalid content type")
+// Replace request token with the new one
+func (h *handler) sessionRefreshPost(w http.ResponseWriter, r *http.Request) {
+	principal := principalFrom(r.Context())
+	session, err := h.storeHandler.RefreshSession(r.Context(), principal)
+	if err != nil {
+		h.processError(w, r, err)
+		return
 	}
-	dec := json.NewDecoder(r.Body)
+	h.sendSession(w, session)
+}
 
-	err := dec.Decode(&dst)
-	if err != nil || dec.More() {
-		return err
+func (h *handler) sessionRevokePost(w http.ResponseWriter, r *http.Request) {
+	principal := principalFrom(r.Context())
+	if err := h.storeHandler.RevokeSession(r.Context(), principal); err != nil {
+		h.processError(w, r, err)
+		return
 	}
-	return nil
+	h.sendResponse(w, http.StatusOK, &ErrorResponse{})
+}
+
+func (h *handler) sendSession(w http.ResponseWriter, session *store.Session) {
+	h.sendResponse(w, http.StatusOK, &SessionResponse{
+		Token:     session.Token,
+		UserID:    session.UserID,
+		ExpiresAt: session.ExpiresAt.UTC(),
+	})
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.router.ServeHTTP(w, r)
 }
 
 func (h handler) sendResponse(w http.ResponseWriter, status int, data interface{}) {
@@ -138,41 +566,125 @@ func (h handler) sendResponse(w http.ResponseWriter, status int, data interface{
 	if err != nil {
 		h.logger.Error("Error when tryibg marshal response: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 	w.WriteHeader(status)
 	w.Write(json)
 }
 
-func (h *handler) processError(w http.ResponseWriter, err error) {
+// Respond with status and code of store error
+func (h *handler) processError(w http.ResponseWriter, r *http.Request, err error) {
+	code := store.CodeOf(err)
+	var duplicateError *store.DuplicateError
 	var validationError *store.ValidationError
-	var internalError *store.InternalError
-	var notFoundError *store.NotFoundError
 	var transactionError *store.TransactionError
+	var requestError *requestError
+	status := http.StatusInternalServerError
+	message := err.Error()
 	switch {
-	case errors.As(err, &validationError):
-		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+	case errors.As(err, &requestError):
+		sendError(w, requestError.Status, requestError.response())
 		return
-	case errors.As(err, &internalError):
-		h.logger.Error("Error when processing request: ", err)
-		sendErrorResponse(w, "Internal server error", http.StatusInternalServerError)
+	case errors.As(err, &duplicateError):
+		// Replayed request is not a failure, respond with the original result.
+		// Holds and bonuses respond with their own body, see replayed.
+		h.sendResponse(w, http.StatusAlreadyReported, &DepositResponse{
+			Balance: duplicateError.Balance,
+			Code:    code,
+		})
 		return
-	case errors.As(err, &notFoundError):
-		sendErrorResponse(w, err.Error(), http.StatusNotFound)
+	case errors.As(err, &validationError):
+		response := &ErrorResponse{Error: message, Code: code}
+		if validationError.Field != "" {
+			response.Details = []FieldError{{Field: validationError.Field, Message: message}}
+		}
+		sendError(w, http.StatusBadRequest, response)
 		return
 	case errors.As(err, &transactionError):
-		h.logger.Warn("Transaction error: ", err)
-		sendErrorResponse(w, "Transaction error", http.StatusBadRequest)
-		return
+		h.log(r).Warn("Transaction error: ", err)
+		status = http.StatusBadRequest
+		message = "Transaction error"
+		if code == store.CodeDuplicateTransaction {
+			message = "Operation id is already used"
+		}
+	case errors.As(err, new(*store.ConflictError)):
+		h.log(r).Warn("Idempotency conflict: ", err)
+		status = http.StatusConflict
+	case errors.As(err, new(*store.RolledBackError)), errors.As(err, new(*store.StateError)):
+		status = http.StatusConflict
+	case errors.As(err, new(*store.AuthenticationError)):
+		status = http.StatusUnauthorized
+	case errors.As(err, new(*store.AccountFrozenError)), errors.As(err, new(*store.SelfExcludedError)),
+		errors.As(err, new(*store.AccountClosedError)), errors.As(err, new(*store.LimitError)):
+		status = http.StatusForbidden
+	case errors.As(err, new(*store.NotFoundError)):
+		status = http.StatusNotFound
+	case errors.As(err, new(*store.TimeoutError)):
+		h.log(r).Warn("Request aborted: ", err)
+		status = timeoutStatus(err)
+	case errors.As(err, new(*store.InternalError)):
+		h.log(r).Error("Error when processing request: ", err)
+		message = "Internal server error"
 	default:
-		h.logger.Warn("Unhadled error: ", err)
-		sendErrorResponse(w, "Internal server error", http.StatusInternalServerError)
-		return
+		h.log(r).Warn("Unhadled error: ", err)
+		message = "Internal server error"
+	}
+	sendErrorResponseWithCode(w, message, code, status)
+}
+
+// Balance of replayed operation, see store.DuplicateError. Routes which
+// don't respond with DepositResponse send their own body with it.
+func replayed(err error) (store.Money, bool) {
+	var duplicateError *store.DuplicateError
+	if errors.As(err, &duplicateError) {
+		return duplicateError.Balance, true
 	}
+	return 0, false
 }
 
+// Status of store.TimeoutError, cancelled request is abandoned by client
+// or by server on shutdown, deadline is set by timeout middleware
+func timeoutStatus(err error) int {
+	if errors.Is(err, context.Canceled) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusGatewayTimeout
+}
+
+// Send error with default code of status
 func sendErrorResponse(w http.ResponseWriter, message string, status int) {
+	code := store.CodeInvalidRequest
+	switch status {
+	case http.StatusUnauthorized:
+		code = store.CodeUnauthenticated
+	case http.StatusForbidden:
+		code = store.CodeForbidden
+	case http.StatusNotFound:
+		code = store.CodeNotFound
+	case http.StatusInternalServerError:
+		code = store.CodeInternal
+	}
+	sendErrorResponseWithCode(w, message, code, status)
+}
+
+// Report invalid request parameter
+func sendFieldError(w http.ResponseWriter, field string, message string) {
+	sendError(w, http.StatusBadRequest, &ErrorResponse{
+		Error:   message,
+		Code:    store.CodeInvalidField,
+		Details: []FieldError{{Field: field, Message: message}},
+	})
+}
+
+func sendErrorResponseWithCode(w http.ResponseWriter, message string, code store.ErrorCode, status int) {
+	sendError(w, status, &ErrorResponse{Error: message, Code: code})
+}
+
+// Request ID is set to response header by requestID middleware
+func sendError(w http.ResponseWriter, status int, response *ErrorResponse) {
+	response.RequestID = w.Header().Get(headerRequestID)
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	json, _ := json.Marshal(&ErrorResponse{Error: message})
+	json, _ := json.Marshal(response)
 	w.Write(json)
-
 }
@@ -2,12 +2,15 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/dehimb/cake/internal/store"
 	"github.com/gorilla/mux"
@@ -20,18 +23,40 @@ var testHandler *handler
 type MockStoreHandler struct {
 }
 
-func (storeHandler *MockStoreHandler) CreateUser(user *store.User) error {
+func (storeHandler *MockStoreHandler) CreateUser(ctx context.Context, user *store.User) error {
 	return nil
 }
 
-func (storeHandler *MockStoreHandler) CreateDeposit(d *store.Deposit) (float32, error) {
+func (storeHandler *MockStoreHandler) CreateDeposit(ctx context.Context, d *store.Deposit) (store.Money, error) {
 	if d.UserID == 0 {
 		return 0, &store.ValidationError{}
 	}
+	if d.ID == 200 {
+		return 0, &store.DuplicateError{Balance: 1}
+	}
+	if d.ID == 201 {
+		return 0, &store.ConflictError{}
+	}
 	return 1, nil
 }
 
-func (storeHandler *MockStoreHandler) GetUser(userID uint64) (*store.User, *store.Statistic, error) {
+func (storeHandler *MockStoreHandler) CreateTransaction(ctx context.Context, t *store.Transaction) (store.Money, error) {
+	if t.UserID == 0 {
+		return 0, &store.ValidationError{}
+	}
+	if t.Type == store.Rollback && t.ReferenceID == 300 {
+		return 0, &store.RolledBackError{}
+	}
+	if t.Type == store.Bet && t.Amount > 100000 {
+		return 0, &store.LimitError{}
+	}
+	if t.Type == store.Bet && t.UserID == 3 {
+		return 0, &store.SelfExcludedError{}
+	}
+	return 1, nil
+}
+
+func (storeHandler *MockStoreHandler) GetUser(ctx context.Context, userID uint64) (*store.User, *store.Statistic, error) {
 	if userID == 1 {
 		return &store.User{}, &store.Statistic{}, nil
 	}
@@ -41,10 +66,128 @@ func (storeHandler *MockStoreHandler) GetUser(userID uint64) (*store.User, *stor
 	return nil, nil, &store.NotFoundError{}
 }
 
+func (storeHandler *MockStoreHandler) GetHistory(ctx context.Context, q *store.HistoryQuery) ([]store.LedgerEntry, string, error) {
+	if q.UserID != 1 {
+		return nil, "", &store.NotFoundError{}
+	}
+	return []store.LedgerEntry{{ID: 1, Type: store.Bet, Amount: 100}}, "", nil
+}
+
+func (storeHandler *MockStoreHandler) CreateWithdrawal(ctx context.Context, w *store.Withdrawal) (store.Money, error) {
+	if w.UserID != 1 {
+		return 0, &store.NotFoundError{}
+	}
+	return 1, nil
+}
+
+func (storeHandler *MockStoreHandler) ApproveWithdrawal(ctx context.Context, id uint64, operator string) (*store.Withdrawal, error) {
+	if id == 2 {
+		return nil, &store.StateError{}
+	}
+	return &store.Withdrawal{ID: id, UserID: 1, Amount: 1, Status: store.WithdrawalApproved}, nil
+}
+
+func (storeHandler *MockStoreHandler) RejectWithdrawal(ctx context.Context, id uint64, operator string) (*store.Withdrawal, error) {
+	return &store.Withdrawal{ID: id, UserID: 1, Amount: 1, Status: store.WithdrawalRejected}, nil
+}
+
+func (storeHandler *MockStoreHandler) AuthorizeHold(ctx context.Context, h *store.Hold) (store.Money, error) {
+	if h.Amount > 10000 {
+		return 0, &store.ValidationError{}
+	}
+	h.Status = store.HoldAuthorized
+	if h.ID == 200 {
+		return 0, &store.DuplicateError{Balance: 5}
+	}
+	return 1, nil
+}
+
+func (storeHandler *MockStoreHandler) CaptureHold(ctx context.Context, h *store.Hold) (store.Money, error) {
+	if h.ID == 2 {
+		return 0, &store.StateError{}
+	}
+	return 1, nil
+}
+
+func (storeHandler *MockStoreHandler) ReleaseHold(ctx context.Context, h *store.Hold) (store.Money, error) {
+	if h.ID == 3 {
+		return 0, &store.NotFoundError{}
+	}
+	return 1, nil
+}
+
+func (storeHandler *MockStoreHandler) GrantBonus(ctx context.Context, b *store.Bonus) (store.Money, error) {
+	if b.Amount <= 0 {
+		return 0, &store.ValidationError{}
+	}
+	if b.ID == 200 {
+		return 0, &store.DuplicateError{Balance: b.Amount}
+	}
+	return b.Amount, nil
+}
+
+func (storeHandler *MockStoreHandler) GetLimits(ctx context.Context, userID uint64) ([]store.Limit, error) {
+	if userID != 1 {
+		return nil, &store.NotFoundError{}
+	}
+	return []store.Limit{{UserID: 1, Type: store.DepositLimit, Period: store.Daily, Amount: 100}}, nil
+}
+
+func (storeHandler *MockStoreHandler) SetLimit(ctx context.Context, l *store.Limit) (*store.Limit, error) {
+	if l.Type != store.DepositLimit {
+		return nil, &store.ValidationError{}
+	}
+	return l, nil
+}
+
+func (storeHandler *MockStoreHandler) SetAccountStatus(ctx context.Context, c *store.StatusChange) (*store.User, error) {
+	if !c.Admin && c.Status == store.StatusFrozen {
+		return nil, &store.ValidationError{}
+	}
+	return &store.User{ID: c.UserID, Status: c.Status, StatusUntil: c.Until}, nil
+}
+
+func (storeHandler *MockStoreHandler) CreateSession(ctx context.Context, userID uint64) (*store.Session, error) {
+	return &store.Session{Token: "tkn", UserID: userID, ExpiresAt: time.Now().Add(time.Hour)}, nil
+}
+
+func (storeHandler *MockStoreHandler) Authenticate(ctx context.Context, token string) (*store.Principal, error) {
+	if token != "tkn" {
+		return nil, &store.AuthenticationError{Err: errors.New("Invalid token")}
+	}
+	return &store.Principal{UserID: 1}, nil
+}
+
+func (storeHandler *MockStoreHandler) RefreshSession(ctx context.Context, p *store.Principal) (*store.Session, error) {
+	return &store.Session{Token: "tkn2", UserID: p.UserID, ExpiresAt: time.Now().Add(time.Hour)}, nil
+}
+
+func (storeHandler *MockStoreHandler) RevokeSession(ctx context.Context, p *store.Principal) error {
+	return nil
+}
+
+func (storeHandler *MockStoreHandler) CheckHealth(ctx context.Context) []store.HealthCheck {
+	return []store.HealthCheck{{Name: "database", OK: true}}
+}
+
+func (storeHandler *MockStoreHandler) Close(ctx context.Context) error {
+	return nil
+}
+
 type MockMiddlware struct {
 }
 
+// Handlers are tested as called by operator with admin scope
 func (middleware *MockMiddlware) populate() []mux.MiddlewareFunc {
+	principal := &store.Principal{Operator: "test", Scopes: []store.Scope{store.ScopeAdmin}}
+	return []mux.MiddlewareFunc{func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, principal)))
+		})
+	}}
+}
+
+func (middleware *MockMiddlware) populateProvider() []mux.MiddlewareFunc {
 	return make([]mux.MiddlewareFunc, 0)
 }
 
@@ -57,6 +200,147 @@ func init() {
 	testHandler.initRouter(&MockMiddlware{})
 }
 
+func TestProcessError(t *testing.T) {
+	testCases := []struct {
+		name            string
+		err             error
+		expectedStatus  int
+		expectedCode    store.ErrorCode
+		expectedDetails []FieldError
+	}{
+		{
+			name:            "Field validation",
+			err:             &store.ValidationError{Err: errors.New("Invalid amount"), Field: "amount"},
+			expectedStatus:  http.StatusBadRequest,
+			expectedCode:    store.CodeInvalidField,
+			expectedDetails: []FieldError{{Field: "amount", Message: "Invalid amount"}},
+		},
+		{
+			name:           "Insufficient funds",
+			err:            &store.ValidationError{Err: errors.New("No funds"), Code: store.CodeInsufficientFunds},
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   store.CodeInsufficientFunds,
+		},
+		{
+			name:           "User not found",
+			err:            &store.NotFoundError{Err: errors.New("User not found"), Code: store.CodeUserNotFound},
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   store.CodeUserNotFound,
+		},
+		{
+			name:           "Hold expired",
+			err:            &store.StateError{Err: errors.New("Hold is expired"), Code: store.CodeHoldExpired},
+			expectedStatus: http.StatusConflict,
+			expectedCode:   store.CodeHoldExpired,
+		},
+		{
+			name:           "Transaction failed",
+			err:            &store.TransactionError{Err: errors.New("disk I/O error")},
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   store.CodeTransactionFailed,
+		},
+		{
+			name:           "Limit exceeded",
+			err:            &store.LimitError{Err: errors.New("daily deposit limit exceeded")},
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   store.CodeLimitExceeded,
+		},
+		{
+			name:           "Deadline exceeded",
+			err:            &store.TimeoutError{Err: context.DeadlineExceeded},
+			expectedStatus: http.StatusGatewayTimeout,
+			expectedCode:   store.CodeTimeout,
+		},
+		{
+			name:           "Request cancelled",
+			err:            &store.TimeoutError{Err: context.Canceled},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedCode:   store.CodeCancelled,
+		},
+		{
+			name:           "Unknown error",
+			err:            errors.New("unknown"),
+			expectedStatus: http.StatusInternalServerError,
+			expectedCode:   store.CodeInternal,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			rec.Header().Set(headerRequestID, "req-1")
+			testHandler.processError(rec, httptest.NewRequest("GET", "/", nil), testCase.err)
+			var response ErrorResponse
+			assert.Nil(t, json.NewDecoder(rec.Body).Decode(&response))
+			assert.Equal(t, testCase.expectedStatus, rec.Code)
+			assert.Equal(t, testCase.expectedCode, response.Code)
+			assert.Equal(t, testCase.expectedDetails, response.Details)
+			assert.Equal(t, "req-1", response.RequestID)
+		})
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	testCases := []struct {
+		name            string
+		body            string
+		expectedDetails []FieldError
+		expectedError   bool
+	}{
+		{
+			name: "Valid request with legacy token",
+			body: `{"token":"tkn", "transactionId":1, "userId":1, "type":"Bet", "amount":"1.5"}`,
+		},
+		{
+			name:            "Unknown field",
+			body:            `{"transactionId":1, "userId":1, "type":"Bet", "amount":1, "amont":1}`,
+			expectedDetails: []FieldError{{Field: "amont", Message: "Unknown field"}},
+		},
+		{
+			name:            "Invalid field type",
+			body:            `{"transactionId":"1", "userId":1, "type":"Bet", "amount":1}`,
+			expectedDetails: []FieldError{{Field: "transactionId", Message: "Invalid value, string is not allowed"}},
+		},
+		{
+			name:            "Invalid amount",
+			body:            `{"transactionId":1, "userId":1, "type":"Bet", "amount":"1.001"}`,
+			expectedDetails: []FieldError{{Field: "amount", Message: `Invalid amount: "1.001"`}},
+		},
+		{
+			name: "Failed rules",
+			body: `{"transactionId":0, "userId":1, "type":"Deposit", "amount":-1}`,
+			expectedDetails: []FieldError{
+				{Field: "transactionId", Message: "Must be positive"},
+				{Field: "amount", Message: "Must be positive"},
+				{Field: "type", Message: "Must be Bet, Win or Rollback"},
+			},
+		},
+		{
+			name:            "Amount out of bounds",
+			body:            `{"transactionId":1, "userId":1, "type":"Win", "amount":1000000001}`,
+			expectedDetails: []FieldError{{Field: "amount", Message: "Must not exceed 1000000000.00"}},
+		},
+		{
+			name:          "Trailing data",
+			body:          `{"transactionId":1, "userId":1, "type":"Bet", "amount":1}{}`,
+			expectedError: true,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/transaction", bytes.NewBuffer([]byte(testCase.body)))
+			var transaction store.Transaction
+			err := testHandler.decodeBody(req, &transaction)
+			var requestError *requestError
+			if testCase.expectedDetails == nil && !testCase.expectedError {
+				assert.Nil(t, err)
+				return
+			}
+			assert.True(t, errors.As(err, &requestError))
+			assert.Equal(t, testCase.expectedDetails, requestError.Details)
+		})
+	}
+}
+
 func TestUserPost(t *testing.T) {
 	testCases := []struct {
 		name         string
@@ -150,6 +434,16 @@ func TestDepositPost(t *testing.T) {
 			data:         `{"userId":1, "depositId":100, "amount":50, "token":"tkn"}`,
 			expectedCode: http.StatusOK,
 		},
+		{
+			name:         "Replayed request",
+			data:         `{"userId":1, "depositId":200, "amount":50, "token":"tkn"}`,
+			expectedCode: http.StatusAlreadyReported,
+		},
+		{
+			name:         "Idempotency conflict",
+			data:         `{"userId":1, "depositId":201, "amount":50, "token":"tkn"}`,
+			expectedCode: http.StatusConflict,
+		},
 	}
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
@@ -166,6 +460,477 @@ func TestDepositPost(t *testing.T) {
 }
 
 func TestTransactionPost(t *testing.T) {
-	// TODO Implement this
+	testCases := []struct {
+		name         string
+		data         string
+		expectedCode int
+	}{
+		{
+			name:         "Malformed json",
+			data:         "Malformed json",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Invalid amount",
+			data:         `{"userId":1, "transactionId":100, "type":"Bet", "amount":0.001, "token":"tkn"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Validation error",
+			data:         `{"userId":0, "transactionId":100, "type":"Bet", "amount":50, "token":"tkn"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Valid request",
+			data:         `{"userId":1, "transactionId":100, "type":"Bet", "amount":"10.25", "token":"tkn"}`,
+			expectedCode: http.StatusOK,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/transaction", bytes.NewBuffer([]byte(testCase.data)))
+			req.Header.Set("Content-Type", "application/json")
+			testHandler.ServeHTTP(rec, req)
+			bodyBytes, _ := ioutil.ReadAll(rec.Body)
+			t.Log(string(bodyBytes))
+			assert.Equal(t, testCase.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestRollbackPost(t *testing.T) {
+	testCases := []struct {
+		name         string
+		data         string
+		expectedCode int
+	}{
+		{
+			name:         "Malformed json",
+			data:         "Malformed json",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Valid request",
+			data:         `{"userId":1, "transactionId":101, "originalTransactionId":100, "token":"tkn"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Already rolled back",
+			data:         `{"userId":1, "transactionId":101, "originalTransactionId":300, "token":"tkn"}`,
+			expectedCode: http.StatusConflict,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/transaction/rollback", bytes.NewBuffer([]byte(testCase.data)))
+			req.Header.Set("Content-Type", "application/json")
+			testHandler.ServeHTTP(rec, req)
+			bodyBytes, _ := ioutil.ReadAll(rec.Body)
+			t.Log(string(bodyBytes))
+			assert.Equal(t, testCase.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestHistoryGet(t *testing.T) {
+	testCases := []struct {
+		name         string
+		query        string
+		expectedCode int
+	}{
+		{
+			name:         "Invalid user id",
+			query:        "id=0",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Valid request",
+			query:        "id=1&type=Bet,Win&from=2019-12-01T00:00:00Z&minAmount=1.50&limit=10",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Invalid date",
+			query:        "id=1&to=yesterday",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Invalid amount",
+			query:        "id=1&maxAmount=1.001",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Invalid limit",
+			query:        "id=1&limit=-1",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "User not found",
+			query:        "id=2",
+			expectedCode: http.StatusNotFound,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/user/history?token=tkn&"+testCase.query, nil)
+			testHandler.ServeHTTP(rec, req)
+			bodyBytes, _ := ioutil.ReadAll(rec.Body)
+			t.Log(string(bodyBytes))
+			assert.Equal(t, testCase.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestWithdrawal(t *testing.T) {
+	testCases := []struct {
+		name         string
+		url          string
+		data         string
+		expectedCode int
+	}{
+		{
+			name:         "Create withdrawal",
+			url:          "/user/withdrawal",
+			data:         `{"userId":1, "withdrawalId":1, "amount":"10.00", "token":"tkn"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Create withdrawal for unknown user",
+			url:          "/user/withdrawal",
+			data:         `{"userId":2, "withdrawalId":1, "amount":"10.00", "token":"tkn"}`,
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "Approve",
+			url:          "/admin/withdrawal/approve",
+			data:         `{"withdrawalId":1, "token":"tkn"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Approve rejected",
+			url:          "/admin/withdrawal/approve",
+			data:         `{"withdrawalId":2, "token":"tkn"}`,
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name:         "Reject without id",
+			url:          "/admin/withdrawal/reject",
+			data:         `{"token":"tkn"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Reject",
+			url:          "/admin/withdrawal/reject",
+			data:         `{"withdrawalId":1, "token":"tkn"}`,
+			expectedCode: http.StatusOK,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", testCase.url, bytes.NewBuffer([]byte(testCase.data)))
+			req.Header.Set("Content-Type", "application/json")
+			testHandler.ServeHTTP(rec, req)
+			bodyBytes, _ := ioutil.ReadAll(rec.Body)
+			t.Log(string(bodyBytes))
+			assert.Equal(t, testCase.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestHold(t *testing.T) {
+	testCases := []struct {
+		name         string
+		url          string
+		data         string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Authorize",
+			url:          "/hold",
+			data:         `{"userId":1, "holdId":1, "amount":"10.00", "token":"tkn"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Replayed authorize",
+			url:          "/hold",
+			data:         `{"userId":1, "holdId":200, "amount":"10.00", "token":"tkn"}`,
+			expectedCode: http.StatusAlreadyReported,
+			expectedBody: `"holdId":200,"status":"authorized","availableBalance":0.05`,
+		},
+		{
+			name:         "Authorize without funds",
+			url:          "/hold",
+			data:         `{"userId":1, "holdId":1, "amount":"200.00", "token":"tkn"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Capture",
+			url:          "/hold/capture",
+			data:         `{"userId":1, "holdId":1, "transactionId":5, "token":"tkn"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Capture released",
+			url:          "/hold/capture",
+			data:         `{"userId":1, "holdId":2, "transactionId":5, "token":"tkn"}`,
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name:         "Release",
+			url:          "/hold/release",
+			data:         `{"userId":1, "holdId":1, "token":"tkn"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Release unknown",
+			url:          "/hold/release",
+			data:         `{"userId":1, "holdId":3, "token":"tkn"}`,
+			expectedCode: http.StatusNotFound,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", testCase.url, bytes.NewBuffer([]byte(testCase.data)))
+			req.Header.Set("Content-Type", "application/json")
+			testHandler.ServeHTTP(rec, req)
+			bodyBytes, _ := ioutil.ReadAll(rec.Body)
+			t.Log(string(bodyBytes))
+			assert.Equal(t, testCase.expectedCode, rec.Code)
+			assert.Contains(t, string(bodyBytes), testCase.expectedBody)
+		})
+	}
+}
+
+func TestBonusPost(t *testing.T) {
+	testCases := []struct {
+		name         string
+		data         string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Grant",
+			data:         `{"userId":1, "bonusId":1, "amount":"10.00", "token":"tkn"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Invalid amount",
+			data:         `{"userId":1, "bonusId":1, "amount":0, "token":"tkn"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Replayed grant",
+			data:         `{"userId":1, "bonusId":200, "amount":"10.00", "token":"tkn"}`,
+			expectedCode: http.StatusAlreadyReported,
+			expectedBody: `"bonusBalance":10.00,"error":"","code":"ALREADY_PROCESSED"`,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/admin/bonus", bytes.NewBuffer([]byte(testCase.data)))
+			req.Header.Set("Content-Type", "application/json")
+			testHandler.ServeHTTP(rec, req)
+			bodyBytes, _ := ioutil.ReadAll(rec.Body)
+			t.Log(string(bodyBytes))
+			assert.Equal(t, testCase.expectedCode, rec.Code)
+			assert.Contains(t, string(bodyBytes), testCase.expectedBody)
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	testCases := []struct {
+		name         string
+		method       string
+		url          string
+		data         string
+		expectedCode int
+	}{
+		{
+			name:         "Get limits",
+			method:       "GET",
+			url:          "/user/limits?token=tkn&id=1",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Get limits of unknown user",
+			method:       "GET",
+			url:          "/user/limits?token=tkn&id=2",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "Set limit",
+			method:       "POST",
+			url:          "/user/limits",
+			data:         `{"userId":1, "type":"deposit", "period":"daily", "amount":"100.00", "token":"tkn"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Invalid limit",
+			method:       "POST",
+			url:          "/user/limits",
+			data:         `{"userId":1, "type":"bets", "period":"daily", "amount":"100.00", "token":"tkn"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Set usage of limit",
+			method:       "POST",
+			url:          "/user/limits",
+			data:         `{"userId":1, "type":"deposit", "period":"daily", "amount":"100.00", "used":"0.00", "token":"tkn"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Set pending change of limit",
+			method:       "POST",
+			url:          "/user/limits",
+			data:         `{"userId":1, "type":"deposit", "period":"daily", "amount":"100.00", "pendingFrom":"2020-01-01T00:00:00Z", "token":"tkn"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Bet over limit",
+			method:       "POST",
+			url:          "/transaction",
+			data:         `{"userId":1, "transactionId":1, "type":"Bet", "amount":"2000.00", "token":"tkn"}`,
+			expectedCode: http.StatusForbidden,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(testCase.method, testCase.url, bytes.NewBuffer([]byte(testCase.data)))
+			req.Header.Set("Content-Type", "application/json")
+			testHandler.ServeHTTP(rec, req)
+			bodyBytes, _ := ioutil.ReadAll(rec.Body)
+			t.Log(string(bodyBytes))
+			assert.Equal(t, testCase.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestAccountStatus(t *testing.T) {
+	testCases := []struct {
+		name         string
+		url          string
+		data         string
+		expectedCode int
+	}{
+		{
+			name:         "Self-exclusion",
+			url:          "/user/status",
+			data:         `{"userId":1, "status":"self_excluded", "until":"2030-01-01T00:00:00Z", "token":"tkn"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Freeze by user",
+			url:          "/user/status",
+			data:         `{"userId":1, "status":"frozen", "token":"tkn"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Freeze by operator",
+			url:          "/admin/user/status",
+			data:         `{"userId":1, "status":"frozen", "token":"tkn"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Bet of self-excluded user",
+			url:          "/transaction",
+			data:         `{"userId":3, "transactionId":1, "type":"Bet", "amount":1, "token":"tkn"}`,
+			expectedCode: http.StatusForbidden,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", testCase.url, bytes.NewBuffer([]byte(testCase.data)))
+			req.Header.Set("Content-Type", "application/json")
+			testHandler.ServeHTTP(rec, req)
+			bodyBytes, _ := ioutil.ReadAll(rec.Body)
+			t.Log(string(bodyBytes))
+			assert.Equal(t, testCase.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestSessionPost(t *testing.T) {
+	testCases := []struct {
+		name          string
+		data          string
+		expectedCode  int
+		expectedField string
+	}{
+		{
+			name:         "Operator session",
+			data:         `{"userId":1}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:          "Missing user",
+			data:          `{}`,
+			expectedCode:  http.StatusBadRequest,
+			expectedField: "userId",
+		},
+		{
+			name:          "Unknown field",
+			data:          `{"userId":1, "user":1}`,
+			expectedCode:  http.StatusBadRequest,
+			expectedField: "user",
+		},
+		{
+			name:          "Invalid user",
+			data:          `{"userId":"1"}`,
+			expectedCode:  http.StatusBadRequest,
+			expectedField: "userId",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/session", bytes.NewBuffer([]byte(testCase.data)))
+			req.Header.Set("Content-Type", "application/json")
+			testHandler.ServeHTTP(rec, req)
+			bodyBytes, _ := ioutil.ReadAll(rec.Body)
+			t.Log(string(bodyBytes))
+			assert.Equal(t, testCase.expectedCode, rec.Code)
+			if testCase.expectedField != "" {
+				var response ErrorResponse
+				assert.NoError(t, json.Unmarshal(bodyBytes, &response))
+				if assert.Len(t, response.Details, 1) {
+					assert.Equal(t, testCase.expectedField, response.Details[0].Field)
+				}
+			}
+		})
+	}
+}
+
+func TestProbes(t *testing.T) {
+	shutdown := make(chan struct{})
+	h := &handler{storeHandler: &MockStoreHandler{}, logger: logrus.New(), shutdown: shutdown}
+
+	rec := httptest.NewRecorder()
+	h.healthz(rec, httptest.NewRequest("GET", healthzPath, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	h.readyz(rec, httptest.NewRequest("GET", readyzPath, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status":"ok","checks":[{"name":"database","ok":true},{"name":"shutdown","ok":true}]}`, rec.Body.String())
+
+	close(shutdown)
+	rec = httptest.NewRecorder()
+	h.readyz(rec, httptest.NewRequest("GET", readyzPath, nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.JSONEq(t, `{"status":"unavailable","checks":[{"name":"database","ok":true},
+		{"name":"shutdown","ok":false,"error":"Shutdown in progress"}]}`, rec.Body.String())
 
+	rec = httptest.NewRecorder()
+	h.healthz(rec, httptest.NewRequest("GET", healthzPath, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
 }
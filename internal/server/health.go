@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/dehimb/cake/internal/store"
+)
+
+// Probes are served without token, like metrics
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	// Max time of readiness checks, database ping is the slow one
+	readinessTimeout = 2 * time.Second
+)
+
+// Process is alive when it can answer at all
+func (h *handler) healthz(w http.ResponseWriter, r *http.Request) {
+	h.sendResponse(w, http.StatusOK, &HealthResponse{Status: "ok"})
+}
+
+// Ready when store is healthy and shutdown has not begun.
+// Every check is reported, status is 503 when any of them failed.
+func (h *handler) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	checks := h.storeHandler.CheckHealth(ctx)
+
+	shutdown := store.HealthCheck{Name: "shutdown", OK: true}
+	select {
+	case <-h.shutdown:
+		shutdown = store.HealthCheck{Name: "shutdown", Error: "Shutdown in progress"}
+	default:
+	}
+	checks = append(checks, shutdown)
+
+	response := &HealthResponse{Status: "ok", Checks: checks}
+	status := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			response.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	h.sendResponse(w, status, response)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dehimb/cake/internal/metrics"
+	"github.com/gorilla/mux"
+)
+
+// Metrics of all packages are served at metricsPath without token
+const metricsPath = "/metrics"
+
+var (
+	requestsTotal = metrics.NewCounter("cake_http_requests_total",
+		"HTTP requests by route, method and status.", "route", "method", "status")
+	requestDuration = metrics.NewHistogram("cake_http_request_duration_seconds",
+		"HTTP request latency by route, method and status.", metrics.DefaultBuckets, "route", "method", "status")
+	requestsInFlight = metrics.NewGauge("cake_http_requests_in_flight",
+		"HTTP requests being processed.")
+	rateLimitedTotal = metrics.NewCounter("cake_http_rate_limited_total",
+		"Requests rejected by rate limit by rule route.", "route")
+	inFlightRejectedTotal = metrics.NewCounter("cake_http_in_flight_rejected_total",
+		"Balance changing requests rejected because user had too many of them in progress.")
+)
+
+// Keeps response status for metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Count requests and their latency. Routes are labeled by path template,
+// so unknown paths don't create new series.
+func (m *middleware) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestsInFlight.Inc()
+		defer requestsInFlight.Dec()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := routeOf(r)
+		status := strconv.Itoa(rec.status)
+		requestsTotal.Inc(route, r.Method, status)
+		requestDuration.Observe(time.Since(start).Seconds(), route, r.Method, status)
+	})
+}
+
+// Path template of matched route
+func routeOf(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unknown"
+}
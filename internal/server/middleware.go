@@ -1,17 +1,21 @@
 package server
 
 import (
-	"bytes"
-	"encoding/json"
-	"io/ioutil"
-	"log"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dehimb/cake/internal/store"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 // Middlewares functions works like interceptors for every http request.
@@ -19,15 +23,24 @@ import (
 type middleware struct {
 	logger       *logrus.Logger
 	storeHandler store.StoreHandler
+
+	providers       ProviderSecrets
+	signatureWindow time.Duration
+	nonces          *nonceCache
+
+	rateLimiter *rateLimiter
+	maxBodySize int64
+	corsOrigins []string
+	// Deadline of request context, not limited when 0
+	requestTimeout time.Duration
+	// Log request bodies with redacted secrets
+	logBodies bool
 }
 
 type MiddlewareDispatcher interface {
 	populate() []mux.MiddlewareFunc
-}
-
-// Validate token from client request
-func IsTokenValid(token string) bool {
-	return len(token) > 0
+	// Middlewares of provider routes, applied after populate ones
+	populateProvider() []mux.MiddlewareFunc
 }
 
 // This method used to check preflight requests
@@ -41,75 +54,191 @@ func (m *middleware) cors(next http.Handler) http.Handler {
 	})
 }
 
-// Used for loggin request method, url and execution time.
-// Log only when log level set to logrus.InfoLevel or higher.
+// Log method, url, status and execution time of every request at Info level.
+// Body is logged only when enabled, secrets are redacted from body and url.
 func (m *middleware) logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if m.logger.Level >= logrus.InfoLevel {
-			start := time.Now()
-			m.logger.Infof("-> %s %s", r.Method, r.URL)
-			if r.Method == "POST" || r.Method == "PUT" {
-				body, _ := ioutil.ReadAll(r.Body)
-				m.logger.Info("Body: ", string(body))
-				r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-			}
+		logger := store.LoggerFrom(r.Context(), m.logger)
+		if !logger.Logger.IsLevelEnabled(logrus.InfoLevel) {
 			next.ServeHTTP(w, r)
-			m.logger.Infof("<-  %s %s %s", time.Since(start), r.Method, r.URL)
 			return
 		}
-		next.ServeHTTP(w, r)
+		start := time.Now()
+		fields := logrus.Fields{"url": redactURL(r.URL)}
+		if m.logBodies && (r.Method == "POST" || r.Method == "PUT") {
+			fields["body"] = redactBody(bodyFrom(r).raw)
+		}
+		logger.WithFields(fields).Info("Request started")
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		logger.WithFields(logrus.Fields{"status": rec.status, "duration": time.Since(start).String()}).Info("Request finished")
+	})
+}
+
+type contextKey int
+
+const (
+	principalKey contextKey = iota
+	requestIDKey
+	bodyKey
+)
+
+const headerRequestID = "X-Request-ID"
+
+// Client may set ID of request to find it in logs, otherwise it is generated
+func (m *middleware) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(headerRequestID)
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set(headerRequestID, id)
+		// every log line of the request, including store ones, has its ID
+		fields := logrus.Fields{"requestId": id, "method": r.Method, "path": r.URL.Path}
+		if span := oteltrace.SpanFromContext(r.Context()); span.SpanContext().IsValid() {
+			span.SetAttributes(attribute.String("http.request_id", id))
+			fields["traceId"] = span.SpanContext().TraceID().String()
+		}
+		logger := m.logger.WithFields(fields)
+		ctx := store.WithLogger(context.WithValue(r.Context(), requestIDKey, id), logger)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Set deadline of request context. Store operations which don't finish in time
+// fail with store.TimeoutError, so client gets 504 instead of closed connection.
+func (m *middleware) timeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.requestTimeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), m.requestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-// TODO add maxBytesReader middleware
+// Request scoped log entry, see requestID
+func (m *middleware) log(r *http.Request) *logrus.Entry {
+	return store.LoggerFrom(r.Context(), m.logger)
+}
 
-// Validate tokens for every client request
+// Principal resolved by checkToken
+func principalFrom(ctx context.Context) *store.Principal {
+	p, _ := ctx.Value(principalKey).(*store.Principal)
+	return p
+}
+
+// Resolve token of every client request to principal and check that request
+// user, "id" query parameter or "userId" body field, belongs to it.
+// Session tokens and operator API keys are accepted the same way.
+// Token is taken from "Authorization: Bearer" header. For backward compatibility
+// "token" query parameter of GET and body field of POST and PUT are accepted too.
 func (m *middleware) checkToken(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			if token := r.URL.Query().Get("token"); IsTokenValid(token) {
-				next.ServeHTTP(w, r)
-				return
-			}
-			sendErrorResponse(w, "Invalid token", http.StatusBadRequest)
-		case "POST", "PUT":
-			body, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				m.logger.Error("Failed to read request body: ", err)
-				sendErrorResponse(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
+		if r.Method != "GET" && r.Method != "POST" && r.Method != "PUT" {
+			sendErrorResponse(w, "Not found", http.StatusNotFound)
+			return
+		}
+		// provider requests are signed instead, see checkSignature
+		if strings.HasPrefix(r.URL.Path, providerPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := bearerToken(r)
+		var legacyToken string
+		var userID uint64
+		if r.Method == "GET" {
+			legacyToken = r.URL.Query().Get("token")
+			userID, _ = strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		} else {
+			body := bodyFrom(r)
+			body.field("token", &legacyToken)
+			userID = bodyUserID(body)
+		}
+		if token == "" && legacyToken != "" {
+			m.log(r).Debug("Deprecated token parameter used")
+			w.Header().Set("Warning", `299 - "token parameter is deprecated, use Authorization header"`)
+			token = legacyToken
+		}
 
-			var data map[string]interface{}
-			err = json.Unmarshal(body, &data)
-			if err != nil {
-				log.Printf("Error reading body: %v", err)
-				sendErrorResponse(w, "Invalid token", http.StatusBadRequest)
+		principal, err := m.storeHandler.Authenticate(r.Context(), token)
+		if err != nil {
+			var authenticationError *store.AuthenticationError
+			if errors.As(err, &authenticationError) {
+				m.limitAuthFailure(r)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				sendErrorResponseWithCode(w, err.Error(), store.CodeUnauthenticated, http.StatusUnauthorized)
 				return
 			}
-
-			if token, _ := data["token"].(string); IsTokenValid(token) {
-				r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-				next.ServeHTTP(w, r)
+			if errors.As(err, new(*store.TimeoutError)) {
+				sendErrorResponseWithCode(w, err.Error(), store.CodeOf(err), timeoutStatus(err))
 				return
 			}
-			sendErrorResponse(w, "Invalid token", http.StatusBadRequest)
-		default:
-			sendErrorResponse(w, "Not found", http.StatusNotFound)
+			m.log(r).Error("Failed to authenticate request: ", err)
+			sendErrorResponse(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		// operators act on any user, their access is limited by scopes
+		if principal.UserID != 0 && userID != 0 && userID != principal.UserID {
+			sendErrorResponseWithCode(w, "Token doesn't belong to user", store.CodeForbidden, http.StatusForbidden)
+			return
 		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, principal)))
 	})
 }
 
-// TODO add validator for content type
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
+	return ""
+}
 
 // Method used for providing all middlewares at one place
 // Declare all midlwares and add them to return array
 func (m *middleware) populate() []mux.MiddlewareFunc {
 	return []mux.MiddlewareFunc{
+		m.instrument,
+		m.trace,
+		m.requestID,
+		m.timeout,
+		m.readBody,
 		m.logRequest,
 		m.cors,
-		handlers.CORS(handlers.AllowedOrigins([]string{"*"})),
+		handlers.CORS(
+			handlers.AllowedOrigins(m.corsOrigins),
+			handlers.ExposedHeaders([]string{headerRequestID, headerTimestamp, headerSignature}),
+			handlers.AllowedHeaders([]string{"Authorization", "Content-Type", headerRequestID, headerTraceparent, headerProvider, headerTimestamp, headerNonce, headerSignature}),
+		),
+		m.limitRate,
 		m.checkToken,
+		m.limitPrincipal,
+	}
+}
+
+func (m *middleware) populateProvider() []mux.MiddlewareFunc {
+	return []mux.MiddlewareFunc{
+		m.checkSignature,
 	}
 }
@@ -2,16 +2,27 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dehimb/cake/internal/metrics"
 	"github.com/dehimb/cake/internal/store"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 var middlewareTestHandler *handler
@@ -19,18 +30,102 @@ var middlewareTestHandler *handler
 type MiddlewareMockStoreHandler struct {
 }
 
-func (storeHandler *MiddlewareMockStoreHandler) GetUser(userID uint64) (*store.User, *store.Statistic, error) {
+func (storeHandler *MiddlewareMockStoreHandler) GetUser(ctx context.Context, userID uint64) (*store.User, *store.Statistic, error) {
 	return nil, nil, nil
 }
 
-func (storeHandler *MiddlewareMockStoreHandler) CreateUser(user *store.User) error {
+func (storeHandler *MiddlewareMockStoreHandler) CreateUser(ctx context.Context, user *store.User) error {
 	return nil
 }
 
-func (storeHandler *MiddlewareMockStoreHandler) CreateDeposit(d *store.Deposit) (float32, error) {
+func (storeHandler *MiddlewareMockStoreHandler) CreateDeposit(ctx context.Context, d *store.Deposit) (store.Money, error) {
 	return 0, nil
 }
 
+func (storeHandler *MiddlewareMockStoreHandler) CreateTransaction(ctx context.Context, t *store.Transaction) (store.Money, error) {
+	return 0, nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) GetHistory(ctx context.Context, q *store.HistoryQuery) ([]store.LedgerEntry, string, error) {
+	return nil, "", nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) CreateWithdrawal(ctx context.Context, w *store.Withdrawal) (store.Money, error) {
+	return 0, nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) ApproveWithdrawal(ctx context.Context, id uint64, operator string) (*store.Withdrawal, error) {
+	return nil, nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) RejectWithdrawal(ctx context.Context, id uint64, operator string) (*store.Withdrawal, error) {
+	return nil, nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) AuthorizeHold(ctx context.Context, h *store.Hold) (store.Money, error) {
+	return 0, nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) CaptureHold(ctx context.Context, h *store.Hold) (store.Money, error) {
+	return 0, nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) ReleaseHold(ctx context.Context, h *store.Hold) (store.Money, error) {
+	return 0, nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) GrantBonus(ctx context.Context, b *store.Bonus) (store.Money, error) {
+	return 0, nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) GetLimits(ctx context.Context, userID uint64) ([]store.Limit, error) {
+	return nil, nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) SetLimit(ctx context.Context, l *store.Limit) (*store.Limit, error) {
+	return l, nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) SetAccountStatus(ctx context.Context, c *store.StatusChange) (*store.User, error) {
+	return &store.User{ID: c.UserID, Status: c.Status}, nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) CreateSession(ctx context.Context, userID uint64) (*store.Session, error) {
+	return &store.Session{Token: "tkn", UserID: userID, ExpiresAt: time.Now().Add(time.Hour)}, nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) Authenticate(ctx context.Context, token string) (*store.Principal, error) {
+	switch token {
+	case "tkn":
+		return &store.Principal{UserID: 1, Scopes: []store.Scope{store.ScopeUsersRead, store.ScopeUsersWrite,
+			store.ScopeDepositsWrite, store.ScopeTransactionsWrite, store.ScopeWithdrawalsWrite}}, nil
+	case "player":
+		// scopes of real session tokens
+		return &store.Principal{UserID: 1, Scopes: []store.Scope{store.ScopeUsersRead, store.ScopeUsersWrite, store.ScopeWithdrawalsWrite}}, nil
+	case "ck_cashier":
+		return &store.Principal{Operator: "cashier", Scopes: []store.Scope{store.ScopeDepositsWrite}}, nil
+	case "slow":
+		return nil, &store.TimeoutError{Err: context.DeadlineExceeded}
+	}
+	return nil, &store.AuthenticationError{Err: errors.New("Invalid token")}
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) RefreshSession(ctx context.Context, p *store.Principal) (*store.Session, error) {
+	return &store.Session{Token: "tkn2", UserID: p.UserID, ExpiresAt: time.Now().Add(time.Hour)}, nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) RevokeSession(ctx context.Context, p *store.Principal) error {
+	return nil
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) CheckHealth(ctx context.Context) []store.HealthCheck {
+	return []store.HealthCheck{{Name: "database", OK: true}}
+}
+
+func (storeHandler *MiddlewareMockStoreHandler) Close(ctx context.Context) error {
+	return nil
+}
+
 func init() {
 	middlewareTestHandler = &handler{
 		router:       mux.NewRouter(),
@@ -41,6 +136,12 @@ func init() {
 	m := &middleware{
 		logger:       middlewareTestHandler.logger,
 		storeHandler: middlewareTestHandler.storeHandler,
+
+		providers:       ProviderSecrets{"games": {"old", "new"}},
+		signatureWindow: time.Minute,
+		nonces:          newNonceCache(time.Minute),
+
+		maxBodySize: 256,
 	}
 	middlewareTestHandler.initRouter(m)
 }
@@ -53,12 +154,71 @@ func TestCors(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rec.Code)
 }
 
+func TestRequestID(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	req.Header.Set(headerRequestID, "client-id-1")
+	middlewareTestHandler.ServeHTTP(rec, req)
+	assert.Equal(t, "client-id-1", rec.Header().Get(headerRequestID))
+	assert.Contains(t, rec.Body.String(), `"requestId":"client-id-1"`)
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/ping", nil)
+	req.Header.Set(headerRequestID, "invalid id")
+	middlewareTestHandler.ServeHTTP(rec, req)
+	assert.Len(t, rec.Header().Get(headerRequestID), 32)
+}
+
+func TestTimeout(t *testing.T) {
+	var deadline time.Time
+	var hasDeadline bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, hasDeadline = r.Context().Deadline()
+	})
+	m := &middleware{requestTimeout: time.Minute}
+	m.timeout(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.True(t, hasDeadline)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+
+	m.requestTimeout = 0
+	m.timeout(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.False(t, hasDeadline)
+
+	// store timeout during authentication is not reported as invalid token
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/user?id=1", nil)
+	req.Header.Set("Authorization", "Bearer slow")
+	middlewareTestHandler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	assert.Contains(t, rec.Body.String(), string(store.CodeTimeout))
+}
+
+func TestInstrument(t *testing.T) {
+	before := requestsTotal.Value("/user", "GET", "401")
+	beforeUnknown := requestsTotal.Value("/", "GET", "401")
+	for _, path := range []string{"/user?id=1", "/user?id=2", "/no/such/path"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		middlewareTestHandler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	assert.Equal(t, before+2, requestsTotal.Value("/user", "GET", "401"))
+	// unknown paths share catch-all route
+	assert.Equal(t, beforeUnknown+1, requestsTotal.Value("/", "GET", "401"))
+	assert.True(t, requestDuration.Count("/user", "GET", "401") >= 2)
+	assert.Equal(t, float64(0), requestsInFlight.Value())
+
+	rec := httptest.NewRecorder()
+	metrics.Default.ServeHTTP(rec, httptest.NewRequest("GET", metricsPath, nil))
+	assert.Contains(t, rec.Body.String(), `cake_http_requests_total{route="/user",method="GET",status="401"}`)
+	assert.Contains(t, rec.Body.String(), "# TYPE cake_store_operations_total counter")
+}
+
 func TestCheckToken(t *testing.T) {
 	testCases := []struct {
 		name         string
 		method       string
 		url          string
 		data         io.Reader
+		token        string
 		expectedCode int
 	}{
 		{
@@ -73,7 +233,7 @@ func TestCheckToken(t *testing.T) {
 			method:       "GET",
 			url:          "/ping",
 			data:         nil,
-			expectedCode: http.StatusBadRequest,
+			expectedCode: http.StatusUnauthorized,
 		},
 		{
 			name:         "Valid POST",
@@ -87,7 +247,7 @@ func TestCheckToken(t *testing.T) {
 			method:       "POST",
 			url:          "/ping",
 			data:         bytes.NewBuffer([]byte(`{"data":"tkn"}`)),
-			expectedCode: http.StatusBadRequest,
+			expectedCode: http.StatusUnauthorized,
 		},
 		{
 			name:         "Valid PUT",
@@ -101,8 +261,164 @@ func TestCheckToken(t *testing.T) {
 			method:       "PUT",
 			url:          "/ping",
 			data:         bytes.NewBuffer([]byte(`{"data":"tkn"}`)),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "Authorization header",
+			method:       "GET",
+			url:          "/ping",
+			token:        "tkn",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Unknown token",
+			method:       "POST",
+			url:          "/ping",
+			data:         bytes.NewBuffer([]byte(`{"userId":1}`)),
+			token:        "unknown",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "Token of another user",
+			method:       "GET",
+			url:          "/user?token=tkn&id=2",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "Body user of another user",
+			method:       "POST",
+			url:          "/user/deposit",
+			data:         bytes.NewBuffer([]byte(`{"userId":2, "depositId":1, "amount":1}`)),
+			token:        "tkn",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "Withdrawal for another user with differently cased field",
+			method:       "POST",
+			url:          "/user/withdrawal",
+			data:         bytes.NewBuffer([]byte(`{"UserID":2, "withdrawalId":1, "amount":1}`)),
+			token:        "player",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "Withdrawal for another user with own user repeated",
+			method:       "POST",
+			url:          "/user/withdrawal",
+			data:         bytes.NewBuffer([]byte(`{"userId":1, "UserId":2, "withdrawalId":1, "amount":1}`)),
+			token:        "player",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "Status of another user with differently cased field",
+			method:       "POST",
+			url:          "/user/status",
+			data:         bytes.NewBuffer([]byte(`{"USERID":2, "status":"closed"}`)),
+			token:        "player",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "Status of another user with own user repeated",
+			method:       "POST",
+			url:          "/user/status",
+			data:         bytes.NewBuffer([]byte(`{"userId":1, "USERID":2, "status":"closed"}`)),
+			token:        "player",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "Own status",
+			method:       "POST",
+			url:          "/user/status",
+			data:         bytes.NewBuffer([]byte(`{"userId":1, "status":"closed"}`)),
+			token:        "player",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Session deposit to own account",
+			method:       "POST",
+			url:          "/user/deposit",
+			data:         bytes.NewBuffer([]byte(`{"userId":1, "depositId":1, "amount":1}`)),
+			token:        "player",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "Session win to own account",
+			method:       "POST",
+			url:          "/transaction",
+			data:         bytes.NewBuffer([]byte(`{"userId":1, "transactionId":1, "type":"Win", "amount":1}`)),
+			token:        "player",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "Capture hold of another user",
+			method:       "POST",
+			url:          "/hold/capture",
+			data:         bytes.NewBuffer([]byte(`{"userId":2, "holdId":1, "transactionId":1}`)),
+			token:        "tkn",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "Capture hold without user",
+			method:       "POST",
+			url:          "/hold/capture",
+			data:         bytes.NewBuffer([]byte(`{"holdId":1, "transactionId":1}`)),
+			token:        "tkn",
 			expectedCode: http.StatusBadRequest,
 		},
+		{
+			name:         "Admin route for another user",
+			method:       "POST",
+			url:          "/admin/bonus",
+			data:         bytes.NewBuffer([]byte(`{"userId":2, "bonusId":1, "amount":1}`)),
+			token:        "tkn",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "Admin route for own user",
+			method:       "POST",
+			url:          "/admin/bonus",
+			data:         bytes.NewBuffer([]byte(`{"userId":1, "bonusId":1, "amount":1}`)),
+			token:        "tkn",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "Create user without token",
+			method:       "POST",
+			url:          "/user",
+			data:         bytes.NewBuffer([]byte(`{"id":5, "balance":1}`)),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "Create user with session token",
+			method:       "POST",
+			url:          "/user",
+			data:         bytes.NewBuffer([]byte(`{"id":5, "balance":1}`)),
+			token:        "tkn",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "API key deposit for any user",
+			method:       "POST",
+			url:          "/user/deposit",
+			data:         bytes.NewBuffer([]byte(`{"userId":2, "depositId":1, "amount":1}`)),
+			token:        "ck_cashier",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "API key without scope",
+			method:       "POST",
+			url:          "/transaction",
+			data:         bytes.NewBuffer([]byte(`{"userId":2, "transactionId":1, "type":"Bet", "amount":1}`)),
+			token:        "ck_cashier",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "Refresh session",
+			method:       "POST",
+			url:          "/session/refresh",
+			data:         bytes.NewBuffer([]byte(`{}`)),
+			token:        "tkn",
+			expectedCode: http.StatusOK,
+		},
 	}
 	for _, testCase := range testCases {
 
@@ -112,6 +428,9 @@ func TestCheckToken(t *testing.T) {
 			if testCase.method == "POST" || testCase.method == "PUT" {
 				req.Header.Set("Content-Type", "application/json")
 			}
+			if testCase.token != "" {
+				req.Header.Set("Authorization", "Bearer "+testCase.token)
+			}
 			middlewareTestHandler.ServeHTTP(rec, req)
 			bodyBytes, _ := ioutil.ReadAll(rec.Body)
 			t.Log(string(bodyBytes))
@@ -119,3 +438,363 @@ func TestCheckToken(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckSignature(t *testing.T) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-2*time.Minute).Unix(), 10)
+	body := `{"userId":2, "transactionId":1, "type":"Bet", "amount":1}`
+	testCases := []struct {
+		name         string
+		url          string
+		provider     string
+		timestamp    string
+		nonce        string
+		secret       string
+		expectedCode int
+	}{
+		{
+			name:         "Valid signature",
+			url:          "/provider/transaction",
+			provider:     "games",
+			timestamp:    now,
+			nonce:        "1",
+			secret:       "new",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Previous secret",
+			url:          "/provider/transaction",
+			provider:     "games",
+			timestamp:    now,
+			nonce:        "2",
+			secret:       "old",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Replayed nonce",
+			url:          "/provider/transaction",
+			provider:     "games",
+			timestamp:    now,
+			nonce:        "1",
+			secret:       "new",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "Wrong secret",
+			url:          "/provider/transaction",
+			provider:     "games",
+			timestamp:    now,
+			nonce:        "3",
+			secret:       "unknown",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "Unknown provider",
+			url:          "/provider/transaction",
+			provider:     "other",
+			timestamp:    now,
+			nonce:        "4",
+			secret:       "new",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "Expired timestamp",
+			url:          "/provider/transaction",
+			provider:     "games",
+			timestamp:    old,
+			nonce:        "5",
+			secret:       "new",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "Route out of provider scope",
+			url:          "/provider/user/deposit",
+			provider:     "games",
+			timestamp:    now,
+			nonce:        "6",
+			secret:       "new",
+			expectedCode: http.StatusNotFound,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", testCase.url, bytes.NewBuffer([]byte(body)))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(headerProvider, testCase.provider)
+			req.Header.Set(headerTimestamp, testCase.timestamp)
+			req.Header.Set(headerNonce, testCase.nonce)
+			req.Header.Set(headerSignature, sign(testCase.secret, testCase.timestamp, testCase.nonce, []byte(body)))
+			middlewareTestHandler.ServeHTTP(rec, req)
+			responseBody, _ := ioutil.ReadAll(rec.Body)
+			t.Log(string(responseBody))
+			assert.Equal(t, testCase.expectedCode, rec.Code)
+			if rec.Code == http.StatusOK {
+				// response is signed with the secret of request
+				expected := sign(testCase.secret, rec.Header().Get(headerTimestamp), testCase.nonce, responseBody)
+				assert.Equal(t, expected, rec.Header().Get(headerSignature))
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limits, err := ParseRateLimits("default=1:2, /transaction=10:1")
+	assert.Nil(t, err)
+	limiter := newRateLimiter(limits)
+	now := time.Now()
+	testCases := []struct {
+		name          string
+		client        string
+		route         string
+		after         time.Duration
+		expectedOk    bool
+		expectedRetry time.Duration
+	}{
+		{name: "First request", client: "a", route: "/user", expectedOk: true},
+		{name: "Burst", client: "a", route: "/user", expectedOk: true},
+		{name: "Bucket is empty", client: "a", route: "/user", expectedOk: false, expectedRetry: time.Second},
+		{name: "Another client", client: "b", route: "/user", expectedOk: true},
+		{name: "Another route", client: "a", route: "/user/history", expectedOk: false, expectedRetry: time.Second},
+		{name: "Route rule", client: "a", route: "/transaction", expectedOk: true},
+		{name: "Route rule burst", client: "a", route: "/transaction", expectedOk: false, expectedRetry: 100 * time.Millisecond},
+		{name: "Refilled", client: "a", route: "/user", after: time.Second, expectedOk: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			now = now.Add(testCase.after)
+			ok, retry := limiter.allow(testCase.client, testCase.route, now)
+			assert.Equal(t, testCase.expectedOk, ok)
+			assert.Equal(t, testCase.expectedRetry, retry)
+		})
+	}
+	assert.Equal(t, map[string]uint64{"default": 2, "/transaction": 1}, limiter.takeRejected())
+	// check doesn't take token
+	ok, _ := limiter.check("c", "/user", now)
+	assert.True(t, ok)
+	ok, _ = limiter.allow("d", "/user", now)
+	assert.True(t, ok)
+	ok, _ = limiter.check("d", "/user", now)
+	assert.True(t, ok)
+	ok, _ = limiter.allow("d", "/user", now)
+	assert.True(t, ok)
+	ok, _ = limiter.check("d", "/user", now)
+	assert.False(t, ok)
+	limiter.prune(now.Add(time.Minute))
+	assert.Empty(t, limiter.buckets)
+
+	_, err = ParseRateLimits("default=1")
+	assert.NotNil(t, err)
+}
+
+func TestRateLimitClients(t *testing.T) {
+	limits, err := ParseRateLimits("default=0.001:2")
+	assert.Nil(t, err)
+	h := &handler{router: mux.NewRouter(), storeHandler: &MiddlewareMockStoreHandler{}, logger: logrus.New()}
+	m := &middleware{logger: h.logger, storeHandler: h.storeHandler, rateLimiter: newRateLimiter(limits)}
+	h.initRouter(m)
+	request := func(addr, token string) int {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/ping", nil)
+		req.RemoteAddr = addr + ":1234"
+		req.Header.Set("Authorization", "Bearer "+token)
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	testCases := []struct {
+		name         string
+		addr         string
+		token        string
+		expectedCode int
+	}{
+		{name: "Session", addr: "10.0.0.1", token: "tkn", expectedCode: http.StatusOK},
+		{name: "Session burst", addr: "10.0.0.1", token: "tkn", expectedCode: http.StatusOK},
+		{name: "Session bucket is empty", addr: "10.0.0.1", token: "tkn", expectedCode: http.StatusTooManyRequests},
+		{name: "API key behind the same address", addr: "10.0.0.1", token: "ck_cashier", expectedCode: http.StatusOK},
+		{name: "Invalid token", addr: "10.0.0.2", token: "random1", expectedCode: http.StatusUnauthorized},
+		{name: "Another invalid token", addr: "10.0.0.2", token: "random2", expectedCode: http.StatusUnauthorized},
+		{name: "New invalid token is limited by address", addr: "10.0.0.2", token: "random3", expectedCode: http.StatusTooManyRequests},
+		{name: "Another address", addr: "10.0.0.3", token: "random4", expectedCode: http.StatusUnauthorized},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.expectedCode, request(testCase.addr, testCase.token))
+		})
+	}
+	// invalid tokens don't get own buckets
+	assert.Len(t, m.rateLimiter.buckets, 4)
+}
+
+func TestInFlightLimit(t *testing.T) {
+	h := &handler{router: mux.NewRouter(), logger: logrus.New(), inFlight: newInFlightLimiter(1)}
+	entered := make(chan struct{})
+	finish := make(chan struct{})
+	slow := h.limitInFlight(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-finish
+	})
+	request := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/transaction", bytes.NewBuffer([]byte(body)))
+		slow(rec, req)
+		return rec
+	}
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- request(`{"userId":1}`) }()
+	<-entered
+
+	rec := request(`{"userId":1}`)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	// handler decodes field case-insensitively, so the same user is counted
+	rec = request(`{"UserID":1}`)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	rec = request(`{"userId":2, "USERID":1}`)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	close(finish)
+	assert.Equal(t, http.StatusOK, (<-done).Code)
+	assert.Empty(t, h.inFlight.users)
+	assert.Equal(t, uint64(3), h.inFlight.rejected)
+}
+
+func TestReadBody(t *testing.T) {
+	testCases := []struct {
+		name          string
+		contentType   string
+		body          string
+		expectedCode  int
+		expectedError store.ErrorCode
+	}{
+		{
+			name:         "Valid body",
+			contentType:  "application/json; charset=utf-8",
+			body:         `{"token":"tkn"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:          "Invalid content type",
+			contentType:   "text/plain",
+			body:          `{"token":"tkn"}`,
+			expectedCode:  http.StatusUnsupportedMediaType,
+			expectedError: store.CodeUnsupportedMediaType,
+		},
+		{
+			name:          "Body too large",
+			contentType:   "application/json",
+			body:          `{"token":"tkn", "data":"` + strings.Repeat("a", 256) + `"}`,
+			expectedCode:  http.StatusRequestEntityTooLarge,
+			expectedError: store.CodeRequestTooLarge,
+		},
+		{
+			name:          "Duplicate field",
+			contentType:   "application/json",
+			body:          `{"token":"tkn", "userId":1, "userId":2}`,
+			expectedCode:  http.StatusBadRequest,
+			expectedError: store.CodeInvalidField,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/ping", bytes.NewBuffer([]byte(testCase.body)))
+			req.Header.Set("Content-Type", testCase.contentType)
+			middlewareTestHandler.ServeHTTP(rec, req)
+			assert.Equal(t, testCase.expectedCode, rec.Code)
+			if testCase.expectedError != "" {
+				assert.Contains(t, rec.Body.String(), `"code":"`+string(testCase.expectedError)+`"`)
+			}
+		})
+	}
+	assert.Equal(t, "a.b", duplicateField([]byte(`{"a":{"b":1,"c":[{"b":1}],"b":2}}`)))
+	assert.Equal(t, "", duplicateField([]byte(`{"a":{"b":1},"b":{"a":2}}`)))
+}
+
+func TestLogRequest(t *testing.T) {
+	var output bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&output)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	m := &middleware{logger: logger, maxBodySize: 256, logBodies: true}
+	var handlerLog *logrus.Entry
+	h := m.requestID(m.readBody(m.logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerLog = m.log(r)
+		w.WriteHeader(http.StatusCreated)
+	}))))
+
+	req, _ := http.NewRequest("POST", "/user?token=qtkn&id=1", bytes.NewBufferString(`{"token":"tkn","user":{"apiKey":"key"},"amount":10.5}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerRequestID, "log-test")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, "log-test", handlerLog.Data["requestId"])
+	assert.NotContains(t, output.String(), "tkn")
+	assert.NotContains(t, output.String(), `\"key\"`)
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], `"requestId":"log-test"`)
+		assert.Contains(t, lines[0], `"url":"/user?id=1\u0026token=%5BREDACTED%5D"`)
+		assert.Contains(t, lines[0], `"body":"{\"amount\":10.5,\"token\":\"[REDACTED]\",\"user\":{\"apiKey\":\"[REDACTED]\"}}"`)
+		assert.Contains(t, lines[1], `"status":201`)
+	}
+
+	output.Reset()
+	m.logBodies = false
+	req, _ = http.NewRequest("POST", "/user", bytes.NewBufferString(`{"amount":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.NotContains(t, output.String(), "amount")
+	assert.Equal(t, "<3 bytes of invalid JSON>", redactBody([]byte("abc")))
+}
+
+// Install tracer provider which keeps ended spans in memory
+func recordSpans() (*tracetest.SpanRecorder, func()) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	return recorder, func() { otel.SetTracerProvider(noop.NewTracerProvider()) }
+}
+
+// Attributes of span by key
+func spanAttributes(span sdktrace.ReadOnlySpan) map[string]interface{} {
+	attributes := make(map[string]interface{})
+	for _, kv := range span.Attributes() {
+		attributes[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	return attributes
+}
+
+func TestTrace(t *testing.T) {
+	recorder, reset := recordSpans()
+	defer reset()
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/user/deposit", bytes.NewBufferString(`{"depositId":1,"userId":1,"amount":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer tkn")
+	req.Header.Set(headerTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(headerRequestID, "trace-test")
+	middlewareTestHandler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	spans := recorder.Ended()
+	if assert.Len(t, spans, 2) {
+		decode, server := spans[0], spans[1]
+		assert.Equal(t, "decode body", decode.Name())
+		assert.Equal(t, server.SpanContext().SpanID(), decode.Parent().SpanID())
+		assert.Equal(t, "POST /user/deposit", server.Name())
+		assert.Equal(t, oteltrace.SpanKindServer, server.SpanKind())
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+		attributes := spanAttributes(server)
+		assert.Equal(t, "/user/deposit", attributes["http.route"])
+		assert.Equal(t, "trace-test", attributes["http.request_id"])
+		assert.Equal(t, int64(http.StatusOK), attributes["http.status_code"])
+	}
+
+	// caller decided not to sample the trace
+	req, _ = http.NewRequest("GET", "/ping", nil)
+	req.Header.Set("Authorization", "Bearer tkn")
+	req.Header.Set(headerTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	middlewareTestHandler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Len(t, recorder.Ended(), 2)
+}
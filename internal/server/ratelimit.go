@@ -0,0 +1,342 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dehimb/cake/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+// Clients are limited in two ways:
+//  - requests rate, token bucket per client and route. Client is IP address until
+//    its token is checked, then user of session or API key.
+//  - balance changing requests of one user which are processed at the same time
+
+const (
+	// Rule for routes without own rule
+	defaultRateLimitRoute = "default"
+
+	DefaultRateLimits  = "default=50:100"
+	DefaultMaxInFlight = 4
+
+	// Period of rejected requests summary in logs
+	limitReportInterval = time.Minute
+	// Full buckets are pruned before new one is added above this size
+	maxRateLimitBuckets = 100000
+)
+
+// Rate limit of route: tokens added per second and bucket size
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// Rate limits keyed by route path, "default" applies to other routes
+type RateLimits map[string]RateLimit
+
+// Format limits like ParseRateLimits accepts them
+func (l RateLimits) String() string {
+	routes := make([]string, 0, len(l))
+	for route := range l {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for i, route := range routes {
+		routes[i] = fmt.Sprintf("%s=%s:%d", route, strconv.FormatFloat(l[route].Rate, 'f', -1, 64), l[route].Burst)
+	}
+	return strings.Join(routes, ",")
+}
+
+// Parse comma separated list of route=rate:burst like "default=50:100,/transaction=20:40"
+func ParseRateLimits(list string) (RateLimits, error) {
+	limits := make(RateLimits)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid rate limit: %s", item)
+		}
+		values := strings.Split(parts[1], ":")
+		if len(values) != 2 {
+			return nil, fmt.Errorf("Invalid rate limit: %s", item)
+		}
+		rate, err := strconv.ParseFloat(values[0], 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("Invalid rate of %s", parts[0])
+		}
+		burst, err := strconv.Atoi(values[1])
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("Invalid burst of %s", parts[0])
+		}
+		limits[parts[0]] = RateLimit{Rate: rate, Burst: burst}
+	}
+	return limits, nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Add tokens for time passed since last request
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	limits  RateLimits
+	buckets map[string]*tokenBucket
+	// rejected requests keyed by route
+	rejected map[string]uint64
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{limits: limits, buckets: make(map[string]*tokenBucket), rejected: make(map[string]uint64)}
+}
+
+// Take token from bucket of client and route. When bucket is empty
+// time after which request can be retried is returned.
+func (l *rateLimiter) allow(client, route string, now time.Time) (bool, time.Duration) {
+	return l.take(client, route, now, true)
+}
+
+// Report whether bucket of client and route has token, without taking it
+func (l *rateLimiter) check(client, route string, now time.Time) (bool, time.Duration) {
+	return l.take(client, route, now, false)
+}
+
+func (l *rateLimiter) take(client, route string, now time.Time, consume bool) (bool, time.Duration) {
+	limit, ok := l.limits[route]
+	if !ok {
+		route = defaultRateLimitRoute
+		if limit, ok = l.limits[route]; !ok {
+			return true, 0
+		}
+	}
+	l.Lock()
+	defer l.Unlock()
+	key := route + " " + client
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if !consume {
+			// missing bucket is full
+			return true, 0
+		}
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.pruneLocked(now)
+		}
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.refill(limit, now)
+	if bucket.tokens < 1 {
+		l.rejected[route]++
+		rateLimitedTotal.Inc(route)
+		return false, time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+	}
+	if consume {
+		bucket.tokens--
+	}
+	return true, 0
+}
+
+// Remove buckets which are full again, they don't differ from new ones
+func (l *rateLimiter) prune(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	l.pruneLocked(now)
+}
+
+func (l *rateLimiter) pruneLocked(now time.Time) {
+	for key, bucket := range l.buckets {
+		limit, ok := l.limits[key[:strings.Index(key, " ")]]
+		if !ok {
+			continue
+		}
+		bucket.refill(limit, now)
+		if bucket.tokens >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Return and reset counters of rejected requests
+func (l *rateLimiter) takeRejected() map[string]uint64 {
+	l.Lock()
+	defer l.Unlock()
+	rejected := l.rejected
+	l.rejected = make(map[string]uint64)
+	return rejected
+}
+
+// Rate limit clients by IP address before their token is checked. Bucket of address
+// is taken by provider requests, which are authenticated later by signature, and by
+// failed authentications, see limitAuthFailure. Clients with valid tokens are limited
+// by limitPrincipal, so they don't share limit with other clients behind the address.
+func (m *middleware) limitRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.rateLimiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		check := m.rateLimiter.check
+		if strings.HasPrefix(r.URL.Path, providerPathPrefix) {
+			check = m.rateLimiter.allow
+		}
+		if ok, retryAfter := check(clientIPKey(r), r.URL.Path, time.Now()); !ok {
+			sendRateLimited(w, r, m.log(r), retryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Take token from bucket of client address when its token is rejected
+func (m *middleware) limitAuthFailure(r *http.Request) {
+	if m.rateLimiter != nil {
+		m.rateLimiter.allow(clientIPKey(r), r.URL.Path, time.Now())
+	}
+}
+
+// Rate limit clients by principal resolved by checkToken
+func (m *middleware) limitPrincipal(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := principalFrom(r.Context())
+		if m.rateLimiter == nil || principal == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, retryAfter := m.rateLimiter.allow(principalClientKey(principal), r.URL.Path, time.Now()); !ok {
+			sendRateLimited(w, r, m.log(r), retryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func sendRateLimited(w http.ResponseWriter, r *http.Request, log *logrus.Entry, retryAfter time.Duration) {
+	log.Debug("Rate limit exceeded")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	sendErrorResponseWithCode(w, "Rate limit exceeded", store.CodeRateLimited, http.StatusTooManyRequests)
+}
+
+// Provider headers are not trusted before signature is checked, so providers are limited by IP
+func clientIPKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Sessions of the same user share bucket, so new sessions don't reset it
+func principalClientKey(p *store.Principal) string {
+	if p.UserID != 0 {
+		return "user:" + strconv.FormatUint(p.UserID, 10)
+	}
+	return "key:" + strconv.FormatUint(p.APIKeyID, 10)
+}
+
+// Counts balance changing requests processed for every user
+type inFlightLimiter struct {
+	sync.Mutex
+	max      int
+	users    map[uint64]int
+	rejected uint64
+}
+
+func newInFlightLimiter(max int) *inFlightLimiter {
+	return &inFlightLimiter{max: max, users: make(map[uint64]int)}
+}
+
+func (l *inFlightLimiter) acquire(userID uint64) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.users[userID] >= l.max {
+		atomic.AddUint64(&l.rejected, 1)
+		inFlightRejectedTotal.Inc()
+		return false
+	}
+	l.users[userID]++
+	return true
+}
+
+func (l *inFlightLimiter) release(userID uint64) {
+	l.Lock()
+	defer l.Unlock()
+	if l.users[userID]--; l.users[userID] <= 0 {
+		delete(l.users, userID)
+	}
+}
+
+// Reject balance changing request when user has too many of them in progress
+func (h *handler) limitInFlight(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.inFlight == nil {
+			next(w, r)
+			return
+		}
+		userID := requestUserID(r)
+		if userID == 0 {
+			// requests without user are rejected by handler
+			next(w, r)
+			return
+		}
+		if !h.inFlight.acquire(userID) {
+			h.log(r).Debugf("Too many requests in flight for user %d", userID)
+			w.Header().Set("Retry-After", "1")
+			sendErrorResponseWithCode(w, "Too many requests in progress", store.CodeTooManyInFlight, http.StatusTooManyRequests)
+			return
+		}
+		defer h.inFlight.release(userID)
+		next(w, r)
+	}
+}
+
+// User of request, from principal of session or "userId" body field of operator request.
+// Body field is decoded the way handler decodes it, see bodyUserID, so requests
+// are counted against the user they change.
+func requestUserID(r *http.Request) uint64 {
+	if principal := principalFrom(r.Context()); principal != nil && principal.UserID != 0 {
+		return principal.UserID
+	}
+	return bodyUserID(bodyFrom(r))
+}
+
+// Log rejected requests summary and forget idle clients until ctx is done
+func reportLimits(done <-chan struct{}, logger *logrus.Logger, rates *rateLimiter, inFlight *inFlightLimiter) {
+	ticker := time.NewTicker(limitReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if rates != nil {
+				rates.prune(now)
+				for route, count := range rates.takeRejected() {
+					logger.Warnf("Rate limit rejected %d requests to %s", count, route)
+				}
+			}
+			if inFlight != nil {
+				if count := atomic.SwapUint64(&inFlight.rejected, 0); count > 0 {
+					logger.Warnf("In flight limit rejected %d requests", count)
+				}
+			}
+		}
+	}
+}
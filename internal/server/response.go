@@ -1,25 +1,122 @@
 package server
 
+import (
+	"time"
+
+	"github.com/dehimb/cake/internal/store"
+)
+
+// Every error has stable code from store.ErrorCode catalog
 type ErrorResponse struct {
-	Error string `json:"error"`
+	Error string          `json:"error"`
+	Code  store.ErrorCode `json:"code"`
+	// Fields which failed validation
+	Details   []FieldError `json:"details,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+}
+
+// Status is "ok" or "unavailable"
+type HealthResponse struct {
+	Status string              `json:"status"`
+	Checks []store.HealthCheck `json:"checks,omitempty"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
 }
 
 type UserCreateResponse struct {
-	Error string `json:"error"`
+	// First session token of the user
+	Token     string     `json:"token,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Error     string     `json:"error"`
+}
+
+type SessionResponse struct {
+	Token     string    `json:"token"`
+	UserID    uint64    `json:"userId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Error     string    `json:"error"`
 }
 
 type UserResponse struct {
-	UserID        uint64  `json:"id"`
-	Balance       float32 `json:"balance"`
-	DepositeCount int     `json:"depositCount"`
-	DepositSum    float32 `json:"depositSum"`
-	BetCount      int     `json:"betCount"`
-	BetSum        float32 `json:"betSum"`
-	WinCount      int     `json:"winCount"`
-	WinSum        float32 `json:"winSum"`
+	UserID  uint64      `json:"id"`
+	Balance store.Money `json:"balance"`
+	// Balance without funds reserved by holds
+	AvailableBalance store.Money `json:"availableBalance"`
+	DepositeCount    int         `json:"depositCount"`
+	DepositSum       store.Money `json:"depositSum"`
+	BetCount         int         `json:"betCount"`
+	BetSum           store.Money `json:"betSum"`
+	WinCount         int         `json:"winCount"`
+	WinSum           store.Money `json:"winSum"`
+
+	WithdrawalCount        int         `json:"withdrawalCount"`
+	WithdrawalSum          store.Money `json:"withdrawalSum"`
+	PendingWithdrawalCount int         `json:"pendingWithdrawalCount"`
+	PendingWithdrawalSum   store.Money `json:"pendingWithdrawalSum"`
+
+	// Balance contains only cash, bonus wallet is reported separately
+	BonusBalance store.Money `json:"bonusBalance"`
+	WageringLeft store.Money `json:"wageringLeft"`
+	// parts of betSum and winSum paid from and to bonus wallet
+	BetBonusSum       store.Money `json:"betBonusSum"`
+	WinBonusSum       store.Money `json:"winBonusSum"`
+	BonusGrantedSum   store.Money `json:"bonusGrantedSum"`
+	BonusConvertedSum store.Money `json:"bonusConvertedSum"`
+	BonusExpiredSum   store.Money `json:"bonusExpiredSum"`
+
+	Status store.AccountStatus `json:"status"`
+	// End of self-exclusion
+	StatusUntil *time.Time `json:"statusUntil,omitempty"`
 }
 
 type DepositResponse struct {
-	Balance float32 `json:"balance"`
-	Errror  string  `json:"error"`
+	Balance store.Money     `json:"balance"`
+	Errror  string          `json:"error"`
+	Code    store.ErrorCode `json:"code,omitempty"`
+}
+
+type HistoryResponse struct {
+	Entries    []store.LedgerEntry `json:"entries"`
+	NextCursor string              `json:"nextCursor,omitempty"`
+}
+
+type WithdrawalResponse struct {
+	store.Withdrawal
+	Error string `json:"error"`
+}
+
+type BonusResponse struct {
+	BonusBalance store.Money     `json:"bonusBalance"`
+	Error        string          `json:"error"`
+	Code         store.ErrorCode `json:"code,omitempty"`
+}
+
+type LimitsResponse struct {
+	Limits []store.Limit `json:"limits"`
+	Error  string        `json:"error"`
+}
+
+type LimitResponse struct {
+	// nil when limit was removed
+	Limit *store.Limit `json:"limit"`
+	Error string       `json:"error"`
+}
+
+type StatusResponse struct {
+	UserID      uint64              `json:"id"`
+	Status      store.AccountStatus `json:"status"`
+	StatusUntil *time.Time          `json:"statusUntil,omitempty"`
+	Error       string              `json:"error"`
+}
+
+type HoldResponse struct {
+	HoldID           uint64           `json:"holdId"`
+	Status           store.HoldStatus `json:"status"`
+	AvailableBalance store.Money      `json:"availableBalance"`
+	ExpiresAt        time.Time        `json:"expiresAt,omitempty"`
+	Error            string           `json:"error"`
+	Code             store.ErrorCode  `json:"code,omitempty"`
 }
@@ -5,57 +5,167 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/dehimb/cake/internal/metrics"
 	"github.com/dehimb/cake/internal/store"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
 
-func Start(ctx context.Context, storeHandler store.StoreHandler, logger *logrus.Logger) {
+const (
+	DefaultAddr            = ":8080"
+	DefaultReadTimeout     = 15 * time.Second
+	DefaultWriteTimeout    = 15 * time.Second
+	DefaultIdleTimeout     = 60 * time.Second
+	DefaultRequestTimeout  = 10 * time.Second
+	DefaultShutdownTimeout = 5 * time.Second
+)
+
+type Config struct {
+	// Listen address, defaults to DefaultAddr
+	Addr string
+	// Zero timeouts are replaced by defaults
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	// Store operations of request are abandoned after this time with 504.
+	// Should be less than WriteTimeout, so client receives the response.
+	RequestTimeout time.Duration
+	// Time between readiness failure and closing of listener,
+	// so load balancers stop sending requests before shutdown
+	ShutdownDelay time.Duration
+	// Origins allowed by CORS, any origin when empty
+	CORSOrigins []string
+	// Secrets used to verify signed requests of game providers
+	Providers ProviderSecrets
+	// Max difference between signature timestamp and server time
+	SignatureWindow time.Duration
+	// Requests rate of every client, not limited when empty
+	RateLimits RateLimits
+	// Balance changing requests of one user processed at the same time, not limited when 0
+	MaxInFlight int
+	// Max size of request body in bytes
+	MaxBodySize int64
+	// Log request bodies, secrets are redacted
+	LogBodies bool
+}
+
+// Serve requests until ctx is done, then drain requests in progress and close the store.
+// Returns error when server fails to start or any shutdown step fails.
+func Start(ctx context.Context, storeHandler store.StoreHandler, logger *logrus.Logger, config Config) error {
+	if config.Addr == "" {
+		config.Addr = DefaultAddr
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = DefaultReadTimeout
+	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = DefaultWriteTimeout
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = DefaultIdleTimeout
+	}
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = DefaultRequestTimeout
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if len(config.CORSOrigins) == 0 {
+		config.CORSOrigins = []string{"*"}
+	}
+	if config.SignatureWindow == 0 {
+		config.SignatureWindow = DefaultSignatureWindow
+	}
+	if config.MaxBodySize == 0 {
+		config.MaxBodySize = DefaultMaxBodySize
+	}
 	handler := &handler{
 		router:       mux.NewRouter(),
 		storeHandler: storeHandler,
 		logger:       logger,
+		shutdown:     ctx.Done(),
+	}
+	if config.MaxInFlight > 0 {
+		handler.inFlight = newInFlightLimiter(config.MaxInFlight)
 	}
+	root := http.NewServeMux()
+	root.Handle(metricsPath, metrics.Default)
+	root.HandleFunc(healthzPath, handler.healthz)
+	root.HandleFunc(readyzPath, handler.readyz)
+	root.Handle("/", handler)
 	s := &http.Server{
-		Addr:         ":8080",
-		Handler:      handler,
-		WriteTimeout: time.Second * 15,
-		ReadTimeout:  time.Second * 15,
-		IdleTimeout:  time.Second * 60,
+		Addr:         config.Addr,
+		Handler:      root,
+		WriteTimeout: config.WriteTimeout,
+		ReadTimeout:  config.ReadTimeout,
+		IdleTimeout:  config.IdleTimeout,
 	}
 
 	m := &middleware{
 		logger:       logger,
 		storeHandler: storeHandler,
+
+		providers:       config.Providers,
+		signatureWindow: config.SignatureWindow,
+		nonces:          newNonceCache(config.SignatureWindow),
+
+		maxBodySize:    config.MaxBodySize,
+		requestTimeout: config.RequestTimeout,
+		corsOrigins:    config.CORSOrigins,
+		logBodies:      config.LogBodies,
+	}
+	if len(config.RateLimits) > 0 {
+		m.rateLimiter = newRateLimiter(config.RateLimits)
 	}
 	handler.initRouter(m)
+	go reportLimits(ctx.Done(), logger, m.rateLimiter, handler.inFlight)
 
+	serveErr := make(chan error, 1)
 	go func() {
-		err := s.ListenAndServe()
-		if err != nil && err != http.ErrServerClosed {
-			logger.Fatal("Error starting server", err)
-		}
+		serveErr <- s.ListenAndServe()
 	}()
 
-	logger.Info("Server started")
+	logger.Info("Server started on ", config.Addr)
 
-	waitForShutdown(ctx, s, logger)
-	// Wait untill all services can stop
-	// TODO change this logic
-	time.Sleep(1 * time.Second)
+	err := waitForShutdown(ctx, s, serveErr, logger, config.ShutdownDelay, config.ShutdownTimeout)
+	// store is closed after requests are drained, so the final flush sees all their changes
+	ctxClose, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if closeErr := storeHandler.Close(ctxClose); closeErr != nil {
+		logger.Errorf("Store close failed: %s", closeErr)
+		if err == nil {
+			err = closeErr
+		}
+	} else {
+		logger.Info("Store closed")
+	}
 	logger.Info("Exiting...")
+	return err
 }
 
-func waitForShutdown(ctx context.Context, s *http.Server, logger *logrus.Logger) {
-	<-ctx.Done()
+// Wait for ctx and shut server down, requests in progress are given timeout to finish
+func waitForShutdown(ctx context.Context, s *http.Server, serveErr <-chan error, logger *logrus.Logger, delay, timeout time.Duration) error {
+	select {
+	case err := <-serveErr:
+		logger.Errorf("Error starting server: %s", err)
+		return err
+	case <-ctx.Done():
+	}
+	if delay > 0 {
+		// readiness fails already, requests are still served
+		logger.Infof("Waiting %s before shutdown", delay)
+		time.Sleep(delay)
+	}
 	logger.Info("Trying graceful shutdown server")
 
-	ctxShutDown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctxShutDown, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	if err := s.Shutdown(ctxShutDown); err != nil {
 		logger.Errorf("Server shutdown failed: %s", err)
-		return
+		return err
 	}
 	logger.Info("Server stopped")
+	return nil
 }
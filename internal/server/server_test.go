@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dehimb/cake/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// Store which blocks GetUser until released and records when it is closed
+type drainStoreHandler struct {
+	MiddlewareMockStoreHandler
+	started chan struct{}
+	release chan struct{}
+	// Close was called after GetUser was released
+	drained chan bool
+}
+
+func (storeHandler *drainStoreHandler) GetUser(ctx context.Context, userID uint64) (*store.User, *store.Statistic, error) {
+	close(storeHandler.started)
+	<-storeHandler.release
+	return &store.User{ID: userID}, &store.Statistic{UserID: userID}, nil
+}
+
+func (storeHandler *drainStoreHandler) Close(ctx context.Context) error {
+	select {
+	case <-storeHandler.release:
+		storeHandler.drained <- true
+	default:
+		storeHandler.drained <- false
+	}
+	return nil
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return "127.0.0.1:" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestStart(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	storeHandler := &drainStoreHandler{started: make(chan struct{}), release: make(chan struct{}), drained: make(chan bool, 1)}
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// spare keep-alive connections without requests would delay shutdown
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	result := make(chan error, 1)
+	go func() {
+		result <- Start(ctx, storeHandler, logger, Config{Addr: addr, ShutdownTimeout: 5 * time.Second})
+	}()
+	for i := 0; ; i++ {
+		resp, err := client.Get("http://" + addr + healthzPath)
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatal("Server didn't start: ", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// request in progress when shutdown begins is completed before store is closed
+	status := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://"+addr+"/user?id=1", nil)
+		req.Header.Set("Authorization", "Bearer tkn")
+		resp, err := client.Do(req)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-storeHandler.started
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(storeHandler.release)
+	assert.Equal(t, http.StatusOK, <-status)
+	assert.NoError(t, <-result)
+	assert.True(t, <-storeHandler.drained)
+
+	// store is closed when server can't start too
+	storeHandler = &drainStoreHandler{drained: make(chan bool, 1)}
+	err := Start(context.Background(), storeHandler, logger, Config{Addr: "127.0.0.1:-1"})
+	assert.Error(t, err)
+	assert.False(t, <-storeHandler.drained)
+}
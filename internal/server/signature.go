@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dehimb/cake/internal/store"
+)
+
+// Game providers call wallet routes under providerPathPrefix. Instead of token
+// they sign every request with HMAC-SHA256:
+//
+//   X-Provider:  provider name
+//   X-Timestamp: unix time of the request in seconds
+//   X-Nonce:     unique string, the same nonce can't be used twice within the window
+//   X-Signature: hex(HMAC-SHA256(secret, timestamp + "." + nonce + "." + body))
+//
+// Every provider has up to two active secrets, so secret can be rotated without
+// downtime. Responses are signed with the secret which verified the request:
+//
+//   X-Timestamp: unix time of the response in seconds
+//   X-Signature: hex(HMAC-SHA256(secret, timestamp + "." + request nonce + "." + body))
+
+const (
+	providerPathPrefix = "/provider/"
+
+	headerProvider  = "X-Provider"
+	headerTimestamp = "X-Timestamp"
+	headerNonce     = "X-Nonce"
+	headerSignature = "X-Signature"
+
+	DefaultSignatureWindow = 5 * time.Minute
+
+	// Provider can rotate secret while old one is still in use
+	maxProviderSecrets = 2
+)
+
+// Scopes of providers, they only report game outcomes
+var providerScopes = []store.Scope{store.ScopeTransactionsWrite}
+
+// Secrets of providers keyed by provider name
+type ProviderSecrets map[string][]string
+
+// Read provider secrets from JSON file like {"provider": ["secret", "next secret"]}
+func LoadProviderSecrets(fileName string) (ProviderSecrets, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var secrets ProviderSecrets
+	if err = json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("Can't parse provider secrets: %s", err)
+	}
+	return secrets, secrets.Validate()
+}
+
+func (p ProviderSecrets) Validate() error {
+	for provider, secrets := range p {
+		if len(secrets) == 0 || len(secrets) > maxProviderSecrets {
+			return fmt.Errorf("Provider %s must have from 1 to %d secrets", provider, maxProviderSecrets)
+		}
+		for _, secret := range secrets {
+			if secret == "" {
+				return fmt.Errorf("Provider %s has empty secret", provider)
+			}
+		}
+	}
+	return nil
+}
+
+func sign(secret, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + nonce + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Nonces seen within the signature window
+type nonceCache struct {
+	sync.Mutex
+	window    time.Duration
+	nonces    map[string]time.Time
+	lastPrune time.Time
+}
+
+func newNonceCache(window time.Duration) *nonceCache {
+	return &nonceCache{window: window, nonces: make(map[string]time.Time)}
+}
+
+// Remember nonce and report whether it was already used
+func (c *nonceCache) seen(nonce string, now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	// nonces older than window are rejected by timestamp check anyway
+	if now.Sub(c.lastPrune) > c.window {
+		for n, t := range c.nonces {
+			if now.Sub(t) > 2*c.window {
+				delete(c.nonces, n)
+			}
+		}
+		c.lastPrune = now
+	}
+	if _, ok := c.nonces[nonce]; ok {
+		return true
+	}
+	c.nonces[nonce] = now
+	return false
+}
+
+// Verify signature of provider request and sign the response.
+// Provider principal is put to request context like in checkToken.
+func (m *middleware) checkSignature(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := bodyFrom(r).raw
+		provider := r.Header.Get(headerProvider)
+		timestamp := r.Header.Get(headerTimestamp)
+		nonce := r.Header.Get(headerNonce)
+		secret, err := m.verifySignature(provider, timestamp, nonce, r.Header.Get(headerSignature), body)
+		if err != nil {
+			m.log(r).Warn("Rejected provider request: ", err)
+			sendErrorResponseWithCode(w, err.Error(), store.CodeUnauthenticated, http.StatusUnauthorized)
+			return
+		}
+
+		principal := &store.Principal{Operator: provider, Scopes: providerScopes}
+		sw := &signedResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), principalKey, principal)))
+
+		responseTimestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		w.Header().Set(headerTimestamp, responseTimestamp)
+		w.Header().Set(headerSignature, sign(secret, responseTimestamp, nonce, sw.body.Bytes()))
+		w.WriteHeader(sw.status)
+		w.Write(sw.body.Bytes())
+	})
+}
+
+// Check request signature and return secret which matched it
+func (m *middleware) verifySignature(provider, timestamp, nonce, signature string, body []byte) (string, error) {
+	secrets, ok := m.providers[provider]
+	if !ok {
+		return "", errors.New("Unknown provider")
+	}
+	if nonce == "" || signature == "" {
+		return "", errors.New("Signature is required")
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errors.New("Invalid timestamp")
+	}
+	now := time.Now()
+	if age := now.Sub(time.Unix(unix, 0)); age > m.signatureWindow || age < -m.signatureWindow {
+		return "", errors.New("Timestamp is outside of allowed window")
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return "", errors.New("Invalid signature")
+	}
+	for _, secret := range secrets {
+		actual, _ := hex.DecodeString(sign(secret, timestamp, nonce, body))
+		if hmac.Equal(expected, actual) {
+			// nonce is remembered only for valid signatures, so it can't be burned by others
+			if m.nonces.seen(provider+":"+nonce, now) {
+				return "", errors.New("Nonce is already used")
+			}
+			return secret, nil
+		}
+	}
+	return "", errors.New("Invalid signature")
+}
+
+// Keeps response until it can be signed
+type signedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *signedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *signedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/dehimb/cake/internal/trace"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// W3C trace context header, see trace.Propagator
+const headerTraceparent = "traceparent"
+
+// Start server span of the route. Caller trace and its sampling decision are
+// continued when request has valid traceparent header, otherwise new trace is started.
+func (m *middleware) trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := trace.Propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routeOf(r)
+		ctx, span := trace.Start(ctx, r.Method+" "+route, oteltrace.WithSpanKind(oteltrace.SpanKindServer),
+			oteltrace.WithAttributes(attribute.String("http.method", r.Method), attribute.String("http.route", route)))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			trace.SetError(span, errors.New(http.StatusText(rec.status)))
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/dehimb/cake/internal/store"
+)
+
+// Largest amount accepted in requests, 1 000 000 000.00
+const maxRequestAmount store.Money = 100000000000
+
+// Collects failed fields of request
+type fieldChecker struct {
+	details []FieldError
+}
+
+func (c *fieldChecker) fail(field, message string) {
+	c.details = append(c.details, FieldError{Field: field, Message: message})
+}
+
+func (c *fieldChecker) id(field string, value uint64) {
+	if value == 0 {
+		c.fail(field, "Must be positive")
+	}
+}
+
+// Amount must be within bounds, zero is allowed only when it is optional
+func (c *fieldChecker) amount(field string, value store.Money, optional bool) {
+	switch {
+	case value < 0 || value == 0 && !optional:
+		c.fail(field, "Must be positive")
+	case value > maxRequestAmount:
+		c.fail(field, fmt.Sprintf("Must not exceed %s", maxRequestAmount))
+	}
+}
+
+// Rules which hold for every route of the request type. Fields which are
+// required only by some routes, like ID of captured bet, are checked by store.
+func validateRequest(dst interface{}) []FieldError {
+	c := &fieldChecker{}
+	switch v := dst.(type) {
+	case *store.User:
+		c.id("id", v.ID)
+		c.amount("balance", v.Balance, true)
+	case *store.Deposit:
+		c.id("depositId", v.ID)
+		c.id("userId", v.UserID)
+		c.amount("amount", v.Amount, false)
+	case *store.Transaction:
+		c.id("transactionId", v.ID)
+		c.id("userId", v.UserID)
+		// rollback takes amount from the original bet
+		c.amount("amount", v.Amount, true)
+		switch v.Type {
+		case "", store.Bet, store.Win, store.Rollback:
+		default:
+			c.fail("type", "Must be Bet, Win or Rollback")
+		}
+	case *store.Withdrawal:
+		c.id("withdrawalId", v.ID)
+		// approval and rejection take only id
+		c.amount("amount", v.Amount, true)
+	case *store.Hold:
+		c.id("holdId", v.ID)
+		// ownership of session tokens is checked by userId, see checkToken
+		c.id("userId", v.UserID)
+		c.amount("amount", v.Amount, true)
+	case *store.Bonus:
+		c.id("bonusId", v.ID)
+		c.id("userId", v.UserID)
+		c.amount("amount", v.Amount, false)
+	case *LimitRequest:
+		c.id("userId", v.UserID)
+		c.amount("amount", v.Amount, true)
+	case *store.StatusChange:
+		c.id("userId", v.UserID)
+	}
+	return c.details
+}
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dehimb/cake/internal/trace"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Methods of StoreHandler. Failures caused by done ctx are reported as TimeoutError,
+// balance operations are counted and deposits and transactions are traced too.
+
+// Replace error caused by done ctx with TimeoutError
+func contextError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	var timeoutError *TimeoutError
+	if errors.As(err, &timeoutError) {
+		return err
+	}
+	if errors.Is(err, ctx.Err()) || isInterruptError(err) {
+		return &TimeoutError{Err: ctx.Err()}
+	}
+	return err
+}
+
+func (s *Store) GetUser(ctx context.Context, userID uint64) (*User, *Statistic, error) {
+	user, statistic, err := s.getUser(ctx, userID)
+	return user, statistic, contextError(ctx, err)
+}
+
+func (s *Store) CreateUser(ctx context.Context, user *User) error {
+	start := time.Now()
+	err := contextError(ctx, s.createUser(ctx, user))
+	observeOperation("user_create", start, err)
+	return err
+}
+
+func (s *Store) CreateDeposit(ctx context.Context, d *Deposit) (Money, error) {
+	start := time.Now()
+	ctx, span := trace.Start(ctx, "store.CreateDeposit")
+	defer span.End()
+	balance, err := s.createDeposit(ctx, d)
+	err = contextError(ctx, err)
+	trace.SetError(span, err)
+	observeOperation("deposit", start, err)
+	return balance, err
+}
+
+func (s *Store) CreateTransaction(ctx context.Context, t *Transaction) (Money, error) {
+	start := time.Now()
+	ctx, span := trace.Start(ctx, "store.CreateTransaction")
+	defer span.End()
+	span.SetAttributes(attribute.String("transaction.type", string(t.Type)))
+	balance, err := s.createTransaction(ctx, t)
+	err = contextError(ctx, err)
+	trace.SetError(span, err)
+	operation := "transaction"
+	switch t.Type {
+	case Bet, Win, Rollback:
+		operation = strings.ToLower(string(t.Type))
+	}
+	observeOperation(operation, start, err)
+	return balance, err
+}
+
+func (s *Store) GetHistory(ctx context.Context, q *HistoryQuery) ([]LedgerEntry, string, error) {
+	entries, cursor, err := s.getHistory(ctx, q)
+	return entries, cursor, contextError(ctx, err)
+}
+
+func (s *Store) CreateWithdrawal(ctx context.Context, w *Withdrawal) (Money, error) {
+	start := time.Now()
+	balance, err := s.createWithdrawal(ctx, w)
+	err = contextError(ctx, err)
+	observeOperation("withdrawal", start, err)
+	return balance, err
+}
+
+func (s *Store) ApproveWithdrawal(ctx context.Context, id uint64, operator string) (*Withdrawal, error) {
+	start := time.Now()
+	w, err := s.approveWithdrawal(ctx, id, operator)
+	err = contextError(ctx, err)
+	observeOperation("withdrawal_approve", start, err)
+	return w, err
+}
+
+func (s *Store) RejectWithdrawal(ctx context.Context, id uint64, operator string) (*Withdrawal, error) {
+	start := time.Now()
+	w, err := s.rejectWithdrawal(ctx, id, operator)
+	err = contextError(ctx, err)
+	observeOperation("withdrawal_reject", start, err)
+	return w, err
+}
+
+func (s *Store) AuthorizeHold(ctx context.Context, h *Hold) (Money, error) {
+	start := time.Now()
+	available, err := s.authorizeHold(ctx, h)
+	err = contextError(ctx, err)
+	observeOperation("hold_authorize", start, err)
+	return available, err
+}
+
+func (s *Store) CaptureHold(ctx context.Context, h *Hold) (Money, error) {
+	start := time.Now()
+	balance, err := s.captureHold(ctx, h)
+	err = contextError(ctx, err)
+	observeOperation("hold_capture", start, err)
+	return balance, err
+}
+
+func (s *Store) ReleaseHold(ctx context.Context, h *Hold) (Money, error) {
+	start := time.Now()
+	available, err := s.releaseHold(ctx, h)
+	err = contextError(ctx, err)
+	observeOperation("hold_release", start, err)
+	return available, err
+}
+
+func (s *Store) GrantBonus(ctx context.Context, b *Bonus) (Money, error) {
+	start := time.Now()
+	balance, err := s.grantBonus(ctx, b)
+	err = contextError(ctx, err)
+	observeOperation("bonus_grant", start, err)
+	return balance, err
+}
+
+func (s *Store) GetLimits(ctx context.Context, userID uint64) ([]Limit, error) {
+	limits, err := s.getLimits(ctx, userID)
+	return limits, contextError(ctx, err)
+}
+
+func (s *Store) SetLimit(ctx context.Context, l *Limit) (*Limit, error) {
+	limit, err := s.setLimit(ctx, l)
+	return limit, contextError(ctx, err)
+}
+
+func (s *Store) SetAccountStatus(ctx context.Context, c *StatusChange) (*User, error) {
+	user, err := s.setAccountStatus(ctx, c)
+	return user, contextError(ctx, err)
+}
+
+func (s *Store) CreateSession(ctx context.Context, userID uint64) (*Session, error) {
+	session, err := s.createSession(ctx, userID)
+	return session, contextError(ctx, err)
+}
+
+func (s *Store) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	p, err := s.authenticate(ctx, token)
+	return p, contextError(ctx, err)
+}
+
+func (s *Store) RefreshSession(ctx context.Context, p *Principal) (*Session, error) {
+	session, err := s.refreshSession(ctx, p)
+	return session, contextError(ctx, err)
+}
+
+func (s *Store) RevokeSession(ctx context.Context, p *Principal) error {
+	return contextError(ctx, s.revokeSession(ctx, p))
+}
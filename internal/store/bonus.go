@@ -0,0 +1,302 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Bonus wallet is kept separately from cash balance and can be spent only on bets.
+// Every grant increases wagering requirement by amount multiplied by Config.BonusWagering.
+// All bets decrease wagering requirement, when it is met the whole bonus converts to cash.
+// While wagering requirement is not met wins are credited to bonus wallet, including
+// wins of bets paid from cash: wins are not linked to bets, so the whole balance
+// played during wagering is treated as bonus funds.
+// Bonus which is not converted until Config.BonusTTL after the last grant expires.
+
+// BonusBetOrder defines which wallet pays for the bet first
+type BonusBetOrder string
+
+const (
+	CashFirst  BonusBetOrder = "cash-first"
+	BonusFirst BonusBetOrder = "bonus-first"
+)
+
+const (
+	DefaultBonusWagering = 30
+	DefaultBonusTTL      = 30 * 24 * time.Hour
+)
+
+func ParseBonusBetOrder(order string) (BonusBetOrder, error) {
+	switch BonusBetOrder(order) {
+	case CashFirst, BonusFirst:
+		return BonusBetOrder(order), nil
+	}
+	return "", fmt.Errorf("Unknown bonus bet order: %s", order)
+}
+
+// Row of bonusTransactions table
+type bonusRow struct {
+	Type          BonusTransactionType
+	ReferenceID   uint64
+	Amount        Money
+	BonusBefore   Money
+	BonusAfter    Money
+	WageringAfter Money
+	// cash balance is changed only by conversion
+	BalanceBefore Money
+	BalanceAfter  Money
+}
+
+// Changes of bonus wallet made by one operation under user lock.
+// Methods change balance state and collect bonus ledger rows,
+// rows are written with writeBonusRows in the same db transaction.
+type bonusWallet struct {
+	state *balanceState
+	rows  []bonusRow
+	now   time.Time
+}
+
+// Start bonus wallet changes, expired bonus is forfeited first
+func newBonusWallet(state *balanceState) *bonusWallet {
+	b := &bonusWallet{state: state, now: time.Now()}
+	b.expire()
+	return b
+}
+
+func (b *bonusWallet) active() bool {
+	return b.state.Bonus > 0 || b.state.WageringLeft > 0
+}
+
+func (b *bonusWallet) add(rowType BonusTransactionType, referenceID uint64, amount Money, delta Money) {
+	row := bonusRow{Type: rowType, ReferenceID: referenceID, Amount: amount, BonusBefore: b.state.Bonus}
+	b.state.Bonus += delta
+	row.BonusAfter = b.state.Bonus
+	row.WageringAfter = b.state.WageringLeft
+	b.rows = append(b.rows, row)
+}
+
+func (b *bonusWallet) expire() {
+	if !b.active() || b.state.BonusExpiresAt.IsZero() || b.now.Before(b.state.BonusExpiresAt) {
+		return
+	}
+	b.state.WageringLeft = 0
+	b.state.BonusExpiresAt = time.Time{}
+	b.add(BonusExpiry, 0, b.state.Bonus, -b.state.Bonus)
+}
+
+func (b *bonusWallet) grant(referenceID uint64, amount Money, wagering int, ttl time.Duration) {
+	b.state.WageringLeft += amount * Money(wagering)
+	b.state.BonusExpiresAt = b.now.Add(ttl)
+	b.add(BonusGrant, referenceID, amount, amount)
+	b.convert(referenceID)
+}
+
+// Register bet of amount, bonusPart of which was paid from bonus wallet
+func (b *bonusWallet) bet(referenceID uint64, bonusPart Money, amount Money) {
+	if !b.active() {
+		return
+	}
+	b.state.WageringLeft -= amount
+	if b.state.WageringLeft < 0 {
+		b.state.WageringLeft = 0
+	}
+	b.add(BonusBet, referenceID, bonusPart, -bonusPart)
+	b.convert(referenceID)
+}
+
+// Credit the whole win to bonus wallet while wagering is not met, regardless of
+// how the bet was paid, return credited part
+func (b *bonusWallet) win(referenceID uint64, amount Money) Money {
+	if b.state.WageringLeft == 0 {
+		return 0
+	}
+	b.add(BonusWin, referenceID, amount, amount)
+	return amount
+}
+
+// Return bonus part of rolled back bet, the bet no longer counts for wagering.
+// Wallet which expired or converted since the bet doesn't take it back,
+// returned part is forfeited instead of converting to cash.
+func (b *bonusWallet) rollback(referenceID uint64, bonusPart Money, amount Money) {
+	if !b.active() {
+		if bonusPart > 0 {
+			b.add(BonusRollback, referenceID, bonusPart, bonusPart)
+			b.add(BonusExpiry, referenceID, bonusPart, -bonusPart)
+		}
+		return
+	}
+	b.state.WageringLeft += amount
+	b.add(BonusRollback, referenceID, bonusPart, bonusPart)
+	b.convert(referenceID)
+}
+
+func (b *bonusWallet) convert(referenceID uint64) {
+	if b.state.WageringLeft > 0 || b.state.Bonus <= 0 {
+		return
+	}
+	amount := b.state.Bonus
+	b.rows = append(b.rows, bonusRow{
+		Type:          BonusConversion,
+		ReferenceID:   referenceID,
+		Amount:        amount,
+		BonusBefore:   amount,
+		BalanceBefore: b.state.Balance,
+		BalanceAfter:  b.state.Balance + amount,
+	})
+	b.state.Balance += amount
+	b.state.Bonus = 0
+	b.state.BonusExpiresAt = time.Time{}
+}
+
+// Split bet between cash and bonus wallets according to Config.BonusBetOrder
+func (s *Store) splitBet(user *User, state *balanceState, amount Money) (cashPart Money, bonusPart Money, ok bool) {
+	cash := state.Balance - user.Reserved
+	if cash+state.Bonus < amount {
+		return 0, 0, false
+	}
+	if s.config.BonusBetOrder == BonusFirst {
+		bonusPart = minMoney(amount, state.Bonus)
+		return amount - bonusPart, bonusPart, true
+	}
+	cashPart = minMoney(amount, cash)
+	return cashPart, amount - cashPart, true
+}
+
+func minMoney(a, b Money) Money {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (s *Store) writeBonusRows(ctx context.Context, tx execer, userID uint64, operator string, rows []bonusRow) error {
+	date := time.Now().Unix()
+	for _, row := range rows {
+		var balanceBefore, balanceAfter interface{}
+		if row.Type == BonusConversion {
+			balanceBefore, balanceAfter = row.BalanceBefore, row.BalanceAfter
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO bonusTransactions(userId, type, referenceId, amount, bonusBefore, bonusAfter, wageringAfter,
+			balanceBefore, balanceAfter, date, seq, operator) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			userID, row.Type, row.ReferenceID, row.Amount, row.BonusBefore, row.BonusAfter, row.WageringAfter,
+			balanceBefore, balanceAfter, date, s.nextSeq(), operatorColumn(operator))
+		if err != nil {
+			return &TransactionError{Err: err}
+		}
+	}
+	return nil
+}
+
+// Add bonus wallet totals of rows to statistic
+func (statistic *Statistic) addBonusRows(rows []bonusRow) {
+	for _, row := range rows {
+		switch row.Type {
+		case BonusGrant:
+			statistic.BonusGrantedSum += row.Amount
+		case BonusConversion:
+			statistic.BonusConvertedSum += row.Amount
+		case BonusExpiry:
+			statistic.BonusExpiredSum += row.Amount
+		}
+	}
+}
+
+// Credit bonus wallet and return new bonus balance
+func (s *Store) grantBonus(ctx context.Context, b *Bonus) (Money, error) {
+	if b.Amount <= 0 {
+		return 0, &ValidationError{Err: errors.New("Bonus amount must be greater than zero"), Field: "amount"}
+	}
+	user, ok := s.users.get(b.UserID)
+	if !ok {
+		return 0, &NotFoundError{Err: errors.New("User not found"), Code: CodeUserNotFound}
+	}
+	if err := s.checkBonusReplay(ctx, b); err != nil {
+		return 0, err
+	}
+	if err := lockUser(ctx, user); err != nil {
+		return 0, err
+	}
+	defer user.Unlock()
+	if err := user.checkStatus(operationBonus); err != nil {
+		return 0, err
+	}
+	state := user.state()
+	wallet := newBonusWallet(&state)
+	wallet.grant(b.ID, b.Amount, s.config.BonusWagering, s.config.BonusTTL)
+	err := s.persist(ctx, user, state, func(tx execer) error {
+		return s.writeBonusRows(ctx, tx, user.ID, b.Operator, wallet.rows)
+	})
+	if err != nil {
+		if isConstraintError(err) {
+			if replayErr := s.checkBonusReplay(ctx, b); replayErr != nil {
+				return 0, replayErr
+			}
+		}
+		return 0, err
+	}
+	user.statistic.addBonusRows(wallet.rows)
+	return user.Bonus, nil
+}
+
+// Forfeit bonus wallets which were not converted in time, called by ticker
+func (s *Store) expireBonuses() {
+	ctx := context.Background()
+	now := time.Now()
+	for _, user := range s.users.all() {
+		user.Lock()
+		state := user.state()
+		if state.BonusExpiresAt.IsZero() || now.Before(state.BonusExpiresAt) {
+			user.Unlock()
+			continue
+		}
+		wallet := newBonusWallet(&state)
+		if len(wallet.rows) > 0 {
+			err := s.persist(ctx, user, state, func(tx execer) error {
+				return s.writeBonusRows(ctx, tx, user.ID, "", wallet.rows)
+			})
+			if err != nil {
+				s.logger.Errorf("Can't expire bonus of user %d: %s", user.ID, err)
+			} else {
+				user.statistic.addBonusRows(wallet.rows)
+				s.logger.Info("Bonus expired for user: ", user.ID)
+			}
+		}
+		user.Unlock()
+	}
+}
+
+func (s *Store) checkBonusReplay(ctx context.Context, b *Bonus) error {
+	var userID uint64
+	var amount, bonusAfter Money
+	err := s.db.QueryRowContext(ctx, "SELECT userId, amount, bonusAfter FROM bonusTransactions WHERE type = ? AND referenceId = ?", BonusGrant, b.ID).
+		Scan(&userID, &amount, &bonusAfter)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return &InternalError{Message: "Error when checking bonus replay", Err: err}
+	}
+	if userID != b.UserID || amount != b.Amount {
+		return &ConflictError{Err: errors.New("Bonus id already used with different payload")}
+	}
+	return &DuplicateError{Balance: bonusAfter}
+}
+
+func (s *Store) loadBonusStatistic(statistic *Statistic) error {
+	rows, err := s.db.Query("SELECT type, SUM(amount) FROM bonusTransactions WHERE userId = ? GROUP BY type", statistic.UserID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row bonusRow
+		if err = rows.Scan(&row.Type, &row.Amount); err != nil {
+			return err
+		}
+		statistic.addBonusRows([]bonusRow{row})
+	}
+	return rows.Err()
+}
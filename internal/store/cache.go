@@ -0,0 +1,74 @@
+package store
+
+import "sync"
+
+// Users are spread over shards by ID, so lookups of different users rarely wait
+// for each other. Shard lock protects only the map, fields of user are protected
+// by user lock.
+const cacheShards = 32
+
+type cacheShard struct {
+	sync.RWMutex
+	users map[uint64]*User
+}
+
+type userCache struct {
+	shards [cacheShards]cacheShard
+}
+
+func newUserCache() *userCache {
+	c := &userCache{}
+	for i := range c.shards {
+		c.shards[i].users = make(map[uint64]*User)
+	}
+	return c
+}
+
+func (c *userCache) shard(userID uint64) *cacheShard {
+	return &c.shards[userID%cacheShards]
+}
+
+func (c *userCache) get(userID uint64) (*User, bool) {
+	shard := c.shard(userID)
+	shard.RLock()
+	defer shard.RUnlock()
+	user, ok := shard.users[userID]
+	return user, ok
+}
+
+// Add user unless user with the same ID is cached already
+func (c *userCache) add(user *User) bool {
+	shard := c.shard(user.ID)
+	shard.Lock()
+	defer shard.Unlock()
+	if _, ok := shard.users[user.ID]; ok {
+		return false
+	}
+	shard.users[user.ID] = user
+	return true
+}
+
+// Users cached at the moment of call, users added later may be missed
+func (c *userCache) all() []*User {
+	var users []*User
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.RLock()
+		for _, user := range shard.users {
+			users = append(users, user)
+		}
+		shard.RUnlock()
+	}
+	return users
+}
+
+func (c *userCache) len() int {
+	n := 0
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.RLock()
+		n += len(shard.users)
+		shard.RUnlock()
+	}
+	return n
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+// Stable machine-readable code of failure, clients must rely on it
+// instead of error message. Codes are never renamed or reused.
+type ErrorCode string
+
+const (
+	// ValidationError, 400
+	CodeInvalidField      ErrorCode = "INVALID_FIELD"
+	CodeInsufficientFunds ErrorCode = "INSUFFICIENT_FUNDS"
+	CodeUserExists        ErrorCode = "USER_ALREADY_EXISTS"
+	CodeOperatorExists    ErrorCode = "OPERATOR_ALREADY_EXISTS"
+	CodeNotRollbackable   ErrorCode = "TRANSACTION_NOT_ROLLBACKABLE"
+	CodeSessionRequired   ErrorCode = "SESSION_REQUIRED"
+	CodeStatusNotAllowed  ErrorCode = "STATUS_NOT_ALLOWED"
+	// TransactionError, 400
+	CodeDuplicateTransaction ErrorCode = "DUPLICATE_TRANSACTION"
+	CodeTransactionFailed    ErrorCode = "TRANSACTION_FAILED"
+	// NotFoundError, 404
+	CodeNotFound            ErrorCode = "NOT_FOUND"
+	CodeUserNotFound        ErrorCode = "USER_NOT_FOUND"
+	CodeTransactionNotFound ErrorCode = "TRANSACTION_NOT_FOUND"
+	CodeHoldNotFound        ErrorCode = "HOLD_NOT_FOUND"
+	CodeWithdrawalNotFound  ErrorCode = "WITHDRAWAL_NOT_FOUND"
+	CodeOperatorNotFound    ErrorCode = "OPERATOR_NOT_FOUND"
+	CodeAPIKeyNotFound      ErrorCode = "API_KEY_NOT_FOUND"
+	// DuplicateError, 208
+	CodeAlreadyProcessed ErrorCode = "ALREADY_PROCESSED"
+	// ConflictError, RolledBackError and StateError, 409
+	CodeIdempotencyConflict ErrorCode = "IDEMPOTENCY_CONFLICT"
+	CodeAlreadyRolledBack   ErrorCode = "ALREADY_ROLLED_BACK"
+	CodeInvalidState        ErrorCode = "INVALID_STATE"
+	CodeHoldExpired         ErrorCode = "HOLD_EXPIRED"
+	CodeWithdrawalResolved  ErrorCode = "WITHDRAWAL_ALREADY_RESOLVED"
+	// LimitError and account status errors, 403
+	CodeLimitExceeded ErrorCode = "LIMIT_EXCEEDED"
+	CodeAccountFrozen ErrorCode = "ACCOUNT_FROZEN"
+	CodeSelfExcluded  ErrorCode = "SELF_EXCLUDED"
+	CodeAccountClosed ErrorCode = "ACCOUNT_CLOSED"
+	// AuthenticationError, 401
+	CodeUnauthenticated ErrorCode = "UNAUTHENTICATED"
+	CodeTokenExpired    ErrorCode = "TOKEN_EXPIRED"
+	// TimeoutError, 504 when deadline exceeded and 503 when request is cancelled
+	CodeTimeout   ErrorCode = "TIMEOUT"
+	CodeCancelled ErrorCode = "CANCELLED"
+	// InternalError and unknown errors, 500
+	CodeInternal ErrorCode = "INTERNAL_ERROR"
+
+	// Codes of failures detected by server before request reaches store
+	CodeInvalidRequest  ErrorCode = "INVALID_REQUEST"
+	CodeForbidden       ErrorCode = "FORBIDDEN"
+	CodeRateLimited     ErrorCode = "RATE_LIMITED"
+	CodeTooManyInFlight ErrorCode = "TOO_MANY_IN_FLIGHT"
+	// Content-Type of body is not application/json
+	CodeUnsupportedMediaType ErrorCode = "UNSUPPORTED_MEDIA_TYPE"
+	CodeRequestTooLarge      ErrorCode = "REQUEST_TOO_LARGE"
+)
+
+// Code of error returned by store, CodeInternal for unknown errors
+func CodeOf(err error) ErrorCode {
+	var coded interface{ ErrorCode() ErrorCode }
+	if errors.As(err, &coded) {
+		return coded.ErrorCode()
+	}
+	return CodeInternal
+}
+
+func (e *ValidationError) ErrorCode() ErrorCode {
+	if e.Code == "" {
+		return CodeInvalidField
+	}
+	return e.Code
+}
+
+func (e *NotFoundError) ErrorCode() ErrorCode {
+	if e.Code == "" {
+		return CodeNotFound
+	}
+	return e.Code
+}
+
+// Unique constraint fails when the same id is used concurrently or by another kind of operation
+func (e *TransactionError) ErrorCode() ErrorCode {
+	if isConstraintError(e.Err) {
+		return CodeDuplicateTransaction
+	}
+	return CodeTransactionFailed
+}
+
+func (e *StateError) ErrorCode() ErrorCode {
+	if e.Code == "" {
+		return CodeInvalidState
+	}
+	return e.Code
+}
+
+func (e *AuthenticationError) ErrorCode() ErrorCode {
+	if e.Code == "" {
+		return CodeUnauthenticated
+	}
+	return e.Code
+}
+
+func (e *TimeoutError) ErrorCode() ErrorCode {
+	if e.Err == context.Canceled {
+		return CodeCancelled
+	}
+	return CodeTimeout
+}
+
+func (e *InternalError) ErrorCode() ErrorCode      { return CodeInternal }
+func (e *DuplicateError) ErrorCode() ErrorCode     { return CodeAlreadyProcessed }
+func (e *ConflictError) ErrorCode() ErrorCode      { return CodeIdempotencyConflict }
+func (e *RolledBackError) ErrorCode() ErrorCode    { return CodeAlreadyRolledBack }
+func (e *LimitError) ErrorCode() ErrorCode         { return CodeLimitExceeded }
+func (e *AccountFrozenError) ErrorCode() ErrorCode { return CodeAccountFrozen }
+func (e *SelfExcludedError) ErrorCode() ErrorCode  { return CodeSelfExcluded }
+func (e *AccountClosedError) ErrorCode() ErrorCode { return CodeAccountClosed }
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Flush is considered stale when it didn't succeed for this number of intervals
+const staleFlushIntervals = 3
+
+// Result of one readiness check
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func newHealthCheck(name string, err error) HealthCheck {
+	check := HealthCheck{Name: name, OK: err == nil}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// State of the store which can't be seen from db
+type health struct {
+	sync.Mutex
+	cacheLoaded bool
+	// Time of the last flush without errors, store start before the first flush
+	lastFlush    time.Time
+	lastFlushErr error
+}
+
+func (h *health) setCacheLoaded() {
+	h.Lock()
+	defer h.Unlock()
+	h.cacheLoaded = true
+	h.lastFlush = time.Now()
+}
+
+func (h *health) flushed(err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.lastFlushErr = err
+	if err == nil {
+		h.lastFlush = time.Now()
+	}
+}
+
+// Check database connection, cache and write-behind flush.
+// Database ping is limited by ctx.
+func (s *Store) CheckHealth(ctx context.Context) []HealthCheck {
+	s.health.Lock()
+	cacheLoaded, lastFlush, lastFlushErr := s.health.cacheLoaded, s.health.lastFlush, s.health.lastFlushErr
+	s.health.Unlock()
+
+	checks := []HealthCheck{newHealthCheck("database", s.db.PingContext(ctx))}
+	var err error
+	if !cacheLoaded {
+		err = errors.New("Cache is not loaded")
+	}
+	checks = append(checks, newHealthCheck("cache", err))
+	err = nil
+	if age := time.Since(lastFlush); cacheLoaded && age > staleFlushIntervals*s.config.FlushInterval {
+		err = fmt.Errorf("Last successful flush was %s ago", age.Round(time.Second))
+		if lastFlushErr != nil {
+			err = fmt.Errorf("%s: %s", err, lastFlushErr)
+		}
+	}
+	return append(checks, newHealthCheck("flush", err))
+}
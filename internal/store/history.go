@@ -0,0 +1,145 @@
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 500
+)
+
+// Balance changes of all users from all ledger tables in one list.
+// Rejected withdrawal produces two entries: reservation and return of funds.
+// Bonus wallet rows are included only when bonus converts to cash.
+const ledgerEntries = `
+	SELECT userId, seq, id, 'Deposit' AS type, amount, 0 AS referenceId, 0 AS rolledBack, balanceBefore, balanceAfter, date, operator
+	FROM deposits
+	UNION ALL
+	SELECT userId, seq, id, type, amount, COALESCE(referenceId, 0), rolledBack, balanceBefore, balanceAfter, date, operator
+	FROM transactions
+	UNION ALL
+	SELECT userId, seq, id, 'Withdrawal', amount, 0, 0, balanceBefore, balanceAfter, date, operator
+	FROM withdrawals
+	UNION ALL
+	SELECT userId, resolvedSeq, id, 'WithdrawalReturn', amount, 0, 0, resolvedBalanceBefore, resolvedBalanceAfter, resolvedDate, resolvedOperator
+	FROM withdrawals WHERE status = 'rejected'
+	UNION ALL
+	SELECT userId, seq, referenceId, 'BonusConversion', amount, 0, 0, balanceBefore, balanceAfter, date, operator
+	FROM bonusTransactions WHERE type = 'Conversion'`
+
+// Return user ledger entries from newest to oldest and cursor for the next page.
+// Cursor is empty when there are no more entries.
+func (s *Store) getHistory(ctx context.Context, q *HistoryQuery) ([]LedgerEntry, string, error) {
+	if _, ok := s.users.get(q.UserID); !ok {
+		return nil, "", &NotFoundError{Err: errors.New("User not found"), Code: CodeUserNotFound}
+	}
+	limit := q.Limit
+	if limit == 0 {
+		limit = DefaultHistoryLimit
+	}
+	if limit < 0 || limit > MaxHistoryLimit {
+		return nil, "", &ValidationError{Err: errors.New("Limit must be between 1 and " + strconv.Itoa(MaxHistoryLimit)), Field: "limit"}
+	}
+	if q.MinAmount < 0 || q.MaxAmount < 0 || (q.MaxAmount > 0 && q.MinAmount > q.MaxAmount) {
+		return nil, "", &ValidationError{Err: errors.New("Invalid amount range"), Field: "minAmount"}
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && q.From.After(q.To) {
+		return nil, "", &ValidationError{Err: errors.New("Invalid date range"), Field: "from"}
+	}
+
+	conditions := []string{"userId = ?"}
+	args := []interface{}{q.UserID}
+	if q.Cursor != "" {
+		seq, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, "", &ValidationError{Err: err, Field: "cursor"}
+		}
+		conditions = append(conditions, "seq < ?")
+		args = append(args, seq)
+	}
+	if len(q.Types) > 0 {
+		placeholders := make([]string, len(q.Types))
+		for i, t := range q.Types {
+			switch t {
+			case DepositType, Bet, Win, Rollback, WithdrawalType, WithdrawalReturnType, BonusConversionType:
+			default:
+				return nil, "", &ValidationError{Err: errors.New("Invalid transaction type"), Field: "type"}
+			}
+			placeholders[i] = "?"
+			args = append(args, t)
+		}
+		conditions = append(conditions, "type IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if !q.From.IsZero() {
+		conditions = append(conditions, "date >= ?")
+		args = append(args, q.From.Unix())
+	}
+	if !q.To.IsZero() {
+		conditions = append(conditions, "date <= ?")
+		args = append(args, q.To.Unix())
+	}
+	if q.MinAmount > 0 {
+		conditions = append(conditions, "amount >= ?")
+		args = append(args, q.MinAmount)
+	}
+	if q.MaxAmount > 0 {
+		conditions = append(conditions, "amount <= ?")
+		args = append(args, q.MaxAmount)
+	}
+	// one extra row tells if there is next page
+	args = append(args, limit+1)
+
+	rows, err := s.db.QueryContext(ctx, "SELECT seq, id, type, amount, referenceId, rolledBack, balanceBefore, balanceAfter, date, COALESCE(operator, '') FROM ("+
+		ledgerEntries+") WHERE "+strings.Join(conditions, " AND ")+" ORDER BY seq DESC LIMIT ?", args...)
+	if err != nil {
+		return nil, "", &InternalError{Message: "Error when reading history", Err: err}
+	}
+	defer rows.Close()
+	entries := make([]LedgerEntry, 0, limit)
+	var lastSeq int64
+	hasMore := false
+	for rows.Next() {
+		if len(entries) == limit {
+			hasMore = true
+			break
+		}
+		var e LedgerEntry
+		var date int64
+		err = rows.Scan(&lastSeq, &e.ID, &e.Type, &e.Amount, &e.ReferenceID, &e.RolledBack, &e.BalanceBefore, &e.BalanceAfter, &date, &e.Operator)
+		if err != nil {
+			return nil, "", &InternalError{Message: "Error when reading history", Err: err}
+		}
+		e.Date = time.Unix(date, 0).UTC()
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", &InternalError{Message: "Error when reading history", Err: err}
+	}
+	if !hasMore {
+		return entries, "", nil
+	}
+	return entries, encodeCursor(lastSeq), nil
+}
+
+// Cursor is opaque for clients, it keeps sequence number of the last returned entry
+func encodeCursor(seq int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(seq, 10)))
+}
+
+func decodeCursor(cursor string) (int64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errors.New("Invalid cursor")
+	}
+	seq, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil || seq <= 0 {
+		return 0, errors.New("Invalid cursor")
+	}
+	return seq, nil
+}
@@ -0,0 +1,250 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const DefaultHoldTTL = 15 * time.Minute
+
+// Hold reserves funds before the outcome of the game is known.
+// Authorized hold reduces available balance, but not total balance.
+// Capture turns hold into bet transaction, release returns funds to available balance.
+// Holds which are neither captured nor released expire after Config.HoldTTL.
+
+// Authorize hold and return available balance
+func (s *Store) authorizeHold(ctx context.Context, h *Hold) (Money, error) {
+	if h.Amount <= 0 {
+		return 0, &ValidationError{Err: errors.New("Hold amount must be greater than zero"), Field: "amount"}
+	}
+	user, ok := s.users.get(h.UserID)
+	if !ok {
+		return 0, &NotFoundError{Err: errors.New("User not found"), Code: CodeUserNotFound}
+	}
+	if err := s.checkHoldReplay(ctx, h); err != nil {
+		return 0, err
+	}
+	if err := lockUser(ctx, user); err != nil {
+		return 0, err
+	}
+	defer user.Unlock()
+	if err := user.checkStatus(operationBet); err != nil {
+		return 0, err
+	}
+	available := user.Available() - h.Amount
+	if available < 0 {
+		return 0, &ValidationError{Err: errors.New("User doesn't have anough funds"), Code: CodeInsufficientFunds}
+	}
+	// captured hold becomes bet, so limits are checked on authorization
+	if err := s.checkLimits(ctx, user.ID, Bet, h.Amount); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	h.ExpiresAt = now.Add(s.config.HoldTTL)
+	_, err := s.db.ExecContext(ctx, "INSERT INTO holds(id, userId, amount, status, availableAfter, date, expiresAt, operator) values(?, ?, ?, ?, ?, ?, ?, ?)",
+		h.ID, h.UserID, h.Amount, HoldAuthorized, available, now.Unix(), h.ExpiresAt.Unix(), operatorColumn(h.Operator))
+	if err != nil {
+		if isConstraintError(err) {
+			if replayErr := s.checkHoldReplay(ctx, h); replayErr != nil {
+				return 0, replayErr
+			}
+		}
+		return 0, &TransactionError{Err: err}
+	}
+	h.Status = HoldAuthorized
+	user.Reserved += h.Amount
+	return available, nil
+}
+
+// Turn authorized hold into bet transaction with h.TransactionID and return new balance
+func (s *Store) captureHold(ctx context.Context, h *Hold) (Money, error) {
+	if h.TransactionID == 0 {
+		return 0, &ValidationError{Err: errors.New("Transaction id is required"), Field: "transactionId"}
+	}
+	hold, user, err := s.lockHold(ctx, h)
+	if err != nil {
+		return 0, err
+	}
+	defer user.Unlock()
+	switch {
+	case hold.Status == HoldCaptured && hold.TransactionID == h.TransactionID:
+		var balanceAfter Money
+		if err = s.db.QueryRowContext(ctx, "SELECT balanceAfter FROM transactions WHERE id = ?", h.TransactionID).Scan(&balanceAfter); err != nil {
+			return 0, &InternalError{Message: "Error when reading captured transaction", Err: err}
+		}
+		return 0, &DuplicateError{Balance: balanceAfter}
+	case hold.Status != HoldAuthorized:
+		return 0, &StateError{Err: errors.New("Hold is " + string(hold.Status))}
+	case time.Now().After(hold.ExpiresAt):
+		// ticker didn't release it yet
+		return 0, &StateError{Err: errors.New("Hold is " + string(HoldExpired)), Code: CodeHoldExpired}
+	}
+	t := &Transaction{ID: h.TransactionID, UserID: hold.UserID, Type: Bet, Amount: hold.Amount, Operator: h.Operator}
+	if err = s.checkTransactionReplay(ctx, t); err != nil {
+		return 0, err
+	}
+	// holds reserve cash only, but captured bet still counts for bonus wagering
+	next := user.state()
+	wallet := newBonusWallet(&next)
+	oldBalance := next.Balance
+	newBalance := oldBalance - hold.Amount
+	next.Balance = newBalance
+	wallet.bet(t.ID, 0, t.Amount)
+	err = s.persist(ctx, user, next, func(tx execer) error {
+		now := time.Now().Unix()
+		_, err := tx.ExecContext(ctx, "INSERT INTO transactions(id, userId, type, amount, balanceBefore, balanceAfter, date, seq, operator) values(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			t.ID, t.UserID, t.Type, t.Amount, oldBalance, newBalance, now, s.nextSeq(), operatorColumn(t.Operator))
+		if err != nil {
+			return &TransactionError{Err: err}
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE holds SET status = ?, transactionId = ?, resolvedDate = ?, resolvedOperator = ? WHERE id = ?",
+			HoldCaptured, t.ID, now, operatorColumn(t.Operator), hold.ID)
+		if err != nil {
+			return &TransactionError{Err: err}
+		}
+		return s.writeBonusRows(ctx, tx, user.ID, t.Operator, wallet.rows)
+	})
+	if err != nil {
+		return 0, err
+	}
+	user.Reserved -= hold.Amount
+	statistic := user.statistic
+	statistic.BetCount += 1
+	statistic.BetSum += hold.Amount
+	statistic.addBonusRows(wallet.rows)
+	h.Status = HoldCaptured
+	return user.Balance, nil
+}
+
+// Release authorized hold and return available balance.
+// Releasing already released hold has no effect.
+func (s *Store) releaseHold(ctx context.Context, h *Hold) (Money, error) {
+	hold, user, err := s.lockHold(ctx, h)
+	if err != nil {
+		return 0, err
+	}
+	defer user.Unlock()
+	switch hold.Status {
+	case HoldReleased:
+		return user.Available(), nil
+	case HoldAuthorized:
+	default:
+		return 0, &StateError{Err: errors.New("Hold is " + string(hold.Status))}
+	}
+	_, err = s.db.ExecContext(ctx, "UPDATE holds SET status = ?, resolvedDate = ?, resolvedOperator = ? WHERE id = ?",
+		HoldReleased, time.Now().Unix(), operatorColumn(h.Operator), hold.ID)
+	if err != nil {
+		return 0, &TransactionError{Err: err}
+	}
+	user.Reserved -= hold.Amount
+	h.Status = HoldReleased
+	return user.Available(), nil
+}
+
+// Release holds which were not captured in time, called by ticker
+func (s *Store) expireHolds() {
+	rows, err := s.db.Query("SELECT id, userId FROM holds WHERE status = ? AND expiresAt <= ?", HoldAuthorized, time.Now().Unix())
+	if err != nil {
+		s.logger.Error("Can't read expired holds: ", err)
+		return
+	}
+	var expired []*Hold
+	for rows.Next() {
+		h := &Hold{}
+		if err = rows.Scan(&h.ID, &h.UserID); err != nil {
+			s.logger.Error("Can't read expired holds: ", err)
+			break
+		}
+		expired = append(expired, h)
+	}
+	rows.Close()
+	for _, h := range expired {
+		hold, user, err := s.lockHold(context.Background(), h)
+		if err != nil {
+			s.logger.Errorf("Can't expire hold %d: %s", h.ID, err)
+			continue
+		}
+		// hold could be captured or released after it was selected
+		if hold.Status == HoldAuthorized {
+			_, err = s.db.Exec("UPDATE holds SET status = ?, resolvedDate = ? WHERE id = ?", HoldExpired, time.Now().Unix(), hold.ID)
+			if err != nil {
+				s.logger.Errorf("Can't expire hold %d: %s", h.ID, err)
+			} else {
+				user.Reserved -= hold.Amount
+				s.logger.Info("Hold expired: ", hold.ID)
+			}
+		}
+		user.Unlock()
+	}
+}
+
+// Read hold and lock its user. Status is read under the lock.
+// Hold must belong to h.UserID.
+func (s *Store) lockHold(ctx context.Context, h *Hold) (*Hold, *User, error) {
+	hold, err := s.readHold(ctx, h.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hold.UserID != h.UserID {
+		return nil, nil, &NotFoundError{Err: errors.New("Hold not found"), Code: CodeHoldNotFound}
+	}
+	user, ok := s.users.get(hold.UserID)
+	if !ok {
+		return nil, nil, &NotFoundError{Err: errors.New("User not found"), Code: CodeUserNotFound}
+	}
+	if err = lockUser(ctx, user); err != nil {
+		return nil, nil, err
+	}
+	if hold, err = s.readHold(ctx, h.ID); err != nil {
+		user.Unlock()
+		return nil, nil, err
+	}
+	return hold, user, nil
+}
+
+func (s *Store) readHold(ctx context.Context, id uint64) (*Hold, error) {
+	h := &Hold{ID: id}
+	var expiresAt int64
+	var transactionID sql.NullInt64
+	err := s.db.QueryRowContext(ctx, "SELECT userId, amount, status, expiresAt, transactionId FROM holds WHERE id = ?", id).
+		Scan(&h.UserID, &h.Amount, &h.Status, &expiresAt, &transactionID)
+	if err == sql.ErrNoRows {
+		return nil, &NotFoundError{Err: errors.New("Hold not found"), Code: CodeHoldNotFound}
+	}
+	if err != nil {
+		return nil, &InternalError{Message: "Error when reading hold", Err: err}
+	}
+	h.ExpiresAt = time.Unix(expiresAt, 0)
+	h.TransactionID = uint64(transactionID.Int64)
+	return h, nil
+}
+
+// Replayed hold gets its current status and expiration
+func (s *Store) checkHoldReplay(ctx context.Context, h *Hold) error {
+	var userID uint64
+	var amount, availableAfter Money
+	var status HoldStatus
+	var expiresAt int64
+	err := s.db.QueryRowContext(ctx, "SELECT userId, amount, availableAfter, status, expiresAt FROM holds WHERE id = ?", h.ID).
+		Scan(&userID, &amount, &availableAfter, &status, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return &InternalError{Message: "Error when checking hold replay", Err: err}
+	}
+	if userID != h.UserID || amount != h.Amount {
+		return &ConflictError{Err: errors.New("Hold id already used with different payload")}
+	}
+	h.Status = status
+	h.ExpiresAt = time.Unix(expiresAt, 0)
+	return &DuplicateError{Balance: availableAfter}
+}
+
+func (s *Store) loadReserved(userID uint64) (Money, error) {
+	var reserved Money
+	err := s.db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM holds WHERE userId = ? AND status = ?", userID, HoldAuthorized).Scan(&reserved)
+	return reserved, err
+}
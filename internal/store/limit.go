@@ -0,0 +1,232 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Responsible gaming limits are checked under user lock against sums of ledger
+// rows in rolling window. Authorized holds count as bets until they are resolved.
+// Decreasing a limit takes effect immediately, increase or removal waits for
+// Config.LimitCoolingOff and is applied lazily when limits are read.
+
+const DefaultLimitCoolingOff = 24 * time.Hour
+
+var limitPeriods = map[LimitPeriod]time.Duration{
+	Daily:   24 * time.Hour,
+	Weekly:  7 * 24 * time.Hour,
+	Monthly: 30 * 24 * time.Hour,
+}
+
+// Ledger sums in window for every limit type, parameters are userId and window start
+var limitUsage = map[LimitType]string{
+	DepositLimit: `
+		SELECT COALESCE(SUM(amount), 0) FROM deposits WHERE userId = ? AND date >= ?`,
+	WagerLimit: `
+		SELECT COALESCE(SUM(amount), 0) FROM (
+			SELECT amount FROM transactions WHERE userId = ?1 AND type = 'Bet' AND rolledBack = 0 AND date >= ?2
+			UNION ALL
+			SELECT amount FROM holds WHERE userId = ?1 AND status = 'authorized'
+		)`,
+	LossLimit: `
+		SELECT COALESCE(SUM(amount), 0) FROM (
+			SELECT CASE type WHEN 'Bet' THEN amount ELSE -amount END AS amount FROM transactions
+			WHERE userId = ?1 AND type IN ('Bet', 'Win') AND rolledBack = 0 AND date >= ?2
+			UNION ALL
+			SELECT amount FROM holds WHERE userId = ?1 AND status = 'authorized'
+		)`,
+}
+
+// Limit types which apply to operation of transaction type
+func limitTypesOf(operation TransactionType) []LimitType {
+	switch operation {
+	case DepositType:
+		return []LimitType{DepositLimit}
+	case Bet:
+		return []LimitType{WagerLimit, LossLimit}
+	}
+	return nil
+}
+
+func validateLimit(l *Limit) error {
+	if l.Type != DepositLimit && l.Type != LossLimit && l.Type != WagerLimit {
+		return &ValidationError{Err: errors.New("Invalid limit type"), Field: "type"}
+	}
+	if _, ok := limitPeriods[l.Period]; !ok {
+		return &ValidationError{Err: errors.New("Invalid limit period"), Field: "period"}
+	}
+	if l.Amount < 0 {
+		return &ValidationError{Err: errors.New("Limit amount can't be negative"), Field: "amount"}
+	}
+	return nil
+}
+
+// Return all limits of user with their usage in the current window
+func (s *Store) getLimits(ctx context.Context, userID uint64) ([]Limit, error) {
+	user, ok := s.users.get(userID)
+	if !ok {
+		return nil, &NotFoundError{Err: errors.New("User not found"), Code: CodeUserNotFound}
+	}
+	if err := lockUser(ctx, user); err != nil {
+		return nil, err
+	}
+	defer user.Unlock()
+	limits, err := s.loadLimits(ctx, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for i := range limits {
+		if limits[i].Used, err = s.limitUsed(ctx, &limits[i], time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	return limits, nil
+}
+
+// Set, decrease, increase or remove (zero amount) limit. Returns resulting limit,
+// which is nil when limit was removed or there was nothing to remove.
+func (s *Store) setLimit(ctx context.Context, l *Limit) (*Limit, error) {
+	if err := validateLimit(l); err != nil {
+		return nil, err
+	}
+	user, ok := s.users.get(l.UserID)
+	if !ok {
+		return nil, &NotFoundError{Err: errors.New("User not found"), Code: CodeUserNotFound}
+	}
+	if err := lockUser(ctx, user); err != nil {
+		return nil, err
+	}
+	defer user.Unlock()
+	now := time.Now()
+	limits, err := s.loadLimits(ctx, l.UserID, now)
+	if err != nil {
+		return nil, err
+	}
+	var current *Limit
+	for i := range limits {
+		if limits[i].Type == l.Type && limits[i].Period == l.Period {
+			current = &limits[i]
+		}
+	}
+
+	result := *l
+	result.PendingAmount, result.PendingFrom = nil, nil
+	switch {
+	case current == nil && l.Amount == 0:
+		return nil, nil
+	case current == nil || (l.Amount != 0 && l.Amount <= current.Amount):
+		// new or stricter limit applies immediately and cancels pending increase
+		_, err = s.db.ExecContext(ctx, `INSERT OR REPLACE INTO limits(userId, type, period, amount, pendingAmount, pendingFrom)
+			values(?, ?, ?, ?, NULL, NULL)`, l.UserID, l.Type, l.Period, l.Amount)
+	default:
+		pendingFrom := now.Add(s.config.LimitCoolingOff)
+		result.Amount = current.Amount
+		result.PendingAmount = &l.Amount
+		result.PendingFrom = &pendingFrom
+		_, err = s.db.ExecContext(ctx, "UPDATE limits SET pendingAmount = ?, pendingFrom = ? WHERE userId = ? AND type = ? AND period = ?",
+			l.Amount, pendingFrom.Unix(), l.UserID, l.Type, l.Period)
+	}
+	if err != nil {
+		return nil, &InternalError{Message: "Can't save limit", Err: err}
+	}
+	if result.Used, err = s.limitUsed(ctx, &result, now); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Read limits of user and apply pending changes which passed cooling-off period.
+// Must be called under user lock.
+func (s *Store) loadLimits(ctx context.Context, userID uint64, now time.Time) ([]Limit, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT type, period, amount, pendingAmount, pendingFrom FROM limits WHERE userId = ?", userID)
+	if err != nil {
+		return nil, &InternalError{Message: "Can't read limits", Err: err}
+	}
+	var limits []Limit
+	for rows.Next() {
+		l := Limit{UserID: userID}
+		var pendingAmount, pendingFrom sql.NullInt64
+		if err = rows.Scan(&l.Type, &l.Period, &l.Amount, &pendingAmount, &pendingFrom); err != nil {
+			rows.Close()
+			return nil, &InternalError{Message: "Can't read limits", Err: err}
+		}
+		if pendingAmount.Valid {
+			amount := Money(pendingAmount.Int64)
+			from := time.Unix(pendingFrom.Int64, 0)
+			l.PendingAmount, l.PendingFrom = &amount, &from
+		}
+		limits = append(limits, l)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, &InternalError{Message: "Can't read limits", Err: err}
+	}
+
+	active := limits[:0]
+	for _, l := range limits {
+		if l.PendingFrom == nil || now.Before(*l.PendingFrom) {
+			active = append(active, l)
+			continue
+		}
+		if *l.PendingAmount == 0 {
+			_, err = s.db.ExecContext(ctx, "DELETE FROM limits WHERE userId = ? AND type = ? AND period = ?", userID, l.Type, l.Period)
+		} else {
+			_, err = s.db.ExecContext(ctx, "UPDATE limits SET amount = pendingAmount, pendingAmount = NULL, pendingFrom = NULL WHERE userId = ? AND type = ? AND period = ?",
+				userID, l.Type, l.Period)
+		}
+		if err != nil {
+			return nil, &InternalError{Message: "Can't apply pending limit", Err: err}
+		}
+		LoggerFrom(ctx, s.logger).Infof("Limit %s %s of user %d changed from %s to %s", l.Period, l.Type, userID, l.Amount, *l.PendingAmount)
+		if *l.PendingAmount != 0 {
+			l.Amount = *l.PendingAmount
+			l.PendingAmount, l.PendingFrom = nil, nil
+			active = append(active, l)
+		}
+	}
+	return active, nil
+}
+
+func (s *Store) limitUsed(ctx context.Context, l *Limit, now time.Time) (Money, error) {
+	var used Money
+	windowStart := now.Add(-limitPeriods[l.Period]).Unix()
+	if err := s.db.QueryRowContext(ctx, limitUsage[l.Type], l.UserID, windowStart).Scan(&used); err != nil {
+		return 0, &InternalError{Message: "Can't calculate limit usage", Err: err}
+	}
+	return used, nil
+}
+
+// Return LimitError when operation of amount would exceed any limit of user.
+// Must be called under user lock.
+func (s *Store) checkLimits(ctx context.Context, userID uint64, operation TransactionType, amount Money) error {
+	types := limitTypesOf(operation)
+	if len(types) == 0 {
+		return nil
+	}
+	now := time.Now()
+	limits, err := s.loadLimits(ctx, userID, now)
+	if err != nil {
+		return err
+	}
+	for i := range limits {
+		l := &limits[i]
+		applies := false
+		for _, limitType := range types {
+			applies = applies || l.Type == limitType
+		}
+		if !applies {
+			continue
+		}
+		used, err := s.limitUsed(ctx, l, now)
+		if err != nil {
+			return err
+		}
+		if used+amount > l.Amount {
+			return &LimitError{Err: fmt.Errorf("%s %s limit %s exceeded, used %s", l.Period, l.Type, l.Amount, used)}
+		}
+	}
+	return nil
+}
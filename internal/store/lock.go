@@ -0,0 +1,47 @@
+package store
+
+import (
+	"context"
+	"sync"
+)
+
+// Mutex of user which waiting can be abandoned when context is done.
+// Zero value is unlocked mutex.
+type userLock struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func (l *userLock) init() {
+	l.once.Do(func() {
+		l.ch = make(chan struct{}, 1)
+	})
+}
+
+func (l *userLock) Lock() {
+	l.init()
+	l.ch <- struct{}{}
+}
+
+// Lock or return ctx error when ctx is done first
+func (l *userLock) LockContext(ctx context.Context) error {
+	l.init()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case l.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *userLock) Unlock() {
+	l.init()
+	select {
+	case <-l.ch:
+	default:
+		panic("store: unlock of unlocked user")
+	}
+}
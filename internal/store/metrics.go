@@ -0,0 +1,41 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dehimb/cake/internal/metrics"
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	operationsTotal = metrics.NewCounter("cake_store_operations_total",
+		"Balance operations by result, which is ok or error code.", "operation", "result")
+	operationDuration = metrics.NewHistogram("cake_store_operation_duration_seconds",
+		"Time of balance operations including user lock wait.", metrics.DefaultBuckets, "operation")
+	cachedUsers = metrics.NewGauge("cake_store_cached_users",
+		"Users kept in memory cache.")
+	dirtyUsers = metrics.NewGauge("cake_store_dirty_users",
+		"Users which balance is changed in cache and waits for write-behind flush.")
+	flushDuration = metrics.NewHistogram("cake_store_flush_duration_seconds",
+		"Time of write-behind flush of all dirty users.", metrics.DefaultBuckets)
+	sqliteErrors = metrics.NewCounter("cake_store_sqlite_errors_total",
+		"SQLite errors by operation and error code.", "operation", "code")
+)
+
+func observeOperation(operation string, start time.Time, err error) {
+	operationDuration.Observe(time.Since(start).Seconds(), operation)
+	result := "ok"
+	if err != nil {
+		result = string(CodeOf(err))
+		countSQLiteError(operation, err)
+	}
+	operationsTotal.Inc(operation, result)
+}
+
+func countSQLiteError(operation string, err error) {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		sqliteErrors.Inc(operation, sqliteErr.Code.Error())
+	}
+}
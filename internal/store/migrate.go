@@ -0,0 +1,278 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Schema changes for databases created by previous versions.
+// Database version is kept in sqlite user_version pragma. Fresh databases are
+// created by CreateTables with the latest schema and skip all migrations.
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Convert REAL amounts to integer minor units",
+		apply:       migrateMoneyToMinorUnits,
+	},
+	{
+		version:     2,
+		description: "Add rollback columns to transactions",
+		apply: func(tx *sql.Tx) error {
+			if err := addColumn(tx, "transactions", "referenceId", "INTEGER"); err != nil {
+				return err
+			}
+			return addColumn(tx, "transactions", "rolledBack", "INTEGER NOT NULL DEFAULT 0")
+		},
+	},
+	{
+		version:     3,
+		description: "Add ledger sequence numbers",
+		apply:       migrateLedgerSeq,
+	},
+	{
+		version:     4,
+		description: "Add bonus wallet columns",
+		apply: func(tx *sql.Tx) error {
+			for _, column := range []string{"bonusBalance", "wageringLeft", "bonusExpiresAt"} {
+				if err := addColumn(tx, "users", column, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+					return err
+				}
+			}
+			return addColumn(tx, "transactions", "bonusAmount", "INTEGER NOT NULL DEFAULT 0")
+		},
+	},
+	{
+		version:     5,
+		description: "Add account status columns",
+		apply: func(tx *sql.Tx) error {
+			if err := addColumn(tx, "users", "status", "TEXT NOT NULL DEFAULT 'active'"); err != nil {
+				return err
+			}
+			return addColumn(tx, "users", "statusUntil", "INTEGER NOT NULL DEFAULT 0")
+		},
+	},
+	{
+		version:     6,
+		description: "Add operator columns to ledger tables",
+		apply: func(tx *sql.Tx) error {
+			columns := [][2]string{
+				{"deposits", "operator"},
+				{"transactions", "operator"},
+				{"withdrawals", "operator"},
+				{"withdrawals", "resolvedOperator"},
+				{"holds", "operator"},
+				{"holds", "resolvedOperator"},
+				{"bonusTransactions", "operator"},
+			}
+			for _, c := range columns {
+				if err := addColumn(tx, c[0], c[1], "TEXT"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+func schemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Create tables and indexes, run pending migrations
+func (s *Store) initSchema() error {
+	fresh, err := s.isFreshDatabase()
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		if err = s.migrate(); err != nil {
+			return err
+		}
+	}
+	if _, err = s.db.Exec(CreateTables); err != nil {
+		return fmt.Errorf("Can't create tables: %s", err)
+	}
+	if _, err = s.db.Exec(CreateIndexes); err != nil {
+		return fmt.Errorf("Can't create indexes: %s", err)
+	}
+	if fresh {
+		if _, err = s.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersion())); err != nil {
+			return fmt.Errorf("Can't set schema version: %s", err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) isFreshDatabase() (bool, error) {
+	var count int
+	err := s.db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'users'`).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("Can't read database schema: %s", err)
+	}
+	return count == 0, nil
+}
+
+func (s *Store) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("Can't read schema version: %s", err)
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		s.logger.Infof("Migrating database to version %d: %s", m.version, m.description)
+		tx, err := s.db.Begin()
+		if err != nil {
+			return fmt.Errorf("Can't start migration %d: %s", m.version, err)
+		}
+		if err = m.apply(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration %d failed: %s", m.version, err)
+		}
+		if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.version)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration %d failed: %s", m.version, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("Can't commit migration %d: %s", m.version, err)
+		}
+	}
+	return nil
+}
+
+// Add column to existing table. Tables which don't exist yet are skipped,
+// they are created by CreateTables with all columns.
+func addColumn(tx *sql.Tx, table string, column string, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf(`PRAGMA table_info("%s")`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	tableExists := false
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+		tableExists = true
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if !tableExists {
+		return nil
+	}
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN "%s" %s`, table, column, definition))
+	return err
+}
+
+// Tables created before money type was introduced store amounts as REAL.
+// Rebuild them with INTEGER columns and convert values to minor units.
+func migrateMoneyToMinorUnits(tx *sql.Tx) error {
+	_, err := tx.Exec(fmt.Sprintf(`
+		ALTER TABLE "users" RENAME TO "users_real";
+		ALTER TABLE "deposits" RENAME TO "deposits_real";
+		ALTER TABLE "transactions" RENAME TO "transactions_real";
+		DROP INDEX IF EXISTS "transactionUserId";
+		DROP INDEX IF EXISTS "depositUserId";
+		CREATE TABLE "users" (
+			"id"	INTEGER NOT NULL UNIQUE,
+			"balance"	INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY("id")
+		);
+		CREATE TABLE "deposits" (
+			"id"	INTEGER NOT NULL UNIQUE,
+			"userId"	INTEGER NOT NULL,
+			"amount"	INTEGER NOT NULL,
+			"balanceBefore"	INTEGER NOT NULL,
+			"balanceAfter"	INTEGER NOT NULL,
+			"date" INTEGER NOT NULL,
+			PRIMARY KEY("id")
+		);
+		CREATE TABLE "transactions" (
+			"id"	INTEGER NOT NULL UNIQUE,
+			"userId"	INTEGER NOT NULL,
+			"type"	TEXT NOT NULL,
+			"amount"	INTEGER NOT NULL,
+			"balanceBefore"	INTEGER NOT NULL,
+			"balanceAfter"	INTEGER NOT NULL,
+			"date" INTEGER NOT NULL,
+			PRIMARY KEY("id")
+		);
+		INSERT INTO "users" ("id", "balance")
+			SELECT "id", CAST(ROUND("balance" * %[1]d) AS INTEGER) FROM "users_real";
+		INSERT INTO "deposits" ("id", "userId", "amount", "balanceBefore", "balanceAfter", "date")
+			SELECT "id", "userId",
+				CAST(ROUND("balanceAfter" * %[1]d) AS INTEGER) - CAST(ROUND("balanceBefore" * %[1]d) AS INTEGER),
+				CAST(ROUND("balanceBefore" * %[1]d) AS INTEGER),
+				CAST(ROUND("balanceAfter" * %[1]d) AS INTEGER),
+				"date"
+			FROM "deposits_real";
+		INSERT INTO "transactions" ("id", "userId", "type", "amount", "balanceBefore", "balanceAfter", "date")
+			SELECT "id", "userId", "type",
+				CAST(ROUND("amount" * %[1]d) AS INTEGER),
+				CAST(ROUND("balanceBefore" * %[1]d) AS INTEGER),
+				CAST(ROUND("balanceAfter" * %[1]d) AS INTEGER),
+				"date"
+			FROM "transactions_real";
+		DROP TABLE "users_real";
+		DROP TABLE "deposits_real";
+		DROP TABLE "transactions_real";
+	`, minorUnits))
+	return err
+}
+
+// Number existing ledger rows in order of their date. Rows with the same date
+// are ordered by table and id, which is the best guess available.
+func migrateLedgerSeq(tx *sql.Tx) error {
+	if err := addColumn(tx, "deposits", "seq", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "transactions", "seq", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	rows, err := tx.Query(`
+		SELECT 'deposits', id, date FROM deposits
+		UNION ALL
+		SELECT 'transactions', id, date FROM transactions
+		ORDER BY 3, 1, 2`)
+	if err != nil {
+		return err
+	}
+	type ledgerRow struct {
+		table string
+		id    uint64
+	}
+	var ledger []ledgerRow
+	for rows.Next() {
+		var row ledgerRow
+		var date int64
+		if err = rows.Scan(&row.table, &row.id, &date); err != nil {
+			rows.Close()
+			return err
+		}
+		ledger = append(ledger, row)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for i, row := range ledger {
+		if _, err = tx.Exec(fmt.Sprintf(`UPDATE "%s" SET seq = ? WHERE id = ?`, row.table), i+1, row.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
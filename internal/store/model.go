@@ -1,28 +1,82 @@
 package store
 
-import "sync"
+import "time"
 
 type User struct {
-	sync.Mutex
-	ID      uint64  `json:"id"`
-	Balance float32 `json:"balance"`
-	Updated bool
+	userLock
+	ID      uint64 `json:"id"`
+	Balance Money  `json:"balance"`
+	// Part of balance locked by authorized holds
+	Reserved Money `json:"-"`
+	// Bonus wallet, can be spent only on bets
+	Bonus Money `json:"-"`
+	// Bets amount left before bonus converts to cash
+	WageringLeft Money `json:"-"`
+	// Unconverted bonus is forfeited after this time
+	BonusExpiresAt time.Time `json:"-"`
+	// See AccountStatus, StatusUntil is set only for self-exclusion
+	Status      AccountStatus `json:"-"`
+	StatusUntil time.Time     `json:"-"`
+	Updated     bool
+	// Totals of user operations, changed together with balance under user lock
+	statistic *Statistic
+}
+
+// Cash balance which can be spent by bets and withdrawals
+func (u *User) Available() Money {
+	return u.Balance - u.Reserved
+}
+
+// Copy of cached user and its statistic, which can be read without user lock.
+// Must be called under user lock.
+func (u *User) snapshot() (*User, *Statistic) {
+	user := &User{
+		ID:             u.ID,
+		Balance:        u.Balance,
+		Reserved:       u.Reserved,
+		Bonus:          u.Bonus,
+		WageringLeft:   u.WageringLeft,
+		BonusExpiresAt: u.BonusExpiresAt,
+		Status:         u.Status,
+		StatusUntil:    u.StatusUntil,
+		Updated:        u.Updated,
+	}
+	var statistic Statistic
+	if u.statistic != nil {
+		statistic = *u.statistic
+	}
+	return user, &statistic
 }
 
 type Statistic struct {
 	UserID        uint64
 	DepositeCount int
-	DepositSum    float32
+	DepositSum    Money
 	BetCount      int
-	BetSum        float32
+	BetSum        Money
 	WinCount      int
-	WinSum        float32
+	WinSum        Money
+	// parts of BetSum and WinSum paid from and to bonus wallet
+	BetBonusSum Money
+	WinBonusSum Money
+	// bonus wallet totals
+	BonusGrantedSum   Money
+	BonusConvertedSum Money
+	BonusExpiredSum   Money
+	// approved withdrawals
+	WithdrawalCount int
+	WithdrawalSum   Money
+	// withdrawals waiting for approval, their funds are already reserved
+	PendingWithdrawalCount int
+	PendingWithdrawalSum   Money
 }
 
 type Deposit struct {
-	ID     uint64  `json:"depositId"`
-	UserID uint64  `json:"userId"`
-	Amount float32 `json:"amount"`
+	ID     uint64 `json:"depositId"`
+	UserID uint64 `json:"userId"`
+	Amount Money  `json:"amount"`
+	// Name of the operator which made the request, set by server
+	Operator string `json:"-"`
 }
 
 type TransactionType string
@@ -30,11 +84,146 @@ type TransactionType string
 const (
 	Bet TransactionType = "Bet"
 	Win TransactionType = "Win"
+	// Rollback returns amount of the referenced bet to the user
+	Rollback TransactionType = "Rollback"
+	// DepositType marks deposits in ledger history
+	DepositType TransactionType = "Deposit"
+	// WithdrawalType marks funds reserved by withdrawal request in ledger history
+	WithdrawalType TransactionType = "Withdrawal"
+	// WithdrawalReturnType marks funds returned by rejected withdrawal in ledger history
+	WithdrawalReturnType TransactionType = "WithdrawalReturn"
+	// BonusConversionType marks bonus converted to cash in ledger history
+	BonusConversionType TransactionType = "BonusConversion"
 )
 
 type Transaction struct {
 	ID     uint64          `json:"transactionId"`
 	UserID uint64          `json:"userId"`
 	Type   TransactionType `json:"type"`
-	Amount float32         `json:"amount"`
+	Amount Money           `json:"amount"`
+	// ID of the rolled back transaction, used only by Rollback
+	ReferenceID uint64 `json:"originalTransactionId,omitempty"`
+	// Part of amount paid from or to bonus wallet, set by store
+	BonusAmount Money `json:"-"`
+	// Name of the operator which made the request, set by server
+	Operator string `json:"-"`
+}
+
+type WithdrawalStatus string
+
+const (
+	WithdrawalPending  WithdrawalStatus = "pending"
+	WithdrawalApproved WithdrawalStatus = "approved"
+	WithdrawalRejected WithdrawalStatus = "rejected"
+)
+
+type Withdrawal struct {
+	ID     uint64           `json:"withdrawalId"`
+	UserID uint64           `json:"userId"`
+	Amount Money            `json:"amount"`
+	Status WithdrawalStatus `json:"status,omitempty"`
+	// Name of the operator which made the request, set by server
+	Operator string `json:"-"`
+}
+
+// Bonus granted to user by promotion
+type Bonus struct {
+	ID     uint64 `json:"bonusId"`
+	UserID uint64 `json:"userId"`
+	Amount Money  `json:"amount"`
+	// Name of the operator which made the request, set by server
+	Operator string `json:"-"`
+}
+
+// Types of bonus wallet ledger rows
+type BonusTransactionType string
+
+const (
+	BonusGrant      BonusTransactionType = "Grant"
+	BonusBet        BonusTransactionType = "Bet"
+	BonusWin        BonusTransactionType = "Win"
+	BonusRollback   BonusTransactionType = "Rollback"
+	BonusConversion BonusTransactionType = "Conversion"
+	BonusExpiry     BonusTransactionType = "Expiry"
+)
+
+type HoldStatus string
+
+const (
+	HoldAuthorized HoldStatus = "authorized"
+	HoldCaptured   HoldStatus = "captured"
+	HoldReleased   HoldStatus = "released"
+	HoldExpired    HoldStatus = "expired"
+)
+
+// Hold reserves part of user balance until it is captured as bet or released
+type Hold struct {
+	ID     uint64     `json:"holdId"`
+	UserID uint64     `json:"userId"`
+	Amount Money      `json:"amount"`
+	Status HoldStatus `json:"status,omitempty"`
+	// ID of bet transaction created by capture
+	TransactionID uint64    `json:"transactionId,omitempty"`
+	ExpiresAt     time.Time `json:"-"`
+	// Name of the operator which made the request, set by server
+	Operator string `json:"-"`
+}
+
+// Responsible gaming limit kinds
+type LimitType string
+
+const (
+	DepositLimit LimitType = "deposit"
+	// Bets minus wins in the window
+	LossLimit  LimitType = "loss"
+	WagerLimit LimitType = "wager"
+)
+
+// Limits are checked over rolling window of the period length ending now
+type LimitPeriod string
+
+const (
+	Daily   LimitPeriod = "daily"
+	Weekly  LimitPeriod = "weekly"
+	Monthly LimitPeriod = "monthly"
+)
+
+// Limit of user spending in rolling window. Zero amount in request removes the limit.
+type Limit struct {
+	UserID uint64      `json:"userId"`
+	Type   LimitType   `json:"type"`
+	Period LimitPeriod `json:"period"`
+	Amount Money       `json:"amount"`
+	// Amount spent in the current window
+	Used Money `json:"used"`
+	// Increase or removal which waits for cooling-off period
+	PendingAmount *Money     `json:"pendingAmount,omitempty"`
+	PendingFrom   *time.Time `json:"pendingFrom,omitempty"`
+}
+
+// Single balance change from ledger tables
+type LedgerEntry struct {
+	ID            uint64          `json:"id"`
+	Type          TransactionType `json:"type"`
+	Amount        Money           `json:"amount"`
+	BalanceBefore Money           `json:"balanceBefore"`
+	BalanceAfter  Money           `json:"balanceAfter"`
+	Date          time.Time       `json:"date"`
+	ReferenceID   uint64          `json:"originalTransactionId,omitempty"`
+	RolledBack    bool            `json:"rolledBack,omitempty"`
+	// Operator which wrote the entry, empty for user requests
+	Operator string `json:"operator,omitempty"`
+}
+
+// Filters for user ledger history. Zero values mean no filter.
+type HistoryQuery struct {
+	UserID    uint64
+	Types     []TransactionType
+	From      time.Time
+	To        time.Time
+	MinAmount Money
+	MaxAmount Money
+	// Cursor returned with the previous page
+	Cursor string
+	Limit  int
 }
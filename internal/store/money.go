@@ -0,0 +1,105 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an exact amount of currency kept as integer number of minor units
+// (cents). Every balance, amount and sum in the store uses Money, so
+// arithmetic never accumulates floating point errors.
+type Money int64
+
+const (
+	// MoneyScale is the number of decimal digits of the minor unit
+	MoneyScale = 2
+	// minorUnits is the number of minor units in one major unit
+	minorUnits = 100
+)
+
+var errInvalidMoney = errors.New("Invalid amount")
+
+// ParseMoney converts strict decimal string like "12", "12.5" or "-0.01" to Money.
+// Exponents, leading plus sign, leading zeros and more than MoneyScale
+// fractional digits are rejected.
+func ParseMoney(s string) (Money, error) {
+	negative := strings.HasPrefix(s, "-")
+	if negative {
+		s = s[1:]
+	}
+	intPart, fracPart := s, ""
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		intPart, fracPart = s[:dot], s[dot+1:]
+		if len(fracPart) == 0 || len(fracPart) > MoneyScale {
+			return 0, errInvalidMoney
+		}
+	}
+	if len(intPart) == 0 || (len(intPart) > 1 && intPart[0] == '0') {
+		return 0, errInvalidMoney
+	}
+	if !isDigits(intPart) || !isDigits(fracPart) {
+		return 0, errInvalidMoney
+	}
+	major, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil || major > math.MaxInt64/minorUnits {
+		return 0, errInvalidMoney
+	}
+	var minor int64
+	if len(fracPart) > 0 {
+		fracPart += strings.Repeat("0", MoneyScale-len(fracPart))
+		minor, _ = strconv.ParseInt(fracPart, 10, 64)
+	}
+	value := major*minorUnits + minor
+	if value < 0 {
+		return 0, errInvalidMoney
+	}
+	if negative {
+		value = -value
+	}
+	return Money(value), nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns decimal representation with exactly MoneyScale fractional digits
+func (m Money) String() string {
+	sign := ""
+	value := uint64(m)
+	if m < 0 {
+		sign = "-"
+		value = uint64(-m)
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, value/minorUnits, MoneyScale, value%minorUnits)
+}
+
+// MarshalJSON encodes Money as JSON number with fixed number of fractional digits
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts JSON number or JSON string with decimal value
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	value, err := ParseMoney(s)
+	if err != nil {
+		return fmt.Errorf("%s: %q", err, s)
+	}
+	*m = value
+	return nil
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMoney(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected Money
+		valid    bool
+	}{
+		{value: "0", expected: 0, valid: true},
+		{value: "12", expected: 1200, valid: true},
+		{value: "12.5", expected: 1250, valid: true},
+		{value: "12.05", expected: 1205, valid: true},
+		{value: "-0.01", expected: -1, valid: true},
+		{value: "92233720368547758.07", expected: 9223372036854775807, valid: true},
+		{value: "92233720368547758.08", valid: false},
+		{value: "12.345", valid: false},
+		{value: "12.", valid: false},
+		{value: ".5", valid: false},
+		{value: "+1", valid: false},
+		{value: "01", valid: false},
+		{value: "1e2", valid: false},
+		{value: "", valid: false},
+		{value: "abc", valid: false},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.value, func(t *testing.T) {
+			value, err := ParseMoney(testCase.value)
+			if !testCase.valid {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expected, value)
+		})
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var d Deposit
+	assert.NoError(t, json.Unmarshal([]byte(`{"depositId":1,"userId":2,"amount":0.1}`), &d))
+	assert.Equal(t, Money(10), d.Amount)
+	assert.NoError(t, json.Unmarshal([]byte(`{"amount":"160000.01"}`), &d))
+	assert.Equal(t, Money(16000001), d.Amount)
+	assert.Error(t, json.Unmarshal([]byte(`{"amount":0.001}`), &d))
+	assert.Error(t, json.Unmarshal([]byte(`{"amount":true}`), &d))
+
+	data, err := json.Marshal(&User{ID: 1, Balance: 30})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":1,"balance":0.30,"Updated":false}`, string(data))
+	data, _ = json.Marshal(Money(-1205))
+	assert.Equal(t, `-12.05`, string(data))
+}
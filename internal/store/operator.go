@@ -0,0 +1,226 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Operators are internal services (game servers, cashier, back office) which
+// call the API with API keys. Every key has a set of scopes, which are checked
+// per route by the server, and every ledger row keeps name of the operator
+// whose key was used to write it.
+
+// Permission to call group of routes
+type Scope string
+
+const (
+	ScopeUsersRead         Scope = "users:read"
+	ScopeUsersWrite        Scope = "users:write"
+	ScopeUsersCreate       Scope = "users:create"
+	ScopeDepositsWrite     Scope = "deposits:write"
+	ScopeTransactionsWrite Scope = "transactions:write"
+	ScopeWithdrawalsWrite  Scope = "withdrawals:write"
+	// Grants every other scope
+	ScopeAdmin Scope = "admin"
+)
+
+var scopes = []Scope{
+	ScopeUsersRead, ScopeUsersWrite, ScopeUsersCreate, ScopeDepositsWrite,
+	ScopeTransactionsWrite, ScopeWithdrawalsWrite, ScopeAdmin,
+}
+
+// Scopes of user session tokens, users act only on their own account.
+// Deposits and transactions credit money, they are posted only by operator API keys.
+var sessionScopes = []Scope{
+	ScopeUsersRead, ScopeUsersWrite, ScopeWithdrawalsWrite,
+}
+
+// API keys start with this prefix, session tokens never do
+const apiKeyPrefix = "ck_"
+
+// Parse comma separated list of scopes
+func ParseScopes(list string) ([]Scope, error) {
+	var result []Scope
+	for _, name := range strings.Split(list, ",") {
+		scope := Scope(strings.TrimSpace(name))
+		if scope == "" {
+			continue
+		}
+		known := false
+		for _, s := range scopes {
+			known = known || s == scope
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown scope: %s", scope)
+		}
+		result = append(result, scope)
+	}
+	if len(result) == 0 {
+		return nil, errors.New("At least one scope is required")
+	}
+	return result, nil
+}
+
+func joinScopes(list []Scope) string {
+	names := make([]string, len(list))
+	for i, scope := range list {
+		names[i] = string(scope)
+	}
+	return strings.Join(names, ",")
+}
+
+type APIKey struct {
+	ID       uint64
+	Operator string
+	// First characters of the key to recognize it in the list
+	Prefix     string
+	Scopes     []Scope
+	Created    time.Time
+	LastUsedAt time.Time
+	RevokedAt  time.Time
+}
+
+// Resolve API key to operator principal and record its usage
+func (s *Store) authenticateAPIKey(ctx context.Context, key string) (*Principal, error) {
+	p := &Principal{}
+	var scopeList string
+	var revokedAt sql.NullInt64
+	err := s.db.QueryRowContext(ctx, "SELECT id, operator, scopes, revokedAt FROM apiKeys WHERE keyHash = ?", hashToken(key)).
+		Scan(&p.APIKeyID, &p.Operator, &scopeList, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, &AuthenticationError{Err: errors.New("Invalid API key")}
+	}
+	if err != nil {
+		return nil, &InternalError{Message: "Can't read API key", Err: err}
+	}
+	if revokedAt.Valid {
+		return nil, &AuthenticationError{Err: errors.New("API key is revoked")}
+	}
+	if p.Scopes, err = ParseScopes(scopeList); err != nil {
+		return nil, &InternalError{Message: "Invalid scopes of API key", Err: err}
+	}
+	// usage is recorded with minute precision to avoid write on every request
+	now := time.Now().Unix()
+	_, err = s.db.ExecContext(ctx, "UPDATE apiKeys SET lastUsedAt = ? WHERE id = ? AND (lastUsedAt IS NULL OR lastUsedAt < ?)", now, p.APIKeyID, now-60)
+	if err != nil {
+		LoggerFrom(ctx, s.logger).Warnf("Can't record usage of API key %d: %s", p.APIKeyID, err)
+	}
+	return p, nil
+}
+
+// Operator column value, NULL for changes made without API key
+func operatorColumn(operator string) interface{} {
+	if operator == "" {
+		return nil
+	}
+	return operator
+}
+
+// Admin manages operators and their API keys without starting the store cache
+type Admin struct {
+	store *Store
+}
+
+// Open database for management commands, schema is migrated if needed
+func NewAdmin(logger *logrus.Logger, dbName string) (*Admin, error) {
+	s := &Store{logger: logger, config: Config{DBName: dbName}}
+	var err error
+	if s.db, err = sql.Open("sqlite3", dbName); err != nil {
+		return nil, fmt.Errorf("Can't open database: %s", err)
+	}
+	if err = s.initSchema(); err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	return &Admin{store: s}, nil
+}
+
+func (a *Admin) Close() error {
+	return a.store.db.Close()
+}
+
+func (a *Admin) CreateOperator(name string) error {
+	if name == "" {
+		return &ValidationError{Err: errors.New("Operator name is required"), Field: "name"}
+	}
+	_, err := a.store.db.Exec("INSERT INTO operators(name, date) values(?, ?)", name, time.Now().Unix())
+	if isConstraintError(err) {
+		return &ValidationError{Err: fmt.Errorf("Operator %s already exists", name), Code: CodeOperatorExists, Field: "name"}
+	}
+	return err
+}
+
+// Create API key of operator. The key itself is returned only once, only its hash is stored.
+func (a *Admin) CreateAPIKey(operator string, keyScopes []Scope) (string, *APIKey, error) {
+	var count int
+	if err := a.store.db.QueryRow("SELECT count(*) FROM operators WHERE name = ?", operator).Scan(&count); err != nil {
+		return "", nil, err
+	}
+	if count == 0 {
+		return "", nil, &NotFoundError{Err: fmt.Errorf("Operator %s not found", operator), Code: CodeOperatorNotFound}
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", nil, err
+	}
+	key := apiKeyPrefix + token
+	k := &APIKey{Operator: operator, Prefix: key[:len(apiKeyPrefix)+6], Scopes: keyScopes, Created: time.Now()}
+	result, err := a.store.db.Exec("INSERT INTO apiKeys(operator, keyHash, prefix, scopes, date) values(?, ?, ?, ?, ?)",
+		operator, hashToken(key), k.Prefix, joinScopes(keyScopes), k.Created.Unix())
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", nil, err
+	}
+	k.ID = uint64(id)
+	return key, k, nil
+}
+
+// List API keys, of all operators when operator is empty
+func (a *Admin) ListAPIKeys(operator string) ([]APIKey, error) {
+	rows, err := a.store.db.Query(`SELECT id, operator, prefix, scopes, date, lastUsedAt, revokedAt FROM apiKeys
+		WHERE ? = '' OR operator = ? ORDER BY id`, operator, operator)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []APIKey
+	for rows.Next() {
+		var k APIKey
+		var scopeList string
+		var created int64
+		var lastUsedAt, revokedAt sql.NullInt64
+		if err = rows.Scan(&k.ID, &k.Operator, &k.Prefix, &scopeList, &created, &lastUsedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		k.Scopes, _ = ParseScopes(scopeList)
+		k.Created = time.Unix(created, 0)
+		if lastUsedAt.Valid {
+			k.LastUsedAt = time.Unix(lastUsedAt.Int64, 0)
+		}
+		if revokedAt.Valid {
+			k.RevokedAt = time.Unix(revokedAt.Int64, 0)
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (a *Admin) RevokeAPIKey(id uint64) error {
+	result, err := a.store.db.Exec("UPDATE apiKeys SET revokedAt = ? WHERE id = ? AND revokedAt IS NULL", time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+	if expectOneRow(result) != nil {
+		return &NotFoundError{Err: fmt.Errorf("Active API key %d not found", id), Code: CodeAPIKeyNotFound}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// PersistenceMode defines how balance changes reach users table
+type PersistenceMode string
+
+const (
+	// Ledger row is inserted immediately, users table is updated by ticker.
+	// Fast, but balance in users table may fall behind ledger after crash.
+	WriteBehind PersistenceMode = "write-behind"
+	// Ledger row and user balance are committed in one db transaction
+	WriteThrough PersistenceMode = "write-through"
+)
+
+func ParsePersistenceMode(mode string) (PersistenceMode, error) {
+	switch PersistenceMode(mode) {
+	case WriteBehind, WriteThrough:
+		return PersistenceMode(mode), nil
+	}
+	return "", fmt.Errorf("Unknown persistence mode: %s", mode)
+}
+
+// Common part of sql.DB and sql.Tx used for ledger writes
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// Persistent part of user balance, stored in users table
+type balanceState struct {
+	Balance        Money
+	Bonus          Money
+	WageringLeft   Money
+	BonusExpiresAt time.Time
+}
+
+func (u *User) state() balanceState {
+	return balanceState{
+		Balance:        u.Balance,
+		Bonus:          u.Bonus,
+		WageringLeft:   u.WageringLeft,
+		BonusExpiresAt: u.BonusExpiresAt,
+	}
+}
+
+func (u *User) setState(state balanceState) {
+	u.Balance = state.Balance
+	u.Bonus = state.Bonus
+	u.WageringLeft = state.WageringLeft
+	u.BonusExpiresAt = state.BonusExpiresAt
+}
+
+func updateUserBalance(ctx context.Context, tx execer, userID uint64, state balanceState) error {
+	var bonusExpiresAt int64
+	if !state.BonusExpiresAt.IsZero() {
+		bonusExpiresAt = state.BonusExpiresAt.Unix()
+	}
+	_, err := tx.ExecContext(ctx, "UPDATE users SET balance = ?, bonusBalance = ?, wageringLeft = ?, bonusExpiresAt = ? WHERE id = ?",
+		state.Balance, state.Bonus, state.WageringLeft, bonusExpiresAt, userID)
+	return err
+}
+
+// Run ledger writes in one db transaction and apply new balance state to cached user.
+// In write-through mode balance is updated in the same db transaction,
+// otherwise user is marked as updated and saved later by ticker.
+// Cache is changed only after successful commit. Caller must hold user lock.
+// Errors returned by write are passed to caller unchanged, so write must
+// return store error types.
+func (s *Store) persist(ctx context.Context, user *User, next balanceState, write func(tx execer) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return &InternalError{Message: "Error when starting db transaction", Err: err}
+	}
+	if err = write(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if s.config.Persistence == WriteThrough {
+		if err = updateUserBalance(ctx, tx, user.ID, next); err != nil {
+			tx.Rollback()
+			return &TransactionError{Err: err}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return &TransactionError{Err: err}
+	}
+	user.setState(next)
+	if s.config.Persistence != WriteThrough && !user.Updated {
+		user.Updated = true
+		dirtyUsers.Inc()
+	}
+	return nil
+}
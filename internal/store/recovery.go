@@ -0,0 +1,154 @@
+package store
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// RecoveryPolicy defines what happens at startup when balance in users table
+// disagrees with the latest ledger entry of the user (e.g. after crash in write-behind mode)
+type RecoveryPolicy string
+
+const (
+	// Overwrite balance with the value from ledger
+	RecoveryRepair RecoveryPolicy = "repair"
+	// Refuse to start until database is fixed manually
+	RecoveryRefuse RecoveryPolicy = "refuse"
+)
+
+func ParseRecoveryPolicy(policy string) (RecoveryPolicy, error) {
+	switch RecoveryPolicy(policy) {
+	case RecoveryRepair, RecoveryRefuse:
+		return RecoveryPolicy(policy), nil
+	}
+	return "", fmt.Errorf("Unknown recovery policy: %s", policy)
+}
+
+// Balance of user which disagrees with ledger
+type BalanceCorrection struct {
+	UserID uint64
+	// Wallet is "balance" for cash or "bonusBalance" for bonus wallet
+	Wallet string
+	Stored Money
+	Ledger Money
+	// Wagering requirement of bonus wallet corrections
+	StoredWagering Money
+	LedgerWagering Money
+}
+
+// Latest balanceAfter of every user across all ledger tables.
+// Max seq of each user is computed once, ledger union has no index to look it up per row.
+var latestLedgerBalances = `
+	WITH ledger AS (` + ledgerEntries + `),
+	latest AS (SELECT userId, MAX(seq) AS seq FROM ledger GROUP BY userId)
+	SELECT u.id, u.balance, l.balanceAfter
+	FROM users u
+	JOIN latest m ON m.userId = u.id
+	JOIN ledger l ON l.userId = m.userId AND l.seq = m.seq`
+
+// Latest bonusAfter and wageringAfter of every user with bonus ledger
+const latestBonusBalances = `
+	SELECT u.id, u.bonusBalance, b.bonusAfter, u.wageringLeft, b.wageringAfter
+	FROM users u
+	JOIN bonusTransactions b ON b.userId = u.id
+	WHERE b.seq = (SELECT MAX(seq) FROM bonusTransactions WHERE userId = u.id)`
+
+// Allocate sequence number for new ledger row
+func (s *Store) nextSeq() int64 {
+	return atomic.AddInt64(&s.seq, 1)
+}
+
+func (s *Store) initSeq() error {
+	err := s.db.QueryRow(`
+		SELECT COALESCE(MAX(seq), 0) FROM (
+			SELECT seq FROM (` + ledgerEntries + `)
+			UNION ALL
+			SELECT seq FROM bonusTransactions
+		)`).Scan(&s.seq)
+	if err != nil {
+		return fmt.Errorf("Can't read ledger sequence: %s", err)
+	}
+	return nil
+}
+
+// Compare stored balances with ledger and repair or report mismatches
+func (s *Store) recoverBalances() error {
+	corrections, err := s.findBalanceCorrections()
+	if err != nil {
+		return err
+	}
+	if len(corrections) == 0 {
+		s.logger.Info("Recovery: all balances match ledger")
+		return nil
+	}
+	for _, c := range corrections {
+		if c.Wallet == "bonusBalance" {
+			s.logger.Warnf("Recovery: user %d bonus %s wagering %s, ledger bonus %s wagering %s",
+				c.UserID, c.Stored, c.StoredWagering, c.Ledger, c.LedgerWagering)
+			continue
+		}
+		s.logger.Warnf("Recovery: user %d balance %s, ledger %s", c.UserID, c.Stored, c.Ledger)
+	}
+	if s.config.Recovery == RecoveryRefuse {
+		return fmt.Errorf("Recovery: %d balances don't match ledger", len(corrections))
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Recovery: can't start db transaction: %s", err)
+	}
+	for _, c := range corrections {
+		if c.Wallet == "bonusBalance" {
+			_, err = tx.Exec("UPDATE users SET bonusBalance = ?, wageringLeft = ? WHERE id = ?", c.Ledger, c.LedgerWagering, c.UserID)
+		} else {
+			_, err = tx.Exec("UPDATE users SET balance = ? WHERE id = ?", c.Ledger, c.UserID)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Recovery: can't repair user %d: %s", c.UserID, err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("Recovery: can't commit repaired balances: %s", err)
+	}
+	s.logger.Warnf("Recovery: repaired %d balances", len(corrections))
+	return nil
+}
+
+func (s *Store) findBalanceCorrections() ([]BalanceCorrection, error) {
+	rows, err := s.db.Query(latestLedgerBalances)
+	if err != nil {
+		return nil, fmt.Errorf("Recovery: can't read ledger: %s", err)
+	}
+	defer rows.Close()
+	var corrections []BalanceCorrection
+	for rows.Next() {
+		c := BalanceCorrection{Wallet: "balance"}
+		if err = rows.Scan(&c.UserID, &c.Stored, &c.Ledger); err != nil {
+			return nil, fmt.Errorf("Recovery: can't read ledger: %s", err)
+		}
+		if c.Stored != c.Ledger {
+			corrections = append(corrections, c)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Recovery: can't read ledger: %s", err)
+	}
+	bonusRows, err := s.db.Query(latestBonusBalances)
+	if err != nil {
+		return nil, fmt.Errorf("Recovery: can't read bonus ledger: %s", err)
+	}
+	defer bonusRows.Close()
+	for bonusRows.Next() {
+		c := BalanceCorrection{Wallet: "bonusBalance"}
+		if err = bonusRows.Scan(&c.UserID, &c.Stored, &c.Ledger, &c.StoredWagering, &c.LedgerWagering); err != nil {
+			return nil, fmt.Errorf("Recovery: can't read bonus ledger: %s", err)
+		}
+		if c.Stored != c.Ledger || c.StoredWagering != c.LedgerWagering {
+			corrections = append(corrections, c)
+		}
+	}
+	if err = bonusRows.Err(); err != nil {
+		return nil, fmt.Errorf("Recovery: can't read bonus ledger: %s", err)
+	}
+	return corrections, nil
+}
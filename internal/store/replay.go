@@ -0,0 +1,59 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Clients retry deposits and transactions with the same ID when response is lost.
+// Replay of already applied operation returns DuplicateError with the original
+// resulting balance, reuse of ID with different payload returns ConflictError.
+
+func (s *Store) checkDepositReplay(ctx context.Context, d *Deposit) error {
+	var userID uint64
+	var amount, balanceAfter Money
+	err := s.db.QueryRowContext(ctx, "SELECT userId, amount, balanceAfter FROM deposits WHERE id = ?", d.ID).Scan(&userID, &amount, &balanceAfter)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return &InternalError{Message: "Error when checking deposit replay", Err: err}
+	}
+	if userID != d.UserID || amount != d.Amount {
+		return &ConflictError{Err: errors.New("Deposit id already used with different payload")}
+	}
+	return &DuplicateError{Balance: balanceAfter}
+}
+
+func (s *Store) checkTransactionReplay(ctx context.Context, t *Transaction) error {
+	var userID uint64
+	var transactionType TransactionType
+	var amount, balanceAfter Money
+	var referenceID uint64
+	err := s.db.QueryRowContext(ctx, "SELECT userId, type, amount, COALESCE(referenceId, 0), balanceAfter FROM transactions WHERE id = ?", t.ID).
+		Scan(&userID, &transactionType, &amount, &referenceID, &balanceAfter)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return &InternalError{Message: "Error when checking transaction replay", Err: err}
+	}
+	if userID != t.UserID || transactionType != t.Type || amount != t.Amount || referenceID != t.ReferenceID {
+		return &ConflictError{Err: errors.New("Transaction id already used with different payload")}
+	}
+	return &DuplicateError{Balance: balanceAfter}
+}
+
+func isConstraintError(err error) bool {
+	var sqliteError sqlite3.Error
+	return errors.As(err, &sqliteError) && sqliteError.Code == sqlite3.ErrConstraint
+}
+
+// Statement was interrupted because its context was done
+func isInterruptError(err error) bool {
+	var sqliteError sqlite3.Error
+	return errors.As(err, &sqliteError) && sqliteError.Code == sqlite3.ErrInterrupt
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Return amount of the referenced bet to the user. Bet can be rolled back only once,
+// rollback itself is stored in transactions table as transaction with Rollback type.
+func (s *Store) createRollback(ctx context.Context, t *Transaction) (Money, error) {
+	if t.ReferenceID == 0 {
+		return 0, &ValidationError{Err: errors.New("Original transaction id is required"), Field: "originalTransactionId"}
+	}
+	if t.Amount < 0 {
+		return 0, &ValidationError{Err: errors.New("Amount may not be negative"), Field: "amount"}
+	}
+	user, ok := s.users.get(t.UserID)
+	if !ok {
+		return 0, &NotFoundError{Err: errors.New("User not found"), Code: CodeUserNotFound}
+	}
+
+	var userID uint64
+	var originalType TransactionType
+	var originalAmount, originalBonusAmount Money
+	var rolledBack bool
+	err := s.db.QueryRowContext(ctx, "SELECT userId, type, amount, bonusAmount, rolledBack FROM transactions WHERE id = ?", t.ReferenceID).
+		Scan(&userID, &originalType, &originalAmount, &originalBonusAmount, &rolledBack)
+	if err == sql.ErrNoRows || (err == nil && userID != t.UserID) {
+		return 0, &NotFoundError{Err: errors.New("Original transaction not found"), Code: CodeTransactionNotFound}
+	}
+	if err != nil {
+		return 0, &InternalError{Message: "Error when reading original transaction", Err: err}
+	}
+	if originalType != Bet {
+		return 0, &ValidationError{Err: errors.New("Only bet transactions can be rolled back"), Code: CodeNotRollbackable, Field: "originalTransactionId"}
+	}
+	// amount is optional for rollback, when present it must match the bet
+	if t.Amount != 0 && t.Amount != originalAmount {
+		return 0, &ValidationError{Err: errors.New("Amount doesn't match original transaction"), Field: "amount"}
+	}
+	t.Amount = originalAmount
+	t.BonusAmount = originalBonusAmount
+	if err = s.checkTransactionReplay(ctx, t); err != nil {
+		return 0, err
+	}
+	if rolledBack {
+		return 0, &RolledBackError{Err: errors.New("Transaction already rolled back")}
+	}
+
+	if err = lockUser(ctx, user); err != nil {
+		return 0, err
+	}
+	defer user.Unlock()
+	// cash and bonus parts of the bet return to their wallets
+	next := user.state()
+	wallet := newBonusWallet(&next)
+	oldBalance := next.Balance
+	newBalance := oldBalance + t.Amount - t.BonusAmount
+	next.Balance = newBalance
+	wallet.rollback(t.ID, t.BonusAmount, t.Amount)
+
+	err = s.persist(ctx, user, next, func(tx execer) error {
+		result, err := tracedExec(ctx, tx, "UPDATE transactions SET rolledBack = 1 WHERE id = ? AND rolledBack = 0", t.ReferenceID)
+		if err != nil {
+			return &TransactionError{Err: err}
+		}
+		if count, err := result.RowsAffected(); err != nil || count == 0 {
+			return &RolledBackError{Err: errors.New("Transaction already rolled back")}
+		}
+		_, err = tracedExec(ctx, tx, "INSERT INTO transactions(id, userId, type, amount, bonusAmount, referenceId, balanceBefore, balanceAfter, date, seq, operator) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			t.ID, t.UserID, t.Type, t.Amount, t.BonusAmount, t.ReferenceID, oldBalance, newBalance, time.Now().Unix(), s.nextSeq(), operatorColumn(t.Operator))
+		if err != nil {
+			return &TransactionError{Err: err}
+		}
+		return s.writeBonusRows(ctx, tx, user.ID, t.Operator, wallet.rows)
+	})
+	if err != nil {
+		if isConstraintError(err) {
+			if replayErr := s.checkTransactionReplay(ctx, t); replayErr != nil {
+				return 0, replayErr
+			}
+		}
+		return 0, err
+	}
+
+	statistic := user.statistic
+	statistic.BetCount -= 1
+	statistic.BetSum -= t.Amount
+	statistic.BetBonusSum -= t.BonusAmount
+	statistic.addBonusRows(wallet.rows)
+	return user.Balance, nil
+}
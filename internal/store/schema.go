@@ -1,31 +1,138 @@
 package store
 
+// All amounts are stored as INTEGER minor units (see Money).
+// Ledger rows (deposits, transactions, withdrawals, bonusTransactions) have "seq"
+// column with store wide sequence number, which defines order of balance changes
+// across tables. Cash balance columns of transactions exclude bonusAmount.
+// "operator" columns keep name of the operator whose API key was used for the
+// change, they are NULL for changes made by users and by the store itself.
 const CreateTables string = `
 	CREATE TABLE IF NOT EXISTS "users" (
 		"id"	INTEGER NOT NULL UNIQUE,
-		"balance"	REAL NOT NULL DEFAULT 0,
+		"balance"	INTEGER NOT NULL DEFAULT 0,
+		"bonusBalance"	INTEGER NOT NULL DEFAULT 0,
+		"wageringLeft"	INTEGER NOT NULL DEFAULT 0,
+		"bonusExpiresAt"	INTEGER NOT NULL DEFAULT 0,
+		"status"	TEXT NOT NULL DEFAULT 'active',
+		"statusUntil"	INTEGER NOT NULL DEFAULT 0,
 		PRIMARY KEY("id")
 	);
 	CREATE TABLE IF NOT EXISTS "deposits" (
 		"id"	INTEGER NOT NULL UNIQUE,
 		"userId"	INTEGER NOT NULL,
-		"balanceBefore"	REAL NOT NULL,
-		"balanceAfter"	REAL NOT NULL,
+		"amount"	INTEGER NOT NULL,
+		"balanceBefore"	INTEGER NOT NULL,
+		"balanceAfter"	INTEGER NOT NULL,
 		"date" INTEGER NOT NULL,
+		"seq"	INTEGER NOT NULL DEFAULT 0,
+		"operator"	TEXT,
 		PRIMARY KEY("id")
 	);
 	CREATE TABLE IF NOT EXISTS "transactions" (
 		"id"	INTEGER NOT NULL UNIQUE,
 		"userId"	INTEGER NOT NULL,
 		"type"	TEXT NOT NULL,
-		"amount"	REAL NOT NULL,
-		"balanceBefore"	REAL NOT NULL,
-		"balanceAfter"	REAL NOT NULL,
+		"amount"	INTEGER NOT NULL,
+		"balanceBefore"	INTEGER NOT NULL,
+		"balanceAfter"	INTEGER NOT NULL,
 		"date" INTEGER NOT NULL,
+		"referenceId"	INTEGER,
+		"rolledBack"	INTEGER NOT NULL DEFAULT 0,
+		"seq"	INTEGER NOT NULL DEFAULT 0,
+		"bonusAmount"	INTEGER NOT NULL DEFAULT 0,
+		"operator"	TEXT,
+		PRIMARY KEY("id")
+	);
+	CREATE TABLE IF NOT EXISTS "withdrawals" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"userId"	INTEGER NOT NULL,
+		"amount"	INTEGER NOT NULL,
+		"status"	TEXT NOT NULL,
+		"balanceBefore"	INTEGER NOT NULL,
+		"balanceAfter"	INTEGER NOT NULL,
+		"date" INTEGER NOT NULL,
+		"seq"	INTEGER NOT NULL,
+		"resolvedBalanceBefore"	INTEGER,
+		"resolvedBalanceAfter"	INTEGER,
+		"resolvedDate"	INTEGER,
+		"resolvedSeq"	INTEGER,
+		"operator"	TEXT,
+		"resolvedOperator"	TEXT,
+		PRIMARY KEY("id")
+	);
+	CREATE TABLE IF NOT EXISTS "holds" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"userId"	INTEGER NOT NULL,
+		"amount"	INTEGER NOT NULL,
+		"status"	TEXT NOT NULL,
+		"availableAfter"	INTEGER NOT NULL,
+		"date" INTEGER NOT NULL,
+		"expiresAt"	INTEGER NOT NULL,
+		"transactionId"	INTEGER,
+		"resolvedDate"	INTEGER,
+		"operator"	TEXT,
+		"resolvedOperator"	TEXT,
+		PRIMARY KEY("id")
+	);
+	CREATE TABLE IF NOT EXISTS "bonusTransactions" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"userId"	INTEGER NOT NULL,
+		"type"	TEXT NOT NULL,
+		"referenceId"	INTEGER NOT NULL,
+		"amount"	INTEGER NOT NULL,
+		"bonusBefore"	INTEGER NOT NULL,
+		"bonusAfter"	INTEGER NOT NULL,
+		"wageringAfter"	INTEGER NOT NULL,
+		"balanceBefore"	INTEGER,
+		"balanceAfter"	INTEGER,
+		"date" INTEGER NOT NULL,
+		"seq"	INTEGER NOT NULL,
+		"operator"	TEXT,
+		PRIMARY KEY("id")
+	);
+	CREATE TABLE IF NOT EXISTS "limits" (
+		"userId"	INTEGER NOT NULL,
+		"type"	TEXT NOT NULL,
+		"period"	TEXT NOT NULL,
+		"amount"	INTEGER NOT NULL,
+		"pendingAmount"	INTEGER,
+		"pendingFrom"	INTEGER,
+		PRIMARY KEY("userId", "type", "period")
+	);
+	CREATE TABLE IF NOT EXISTS "sessions" (
+		"tokenHash"	TEXT NOT NULL UNIQUE,
+		"userId"	INTEGER NOT NULL,
+		"date"	INTEGER NOT NULL,
+		"expiresAt"	INTEGER NOT NULL,
+		PRIMARY KEY("tokenHash")
+	);
+	CREATE TABLE IF NOT EXISTS "operators" (
+		"name"	TEXT NOT NULL UNIQUE,
+		"date"	INTEGER NOT NULL,
+		PRIMARY KEY("name")
+	);
+	CREATE TABLE IF NOT EXISTS "apiKeys" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"operator"	TEXT NOT NULL,
+		"keyHash"	TEXT NOT NULL UNIQUE,
+		"prefix"	TEXT NOT NULL,
+		"scopes"	TEXT NOT NULL,
+		"date"	INTEGER NOT NULL,
+		"lastUsedAt"	INTEGER,
+		"revokedAt"	INTEGER,
 		PRIMARY KEY("id")
 	);
 	`
 const CreateIndexes string = `
 	CREATE INDEX IF NOT EXISTS "transactionUserId" ON "transactions" ( "userId" ASC );
 	CREATE INDEX IF NOT EXISTS "depositUserId" ON "deposits" ( "userId" ASC );
+	CREATE INDEX IF NOT EXISTS "transactionUserSeq" ON "transactions" ( "userId" ASC, "seq" ASC );
+	CREATE INDEX IF NOT EXISTS "depositUserSeq" ON "deposits" ( "userId" ASC, "seq" ASC );
+	CREATE INDEX IF NOT EXISTS "transactionUserDate" ON "transactions" ( "userId" ASC, "date" ASC );
+	CREATE INDEX IF NOT EXISTS "depositUserDate" ON "deposits" ( "userId" ASC, "date" ASC );
+	CREATE INDEX IF NOT EXISTS "withdrawalUserSeq" ON "withdrawals" ( "userId" ASC, "seq" ASC );
+	CREATE INDEX IF NOT EXISTS "holdStatusExpires" ON "holds" ( "status" ASC, "expiresAt" ASC );
+	CREATE INDEX IF NOT EXISTS "bonusUserSeq" ON "bonusTransactions" ( "userId" ASC, "seq" ASC );
+	CREATE INDEX IF NOT EXISTS "sessionExpires" ON "sessions" ( "expiresAt" ASC );
+	CREATE UNIQUE INDEX IF NOT EXISTS "bonusGrantId" ON "bonusTransactions" ( "referenceId" ) WHERE "type" = 'Grant';
 `
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Session tokens are random strings given to clients once. Only SHA-256 hash
+// of the token is stored, so database leak doesn't expose valid tokens.
+
+const DefaultTokenTTL = 24 * time.Hour
+
+// Token issued to user
+type Session struct {
+	Token     string    `json:"token"`
+	UserID    uint64    `json:"userId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Authenticated caller of the API, either user with session token
+// or operator with API key
+type Principal struct {
+	// Set for user sessions only
+	UserID uint64
+	// Set for API keys only
+	Operator string
+	APIKeyID uint64
+	Scopes   []Scope
+	// Hash of the session token used for authentication
+	tokenHash string
+}
+
+// Report whether principal is allowed to use routes of scope
+func (p *Principal) HasScope(scope Scope) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Token is missing, unknown, expired or revoked
+type AuthenticationError struct {
+	Err  error
+	Code ErrorCode
+}
+
+func (e *AuthenticationError) Error() string {
+	return fmt.Sprintf("%s", e.Err)
+}
+
+func (e *AuthenticationError) Unwrap() error {
+	return e.Err
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Issue new token for user
+func (s *Store) createSession(ctx context.Context, userID uint64) (*Session, error) {
+	if _, ok := s.users.get(userID); !ok {
+		return nil, &NotFoundError{Err: errors.New("User not found"), Code: CodeUserNotFound}
+	}
+	return s.insertSession(ctx, s.db, userID)
+}
+
+func (s *Store) insertSession(ctx context.Context, tx execer, userID uint64) (*Session, error) {
+	token, err := newToken()
+	// session token must not be taken for API key
+	for err == nil && strings.HasPrefix(token, apiKeyPrefix) {
+		token, err = newToken()
+	}
+	if err != nil {
+		return nil, &InternalError{Message: "Can't generate token", Err: err}
+	}
+	now := time.Now()
+	session := &Session{Token: token, UserID: userID, ExpiresAt: now.Add(s.config.TokenTTL)}
+	_, err = tx.ExecContext(ctx, "INSERT INTO sessions(tokenHash, userId, date, expiresAt) values(?, ?, ?, ?)",
+		hashToken(token), userID, now.Unix(), session.ExpiresAt.Unix())
+	if err != nil {
+		return nil, &InternalError{Message: "Can't save session", Err: err}
+	}
+	return session, nil
+}
+
+// Resolve session token or API key to principal
+func (s *Store) authenticate(ctx context.Context, token string) (*Principal, error) {
+	if token == "" {
+		return nil, &AuthenticationError{Err: errors.New("Token is required")}
+	}
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		return s.authenticateAPIKey(ctx, token)
+	}
+	p := &Principal{Scopes: sessionScopes, tokenHash: hashToken(token)}
+	var expiresAt int64
+	err := s.db.QueryRowContext(ctx, "SELECT userId, expiresAt FROM sessions WHERE tokenHash = ?", p.tokenHash).Scan(&p.UserID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, &AuthenticationError{Err: errors.New("Invalid token")}
+	}
+	if err != nil {
+		return nil, &InternalError{Message: "Can't read session", Err: err}
+	}
+	if time.Now().Unix() >= expiresAt {
+		return nil, &AuthenticationError{Err: errors.New("Token expired"), Code: CodeTokenExpired}
+	}
+	return p, nil
+}
+
+// Replace token of principal with the new one
+func (s *Store) refreshSession(ctx context.Context, p *Principal) (*Session, error) {
+	if p.tokenHash == "" {
+		return nil, &ValidationError{Err: errors.New("Only session tokens can be refreshed"), Code: CodeSessionRequired}
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, &InternalError{Message: "Can't start db transaction", Err: err}
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM sessions WHERE tokenHash = ?", p.tokenHash)
+	if err == nil {
+		err = expectOneRow(result)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, &AuthenticationError{Err: errors.New("Session is already revoked")}
+	}
+	session, err := s.insertSession(ctx, tx, p.UserID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, &InternalError{Message: "Can't commit session", Err: err}
+	}
+	return session, nil
+}
+
+// Invalidate token of principal
+func (s *Store) revokeSession(ctx context.Context, p *Principal) error {
+	if p.tokenHash == "" {
+		return &ValidationError{Err: errors.New("Only session tokens can be revoked"), Code: CodeSessionRequired}
+	}
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE tokenHash = ?", p.tokenHash); err != nil {
+		return &InternalError{Message: "Can't revoke session", Err: err}
+	}
+	return nil
+}
+
+// Remove expired sessions, called by ticker
+func (s *Store) expireSessions() {
+	if _, err := s.db.Exec("DELETE FROM sessions WHERE expiresAt <= ?", time.Now().Unix()); err != nil {
+		s.logger.Error("Can't remove expired sessions: ", err)
+	}
+}
+
+func expectOneRow(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return errors.New("Row not found")
+	}
+	return nil
+}
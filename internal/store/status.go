@@ -0,0 +1,125 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Account status restricts operations which bring money into play.
+// Wins, rollbacks and captures of already authorized holds are always allowed,
+// so rounds opened before status change can be settled.
+//
+//	active         everything is allowed
+//	frozen         deposits, bets, bonuses and withdrawals are refused
+//	self_excluded  deposits, bets and bonuses are refused until StatusUntil
+//	closed         deposits, bets and bonuses are refused, final status
+type AccountStatus string
+
+const (
+	StatusActive       AccountStatus = "active"
+	StatusFrozen       AccountStatus = "frozen"
+	StatusSelfExcluded AccountStatus = "self_excluded"
+	StatusClosed       AccountStatus = "closed"
+)
+
+// Request to change account status
+type StatusChange struct {
+	UserID uint64        `json:"userId"`
+	Status AccountStatus `json:"status"`
+	// End of self-exclusion, required for StatusSelfExcluded
+	Until time.Time `json:"until"`
+	// Change is made by operator, not by the user
+	Admin bool `json:"-"`
+}
+
+// Operations restricted by account status
+type accountOperation string
+
+const (
+	operationDeposit    accountOperation = "deposit"
+	operationBet        accountOperation = "bet"
+	operationBonus      accountOperation = "bonus"
+	operationWithdrawal accountOperation = "withdrawal"
+)
+
+// Status in effect at the moment, self-exclusion ends automatically
+func (u *User) statusAt(now time.Time) AccountStatus {
+	if u.Status == StatusSelfExcluded && !now.Before(u.StatusUntil) {
+		return StatusActive
+	}
+	if u.Status == "" {
+		return StatusActive
+	}
+	return u.Status
+}
+
+// Return error when account status doesn't allow operation. Must be called under user lock.
+func (u *User) checkStatus(operation accountOperation) error {
+	switch u.statusAt(time.Now()) {
+	case StatusFrozen:
+		return &AccountFrozenError{Err: fmt.Errorf("Account is frozen, %s is not allowed", operation)}
+	case StatusSelfExcluded:
+		if operation != operationWithdrawal {
+			return &SelfExcludedError{
+				Err:   fmt.Errorf("Account is self-excluded until %s", u.StatusUntil.UTC().Format(time.RFC3339)),
+				Until: u.StatusUntil,
+			}
+		}
+	case StatusClosed:
+		if operation != operationWithdrawal {
+			return &AccountClosedError{Err: fmt.Errorf("Account is closed, %s is not allowed", operation)}
+		}
+	}
+	return nil
+}
+
+// Change account status. Users can only self-exclude, extend self-exclusion or
+// close account, any other change requires operator. Closed account can't be reopened.
+func (s *Store) setAccountStatus(ctx context.Context, c *StatusChange) (*User, error) {
+	switch c.Status {
+	case StatusActive, StatusFrozen, StatusClosed:
+		c.Until = time.Time{}
+	case StatusSelfExcluded:
+		if !c.Until.After(time.Now()) {
+			return nil, &ValidationError{Err: errors.New("Self-exclusion end date must be in the future"), Field: "until"}
+		}
+	default:
+		return nil, &ValidationError{Err: errors.New("Invalid account status"), Field: "status"}
+	}
+	user, ok := s.users.get(c.UserID)
+	if !ok {
+		return nil, &NotFoundError{Err: errors.New("User not found"), Code: CodeUserNotFound}
+	}
+	if err := lockUser(ctx, user); err != nil {
+		return nil, err
+	}
+	defer user.Unlock()
+	current := user.statusAt(time.Now())
+	if current == StatusClosed && c.Status != StatusClosed {
+		return nil, &StateError{Err: errors.New("Account is closed")}
+	}
+	if !c.Admin {
+		switch {
+		case c.Status != StatusSelfExcluded && c.Status != StatusClosed:
+			return nil, &ValidationError{Err: fmt.Errorf("Status %s can be set only by operator", c.Status), Code: CodeStatusNotAllowed, Field: "status"}
+		case current == StatusFrozen:
+			return nil, &StateError{Err: errors.New("Account is frozen")}
+		case c.Status == StatusSelfExcluded && current == StatusSelfExcluded && c.Until.Before(user.StatusUntil):
+			return nil, &StateError{Err: errors.New("Self-exclusion can't be shortened")}
+		}
+	}
+	var until int64
+	if !c.Until.IsZero() {
+		until = c.Until.Unix()
+	}
+	if _, err := s.db.ExecContext(ctx, "UPDATE users SET status = ?, statusUntil = ? WHERE id = ?", c.Status, until, c.UserID); err != nil {
+		return nil, &InternalError{Message: "Can't update account status", Err: err}
+	}
+	LoggerFrom(ctx, s.logger).Infof("Account status of user %d changed from %s to %s (admin: %t)", user.ID, current, c.Status, c.Admin)
+	user.Status = c.Status
+	user.StatusUntil = c.Until
+	snapshot, _ := user.snapshot()
+	return snapshot, nil
+}
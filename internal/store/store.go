@@ -6,6 +6,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -13,18 +14,74 @@ import (
 )
 
 type Store struct {
-	logger        *logrus.Logger
-	db            *sql.DB
-	users         map[uint64]*User
-	userStatistic map[uint64]*Statistic
+	// last used ledger sequence number, see nextSeq.
+	// First field to keep 64-bit alignment for atomic operations.
+	seq    int64
+	logger *logrus.Logger
+	config Config
+	db     *sql.DB
+	users  *userCache
+	health health
+	// closed by Close to stop the ticker, which closes tickerDone on exit
+	stop       chan struct{}
+	tickerDone chan struct{}
+	closeOnce  sync.Once
+	closeErr   error
 	// pendingActions PendingActions
 }
 
+type Config struct {
+	// Path to sqlite database file
+	DBName string
+	// Defaults to WriteBehind
+	Persistence PersistenceMode
+	// What to do with balances which disagree with ledger at startup.
+	// Defaults to RecoveryRepair
+	Recovery RecoveryPolicy
+	// Authorized holds are released automatically after this time.
+	// Defaults to DefaultHoldTTL
+	HoldTTL time.Duration
+	// Wagering requirement as multiplier of granted bonus.
+	// Defaults to DefaultBonusWagering
+	BonusWagering int
+	// Defaults to CashFirst
+	BonusBetOrder BonusBetOrder
+	// Defaults to DefaultBonusTTL
+	BonusTTL time.Duration
+	// Delay before increased or removed limit takes effect.
+	// Defaults to DefaultLimitCoolingOff
+	LimitCoolingOff time.Duration
+	// Lifetime of session tokens. Defaults to DefaultTokenTTL
+	TokenTTL time.Duration
+	// Period of write-behind flush and expiration tasks.
+	// Defaults to DefaultFlushInterval
+	FlushInterval time.Duration
+}
+
+const DefaultFlushInterval = 10 * time.Second
+
 type StoreHandler interface {
-	GetUser(userID uint64) (*User, *Statistic, error)
-	CreateUser(user *User) error
-	CreateDeposit(d *Deposit) (float32, error)
-	CreateTransaction(t *Transaction) (float32, error)
+	GetUser(ctx context.Context, userID uint64) (*User, *Statistic, error)
+	CreateUser(ctx context.Context, user *User) error
+	CreateDeposit(ctx context.Context, d *Deposit) (Money, error)
+	CreateTransaction(ctx context.Context, t *Transaction) (Money, error)
+	GetHistory(ctx context.Context, q *HistoryQuery) ([]LedgerEntry, string, error)
+	CreateWithdrawal(ctx context.Context, w *Withdrawal) (Money, error)
+	ApproveWithdrawal(ctx context.Context, id uint64, operator string) (*Withdrawal, error)
+	RejectWithdrawal(ctx context.Context, id uint64, operator string) (*Withdrawal, error)
+	AuthorizeHold(ctx context.Context, h *Hold) (Money, error)
+	CaptureHold(ctx context.Context, h *Hold) (Money, error)
+	ReleaseHold(ctx context.Context, h *Hold) (Money, error)
+	GrantBonus(ctx context.Context, b *Bonus) (Money, error)
+	GetLimits(ctx context.Context, userID uint64) ([]Limit, error)
+	SetLimit(ctx context.Context, l *Limit) (*Limit, error)
+	SetAccountStatus(ctx context.Context, c *StatusChange) (*User, error)
+	CreateSession(ctx context.Context, userID uint64) (*Session, error)
+	Authenticate(ctx context.Context, token string) (*Principal, error)
+	RefreshSession(ctx context.Context, p *Principal) (*Session, error)
+	RevokeSession(ctx context.Context, p *Principal) error
+	CheckHealth(ctx context.Context) []HealthCheck
+	Close(ctx context.Context) error
 }
 
 type TransactionError struct {
@@ -40,7 +97,8 @@ func (e *TransactionError) Unwrap() error {
 }
 
 type NotFoundError struct {
-	Err error
+	Err  error
+	Code ErrorCode
 }
 
 func (e *NotFoundError) Error() string {
@@ -52,7 +110,10 @@ func (e *NotFoundError) Unwrap() error {
 }
 
 type ValidationError struct {
-	Err error
+	Err  error
+	Code ErrorCode
+	// Request field which failed validation, if any
+	Field string
 }
 
 func (e *ValidationError) Error() string {
@@ -76,133 +137,326 @@ func (e *InternalError) Unwrap() error {
 	return e.Err
 }
 
-func New(ctx context.Context, logger *logrus.Logger, dbName string) StoreHandler {
-	s := &Store{logger: logger}
-	s.init(ctx, dbName)
+// Operation with the same ID and payload was already applied.
+// Balance contains the balance which original operation responded with:
+// available balance for holds, bonus balance for bonuses and cash balance for others.
+type DuplicateError struct {
+	Balance Money
+}
+
+func (e *DuplicateError) Error() string {
+	return "Operation already processed"
+}
+
+// Transaction was already rolled back by another rollback transaction
+type RolledBackError struct {
+	Err error
+}
+
+func (e *RolledBackError) Error() string {
+	return fmt.Sprintf("%s", e.Err)
+}
+
+func (e *RolledBackError) Unwrap() error {
+	return e.Err
+}
+
+// Operation is not allowed in the current state of the object
+type StateError struct {
+	Err  error
+	Code ErrorCode
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("%s", e.Err)
+}
+
+func (e *StateError) Unwrap() error {
+	return e.Err
+}
+
+// Operation would exceed responsible gaming limit of the user
+type LimitError struct {
+	Err error
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s", e.Err)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// Account is frozen by operator
+type AccountFrozenError struct {
+	Err error
+}
+
+func (e *AccountFrozenError) Error() string {
+	return fmt.Sprintf("%s", e.Err)
+}
+
+func (e *AccountFrozenError) Unwrap() error {
+	return e.Err
+}
+
+// Account is self-excluded from gambling until the date
+type SelfExcludedError struct {
+	Err   error
+	Until time.Time
+}
+
+func (e *SelfExcludedError) Error() string {
+	return fmt.Sprintf("%s", e.Err)
+}
+
+func (e *SelfExcludedError) Unwrap() error {
+	return e.Err
+}
+
+type AccountClosedError struct {
+	Err error
+}
+
+func (e *AccountClosedError) Error() string {
+	return fmt.Sprintf("%s", e.Err)
+}
+
+func (e *AccountClosedError) Unwrap() error {
+	return e.Err
+}
+
+// Operation ID is already used by operation with different payload
+type ConflictError struct {
+	Err error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s", e.Err)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// Context of operation was cancelled or its deadline exceeded while operation
+// waited for user lock or database. Err is context.Canceled or context.DeadlineExceeded.
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Operation aborted: %s", e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Open database, load cache and start periodic tasks. Store must be closed with Close.
+func New(logger *logrus.Logger, config Config) StoreHandler {
+	if config.Persistence == "" {
+		config.Persistence = WriteBehind
+	}
+	if config.Recovery == "" {
+		config.Recovery = RecoveryRepair
+	}
+	if config.HoldTTL == 0 {
+		config.HoldTTL = DefaultHoldTTL
+	}
+	if config.BonusWagering == 0 {
+		config.BonusWagering = DefaultBonusWagering
+	}
+	if config.BonusBetOrder == "" {
+		config.BonusBetOrder = CashFirst
+	}
+	if config.BonusTTL == 0 {
+		config.BonusTTL = DefaultBonusTTL
+	}
+	if config.LimitCoolingOff == 0 {
+		config.LimitCoolingOff = DefaultLimitCoolingOff
+	}
+	if config.TokenTTL == 0 {
+		config.TokenTTL = DefaultTokenTTL
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = DefaultFlushInterval
+	}
+	s := &Store{logger: logger, config: config, stop: make(chan struct{}), tickerDone: make(chan struct{})}
+	s.init()
 	return s
 }
 
-func (s *Store) init(ctx context.Context, dbName string) {
+func (s *Store) init() {
 	var err error
-	s.db, err = sql.Open("sqlite3", dbName)
+	s.db, err = sql.Open("sqlite3", s.config.DBName)
 	if err != nil {
 		s.logger.Fatal("Can't open database: ", err)
 	}
-	_, err = s.db.Exec(CreateTables)
-	if err != nil {
-		s.logger.Fatal("Can't create tables: ", err)
+	if err = s.initSchema(); err != nil {
+		s.logger.Fatal(err)
 	}
-	_, err = s.db.Exec(CreateIndexes)
-	if err != nil {
-		s.logger.Fatal("Can't create indexes: ", err)
+	if err = s.initSeq(); err != nil {
+		s.logger.Fatal(err)
+	}
+	if err = s.recoverBalances(); err != nil {
+		s.logger.Fatal(err)
 	}
 
 	s.initCache()
+	s.health.setCacheLoaded()
+	s.logger.Infof("Store started in %s mode", s.config.Persistence)
 
 	// start ticker for periodic tasks
-	go s.startTicker(ctx)
+	go s.startTicker()
+}
 
-	go func() {
-		// Listen for context done signal and close connection
-		<-ctx.Done()
-		err := s.db.Close()
-		if err != nil {
-			s.logger.Error("Can't close database: ", err)
-			return
+// Stop the ticker, flush balances of updated users and close database.
+// Waiting for the ticker and for locks of users being flushed is limited by ctx.
+// Database is closed even when flush fails, balances are recovered from ledger on
+// the next start then. Store must not be used after Close, repeated calls return
+// result of the first one.
+func (s *Store) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.close(ctx)
+	})
+	return s.closeErr
+}
+
+func (s *Store) close(ctx context.Context) error {
+	close(s.stop)
+	var flushErr error
+	select {
+	case <-s.tickerDone:
+		if flushErr = s.saveUpdatedUsers(ctx); flushErr != nil {
+			flushErr = contextError(ctx, &InternalError{Message: "Can't flush updated users", Err: flushErr})
 		}
-		s.logger.Info("Database connection closed")
-	}()
+	case <-ctx.Done():
+		flushErr = &TimeoutError{Err: ctx.Err()}
+	}
+	if err := s.db.Close(); err != nil {
+		LoggerFrom(ctx, s.logger).Error("Can't close database: ", err)
+		if flushErr == nil {
+			return &InternalError{Message: "Can't close database", Err: err}
+		}
+	} else {
+		LoggerFrom(ctx, s.logger).Info("Database connection closed")
+	}
+	return flushErr
 }
 
-func (s *Store) startTicker(ctx context.Context) {
-	ticker := time.NewTicker(10 * time.Second)
-	func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				s.saveUpdatedUsers()
-			}
+func (s *Store) startTicker() {
+	defer close(s.tickerDone)
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			s.logger.Info("Ticker stopped")
+			return
+		case <-ticker.C:
+			s.expireHolds()
+			s.expireBonuses()
+			s.expireSessions()
+			s.saveUpdatedUsers(context.Background())
 		}
-	}()
-	ticker.Stop()
-	s.saveUpdatedUsers()
-	s.logger.Info("Ticker stopped")
+	}
 }
 
-func (s *Store) saveUpdatedUsers() {
-	for _, user := range s.users {
-		if user.Updated {
-			user.Lock()
-			stmt, err := s.db.Prepare("UPDATE users SET balance = ? WHERE id = ?")
-			if err != nil {
-				s.logger.Errorf("Can't prepare update statement: %+v", user)
-				continue
-			}
-			if _, err = stmt.Exec(user.Balance, user.ID); err != nil {
-				s.logger.Errorf("Can't update user: %+v", user)
-				continue
-			}
-			s.logger.Info("Save updated user: ", user.ID)
+// Write balances of updated users to users table, waiting for user locks is limited by ctx.
+// Returns the last error, users which failed are saved by the next flush.
+func (s *Store) saveUpdatedUsers(ctx context.Context) error {
+	start := time.Now()
+	var flushErr error
+	defer func() {
+		flushDuration.Observe(time.Since(start).Seconds())
+		s.health.flushed(flushErr)
+	}()
+	logger := LoggerFrom(ctx, s.logger)
+	for _, user := range s.users.all() {
+		// Updated is changed by operations under user lock
+		if err := user.LockContext(ctx); err != nil {
+			flushErr = err
+			break
+		}
+		if !user.Updated {
+			user.Unlock()
+			continue
+		}
+		if err := updateUserBalance(ctx, s.db, user.ID, user.state()); err != nil {
+			logger.Errorf("Can't update user %d: %s", user.ID, err)
+			countSQLiteError("flush", err)
+			flushErr = err
 			user.Unlock()
+			continue
 		}
+		user.Updated = false
+		dirtyUsers.Dec()
+		logger.Info("Save updated user: ", user.ID)
+		user.Unlock()
 	}
+	return flushErr
 }
+
 func (s *Store) initCache() {
-	// init users list
-	s.users = make(map[uint64]*User)
-	userRows, err := s.db.Query("SELECT * FROM users")
+	// init users list, cache is filled before the store is used concurrently
+	s.users = newUserCache()
+	userRows, err := s.db.Query("SELECT id, balance, bonusBalance, wageringLeft, bonusExpiresAt, status, statusUntil FROM users")
 	if err != nil {
 		s.logger.Fatal("Can't load cached users: ", err)
 	}
 	defer userRows.Close()
 	for userRows.Next() {
-		var id uint64
-		var balance float32
-		err = userRows.Scan(&id, &balance)
+		user := &User{}
+		var bonusExpiresAt, statusUntil int64
+		err = userRows.Scan(&user.ID, &user.Balance, &user.Bonus, &user.WageringLeft, &bonusExpiresAt, &user.Status, &statusUntil)
 		if err != nil {
 			s.logger.Fatal("Can't read user from db: ", err)
 		}
-		s.users[id] = &User{
-			ID:      id,
-			Balance: balance,
+		if bonusExpiresAt > 0 {
+			user.BonusExpiresAt = time.Unix(bonusExpiresAt, 0)
 		}
+		if statusUntil > 0 {
+			user.StatusUntil = time.Unix(statusUntil, 0)
+		}
+		s.users.add(user)
 	}
+	cachedUsers.Set(float64(s.users.len()))
+	dirtyUsers.Set(0)
 	// init users statistic
-	s.userStatistic = make(map[uint64]*Statistic)
-	for _, user := range s.users {
-		depositRows, err := s.db.Query(fmt.Sprintf("SELECT balanceBefore, balanceAfter FROM deposits WHERE userId=%d", user.ID))
+	for _, user := range s.users.all() {
+		depositRows, err := s.db.Query(fmt.Sprintf("SELECT amount FROM deposits WHERE userId=%d", user.ID))
 		if err != nil {
 			s.logger.Fatal("Can't read deposits: ", err)
 		}
 		defer depositRows.Close()
 		var depositCount int
-		var depositSum float32
+		var depositSum Money
 		for depositRows.Next() {
-			var balanceBefore float32
-			var balanceAfter float32
-			err = depositRows.Scan(&balanceBefore, &balanceAfter)
+			var amount Money
+			err = depositRows.Scan(&amount)
 			if err != nil {
 				s.logger.Fatal("Can't read deposits: ", err)
 			}
 			depositCount += 1
-			depositSum += balanceAfter - balanceBefore
+			depositSum += amount
 		}
 
-		transactionRows, err := s.db.Query(fmt.Sprintf("SELECT type, amount FROM transactions WHERE userId=%d", user.ID))
+		// rolled back bets are excluded from statistic
+		transactionRows, err := s.db.Query(fmt.Sprintf("SELECT type, amount, bonusAmount FROM transactions WHERE userId=%d AND rolledBack=0", user.ID))
 		if err != nil {
 			s.logger.Fatal("Can't read transitions: ", err)
 		}
 		defer transactionRows.Close()
 		var betCount int
 		var winCount int
-		var betSum float32
-		var winSum float32
+		var betSum, betBonusSum Money
+		var winSum, winBonusSum Money
 		for transactionRows.Next() {
 			var transactionType TransactionType
-			var amount float32
-			err = transactionRows.Scan(&transactionType, &amount)
+			var amount, bonusAmount Money
+			err = transactionRows.Scan(&transactionType, &amount, &bonusAmount)
 			if err != nil {
 				s.logger.Fatal("Can't read transactions: ", err)
 			}
@@ -210,14 +464,17 @@ func (s *Store) initCache() {
 			case Bet:
 				betCount += 1
 				betSum += amount
+				betBonusSum += bonusAmount
 			case Win:
 				winCount += 1
 				winSum += amount
+				winBonusSum += bonusAmount
+			case Rollback:
 			default:
 				s.logger.Warn("Unexpected transaction type: ", transactionType)
 			}
 		}
-		s.userStatistic[user.ID] = &Statistic{
+		statistic := &Statistic{
 			UserID:        user.ID,
 			DepositeCount: depositCount,
 			DepositSum:    depositSum,
@@ -225,125 +482,208 @@ func (s *Store) initCache() {
 			BetSum:        betSum,
 			WinCount:      winCount,
 			WinSum:        winSum,
+			BetBonusSum:   betBonusSum,
+			WinBonusSum:   winBonusSum,
+		}
+		if err = s.loadWithdrawalStatistic(statistic); err != nil {
+			s.logger.Fatal("Can't read withdrawals: ", err)
+		}
+		if err = s.loadBonusStatistic(statistic); err != nil {
+			s.logger.Fatal("Can't read bonus transactions: ", err)
+		}
+		user.statistic = statistic
+		if user.Reserved, err = s.loadReserved(user.ID); err != nil {
+			s.logger.Fatal("Can't read holds: ", err)
 		}
 	}
 }
 
 // Create new user or return error
-func (s *Store) CreateUser(user *User) error {
+func (s *Store) createUser(ctx context.Context, user *User) error {
 	// check, is user already exists
-	if _, ok := s.users[user.ID]; ok {
-		return &ValidationError{errors.New("User already exists")}
+	if _, ok := s.users.get(user.ID); ok {
+		return &ValidationError{Err: errors.New("User already exists"), Code: CodeUserExists, Field: "id"}
 	}
 	// check balance
 	if user.Balance < 0 {
-		return &ValidationError{errors.New("User balance may not be negative")}
+		return &ValidationError{Err: errors.New("User balance may not be negative"), Field: "balance"}
 	}
-	stmt, err := s.db.Prepare("INSERT INTO users(id, balance) values(?, ?)")
+	stmt, err := s.db.PrepareContext(ctx, "INSERT INTO users(id, balance) values(?, ?)")
 	if err != nil {
 		return &InternalError{Message: "Error when creating db statement", Err: err}
 	}
-	if _, err = stmt.Exec(user.ID, user.Balance); err != nil {
+	_, err = stmt.ExecContext(ctx, user.ID, user.Balance)
+	if isConstraintError(err) {
+		// concurrent request with the same id was applied first
+		stmt.Close()
+		return &ValidationError{Err: errors.New("User already exists"), Code: CodeUserExists, Field: "id"}
+	}
+	if err != nil {
+		stmt.Close()
 		return &InternalError{Message: "Error executing insert user db request", Err: err}
 	}
-	// add user to cache
+	// add user to cache, user is not shared until it is added
+	user.Status = StatusActive
+	user.StatusUntil = time.Time{}
 	user.Updated = true
-	s.users[user.ID] = user
-	s.userStatistic[user.ID] = &Statistic{UserID: user.ID}
+	user.statistic = &Statistic{UserID: user.ID}
+	if !s.users.add(user) {
+		stmt.Close()
+		return &ValidationError{Err: errors.New("User already exists"), Code: CodeUserExists, Field: "id"}
+	}
+	cachedUsers.Inc()
+	dirtyUsers.Inc()
 	if err = stmt.Close(); err != nil {
 		return &InternalError{Message: "Error when close db statement", Err: err}
 	}
 	return nil
 }
 
-func (s *Store) GetUser(userID uint64) (*User, *Statistic, error) {
-	user, ok := s.users[userID]
+// Return copies of user and statistic, balance and statistic are consistent with each other
+func (s *Store) getUser(ctx context.Context, userID uint64) (*User, *Statistic, error) {
+	user, ok := s.users.get(userID)
 	if !ok {
-		return nil, nil, &NotFoundError{Err: errors.New("User not found")}
+		return nil, nil, &NotFoundError{Err: errors.New("User not found"), Code: CodeUserNotFound}
 	}
-	statistic, ok := s.userStatistic[userID]
-	if !ok {
-		s.logger.Warn("Not found statistic for user ", userID)
-		return nil, nil, &NotFoundError{Err: errors.New("User not found")}
+	if err := lockUser(ctx, user); err != nil {
+		return nil, nil, err
 	}
-	return user, statistic, nil
+	defer user.Unlock()
+	snapshot, statistic := user.snapshot()
+	return snapshot, statistic, nil
 }
 
-func (s *Store) CreateDeposit(d *Deposit) (float32, error) {
-	if d.Amount == 0 {
-		return 0, &ValidationError{errors.New("Deposit amount may be greater then zero")}
+func (s *Store) createDeposit(ctx context.Context, d *Deposit) (Money, error) {
+	if d.Amount <= 0 {
+		return 0, &ValidationError{Err: errors.New("Deposit amount may be greater then zero"), Field: "amount"}
 	}
-	user, ok := s.users[d.UserID]
+	user, ok := s.users.get(d.UserID)
 	if !ok {
-		return 0, &NotFoundError{errors.New("User not found")}
+		return 0, &NotFoundError{Err: errors.New("User not found"), Code: CodeUserNotFound}
 	}
-	stmt, err := s.db.Prepare("INSERT INTO deposits(id, userId, balanceBefore, balanceAfter, date) values(?, ?, ?, ?, ?)")
-	if err != nil {
-		return 0, &InternalError{Message: "Error when creating db statement", Err: err}
+	if err := s.checkDepositReplay(ctx, d); err != nil {
+		return 0, err
+	}
+	if err := lockUser(ctx, user); err != nil {
+		return 0, err
+	}
+	if err := user.checkStatus(operationDeposit); err != nil {
+		user.Unlock()
+		return 0, err
+	}
+	if err := s.checkLimits(ctx, user.ID, DepositType, d.Amount); err != nil {
+		user.Unlock()
+		return 0, err
 	}
-	user.Lock()
 	oldBalance := user.Balance
 	newBalance := oldBalance + d.Amount
-	if _, err = stmt.Exec(d.ID, d.UserID, oldBalance, newBalance, time.Now().Unix()); err != nil {
+	next := user.state()
+	next.Balance = newBalance
+	err := s.persist(ctx, user, next, func(tx execer) error {
+		_, err := tracedExec(ctx, tx, "INSERT INTO deposits(id, userId, amount, balanceBefore, balanceAfter, date, seq, operator) values(?, ?, ?, ?, ?, ?, ?, ?)",
+			d.ID, d.UserID, d.Amount, oldBalance, newBalance, time.Now().Unix(), s.nextSeq(), operatorColumn(d.Operator))
+		if err != nil {
+			return &TransactionError{Err: err}
+		}
+		return nil
+	})
+	if err != nil {
 		user.Unlock()
-		return 0, &TransactionError{Err: err}
-	}
-	user.Balance = newBalance
-	statistic, ok := s.userStatistic[d.UserID]
-	if ok {
-		statistic.DepositeCount += 1
-		statistic.DepositSum += d.Amount
+		if isConstraintError(err) {
+			// concurrent request with the same id was applied first
+			if replayErr := s.checkDepositReplay(ctx, d); replayErr != nil {
+				return 0, replayErr
+			}
+		}
+		return 0, err
 	}
-	user.Updated = true
+	statistic := user.statistic
+	statistic.DepositeCount += 1
+	statistic.DepositSum += d.Amount
 	user.Unlock()
 	return newBalance, nil
 }
 
-func (s *Store) CreateTransaction(t *Transaction) (float32, error) {
+func (s *Store) createTransaction(ctx context.Context, t *Transaction) (Money, error) {
+	if t.Type == Rollback {
+		return s.createRollback(ctx, t)
+	}
 	if t.Amount <= 0 {
-		return 0, &ValidationError{Err: errors.New("Amount must be grater than 0")}
+		return 0, &ValidationError{Err: errors.New("Amount must be grater than 0"), Field: "amount"}
+	}
+	if t.Type != Bet && t.Type != Win {
+		return 0, &ValidationError{Err: errors.New("Invalid transaction type"), Field: "type"}
 	}
-	user, ok := s.users[t.UserID]
+	user, ok := s.users.get(t.UserID)
 	if !ok {
-		return 0, &NotFoundError{errors.New("User not found")}
+		return 0, &NotFoundError{Err: errors.New("User not found"), Code: CodeUserNotFound}
 	}
-	oldBalance := user.Balance
-	var newBalance float32
+	if err := s.checkTransactionReplay(ctx, t); err != nil {
+		return 0, err
+	}
+
+	// bonus wallet state is needed to split the amount, so it is calculated under the lock
+	if err := lockUser(ctx, user); err != nil {
+		return 0, err
+	}
+	defer user.Unlock()
+	next := user.state()
+	wallet := newBonusWallet(&next)
+	oldBalance := next.Balance
 	switch t.Type {
 	case Bet:
+		// wins are credited regardless of account status to settle open rounds
+		if err := user.checkStatus(operationBet); err != nil {
+			return 0, err
+		}
+		if err := s.checkLimits(ctx, user.ID, Bet, t.Amount); err != nil {
+			return 0, err
+		}
 		// chek, is user has funds for this operation
-		newBalance = oldBalance - t.Amount
-		if newBalance < 0 {
-			return 0, &ValidationError{Err: errors.New("User doesn't have anough funds")}
+		cashPart, bonusPart, ok := s.splitBet(user, &next, t.Amount)
+		if !ok {
+			return 0, &ValidationError{Err: errors.New("User doesn't have anough funds"), Code: CodeInsufficientFunds}
 		}
+		t.BonusAmount = bonusPart
+		next.Balance -= cashPart
 	case Win:
-		newBalance = oldBalance + t.Amount
-	default:
-		return 0, &ValidationError{Err: errors.New("Invalid transaction type")}
+		t.BonusAmount = wallet.win(t.ID, t.Amount)
+		next.Balance += t.Amount - t.BonusAmount
+	}
+	// cash balance right after transaction, bonus conversion is recorded separately
+	newBalance := next.Balance
+	if t.Type == Bet {
+		wallet.bet(t.ID, t.BonusAmount, t.Amount)
 	}
 
-	stmt, err := s.db.Prepare("INSERT INTO transactions(id, userId, type, amount, balanceBefore, balanceAfter, date) values(?, ?, ?, ?, ?, ?, ?)")
+	err := s.persist(ctx, user, next, func(tx execer) error {
+		_, err := tracedExec(ctx, tx, "INSERT INTO transactions(id, userId, type, amount, bonusAmount, balanceBefore, balanceAfter, date, seq, operator) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			t.ID, t.UserID, t.Type, t.Amount, t.BonusAmount, oldBalance, newBalance, time.Now().Unix(), s.nextSeq(), operatorColumn(t.Operator))
+		if err != nil {
+			return &TransactionError{Err: err}
+		}
+		return s.writeBonusRows(ctx, tx, user.ID, t.Operator, wallet.rows)
+	})
 	if err != nil {
-		return 0, &InternalError{Message: "Error when creating db statement", Err: err}
-	}
-	user.Lock()
-	if _, err = stmt.Exec(t.ID, t.UserID, t.Type, t.Amount, oldBalance, newBalance, time.Now().Unix()); err != nil {
-		user.Unlock()
-		return 0, &TransactionError{Err: err}
-	}
-	user.Balance = newBalance
-	statistic, ok := s.userStatistic[t.UserID]
-	if ok {
-		switch t.Type {
-		case Bet:
-			statistic.BetCount += 1
-			statistic.BetSum += t.Amount
-		case Win:
-			statistic.WinCount += 1
-			statistic.WinSum += t.Amount
+		if isConstraintError(err) {
+			// concurrent request with the same id was applied first
+			if replayErr := s.checkTransactionReplay(ctx, t); replayErr != nil {
+				return 0, replayErr
+			}
 		}
+		return 0, err
 	}
-	user.Updated = true
-	user.Unlock()
-	return newBalance, nil
+	statistic := user.statistic
+	switch t.Type {
+	case Bet:
+		statistic.BetCount += 1
+		statistic.BetSum += t.Amount
+		statistic.BetBonusSum += t.BonusAmount
+	case Win:
+		statistic.WinCount += 1
+		statistic.WinSum += t.Amount
+		statistic.WinBonusSum += t.BonusAmount
+	}
+	statistic.addBonusRows(wallet.rows)
+	return user.Balance, nil
 }
@@ -1,6 +1,1142 @@
 package store
 
-// TODO implement store tests
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
 
-// Test ValidationError
-// Test constraints
+	"github.com/dehimb/cake/internal/trace"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Create store backed by temporary database file
+func newTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "cake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return openTestStore(t, Config{DBName: filepath.Join(dir, "test.db")}, func() { os.RemoveAll(dir) })
+}
+
+func openTestStore(t *testing.T, config Config, cleanup func()) (*Store, func()) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	s := New(logger, config).(*Store)
+	return s, func() {
+		s.Close(context.Background())
+		if cleanup != nil {
+			cleanup()
+		}
+	}
+}
+
+// Cached user which must be present in store
+func cachedUser(s *Store, userID uint64) *User {
+	user, ok := s.users.get(userID)
+	if !ok {
+		panic("user is not cached")
+	}
+	return user
+}
+
+func TestCreateDeposit(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1}))
+	for i := 1; i <= 1000; i++ {
+		_, err := s.CreateDeposit(context.Background(), &Deposit{ID: uint64(i), UserID: 1, Amount: 10})
+		assert.NoError(t, err)
+	}
+	user, statistic, err := s.GetUser(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, Money(10000), user.Balance)
+	assert.Equal(t, Money(10000), statistic.DepositSum)
+
+	var validationError *ValidationError
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 5000, UserID: 1, Amount: 0})
+	assert.True(t, errors.As(err, &validationError))
+	var notFoundError *NotFoundError
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 5001, UserID: 2, Amount: 10})
+	assert.True(t, errors.As(err, &notFoundError))
+}
+
+func TestCreateTransaction(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1, Balance: 1000}))
+	balance, err := s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 250})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(750), balance)
+	balance, err = s.CreateTransaction(context.Background(), &Transaction{ID: 2, UserID: 1, Type: Win, Amount: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(751), balance)
+
+	var validationError *ValidationError
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 3, UserID: 1, Type: Bet, Amount: 752})
+	assert.True(t, errors.As(err, &validationError))
+	assert.Equal(t, CodeInsufficientFunds, CodeOf(err))
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 4, UserID: 1, Type: "Unknown", Amount: 1})
+	assert.True(t, errors.As(err, &validationError))
+	assert.Equal(t, CodeInvalidField, CodeOf(err))
+	assert.Equal(t, "type", validationError.Field)
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 5, UserID: 2, Type: Bet, Amount: 1})
+	assert.Equal(t, CodeUserNotFound, CodeOf(err))
+	assert.Equal(t, CodeInternal, CodeOf(errors.New("unknown")))
+
+	_, statistic, _ := s.GetUser(context.Background(), 1)
+	assert.Equal(t, 1, statistic.BetCount)
+	assert.Equal(t, Money(250), statistic.BetSum)
+	assert.Equal(t, 1, statistic.WinCount)
+	assert.Equal(t, Money(1), statistic.WinSum)
+}
+
+func TestMetrics(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	betsOk := operationsTotal.Value("bet", "ok")
+	betsFailed := operationsTotal.Value("bet", string(CodeInsufficientFunds))
+	duplicates := operationsTotal.Value("deposit", string(CodeAlreadyProcessed))
+	flushes := flushDuration.Count()
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1, Balance: 100}))
+	_, err := s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 10})
+	assert.NoError(t, err)
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 2, UserID: 1, Type: Bet, Amount: 1000})
+	assert.Error(t, err)
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 1, UserID: 1, Amount: 10})
+	assert.NoError(t, err)
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 1, UserID: 1, Amount: 10})
+	assert.Error(t, err)
+	s.saveUpdatedUsers(context.Background())
+
+	assert.Equal(t, betsOk+1, operationsTotal.Value("bet", "ok"))
+	assert.Equal(t, betsFailed+1, operationsTotal.Value("bet", string(CodeInsufficientFunds)))
+	assert.Equal(t, duplicates+1, operationsTotal.Value("deposit", string(CodeAlreadyProcessed)))
+	assert.True(t, operationDuration.Count("bet") >= 2)
+	assert.Equal(t, flushes+1, flushDuration.Count())
+	assert.False(t, cachedUser(s, 1).Updated)
+}
+
+func TestMigrateMoneyToMinorUnits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbName := filepath.Join(dir, "legacy.db")
+
+	// Database created by version with REAL amounts
+	db, err := sql.Open("sqlite3", dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE "users" ("id" INTEGER NOT NULL UNIQUE, "balance" REAL NOT NULL DEFAULT 0, PRIMARY KEY("id"));
+		CREATE TABLE "deposits" ("id" INTEGER NOT NULL UNIQUE, "userId" INTEGER NOT NULL, "balanceBefore" REAL NOT NULL,
+			"balanceAfter" REAL NOT NULL, "date" INTEGER NOT NULL, PRIMARY KEY("id"));
+		CREATE TABLE "transactions" ("id" INTEGER NOT NULL UNIQUE, "userId" INTEGER NOT NULL, "type" TEXT NOT NULL,
+			"amount" REAL NOT NULL, "balanceBefore" REAL NOT NULL, "balanceAfter" REAL NOT NULL, "date" INTEGER NOT NULL, PRIMARY KEY("id"));
+		INSERT INTO users VALUES (1, 0.20000000298023224);
+		INSERT INTO deposits VALUES (1, 1, 0, 0.10000000149011612, 1);
+		INSERT INTO deposits VALUES (2, 1, 0.10000000149011612, 0.30000001192092896, 2);
+		INSERT INTO transactions VALUES (1, 1, 'Bet', 0.10000000149011612, 0.30000001192092896, 0.20000000298023224, 3);
+	`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, cleanup := openTestStore(t, Config{DBName: dbName}, nil)
+	defer cleanup()
+	user, statistic, err := s.GetUser(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, Money(20), user.Balance)
+	assert.Equal(t, 2, statistic.DepositeCount)
+	assert.Equal(t, Money(30), statistic.DepositSum)
+	assert.Equal(t, Money(10), statistic.BetSum)
+
+	var version int
+	assert.NoError(t, s.db.QueryRow("PRAGMA user_version").Scan(&version))
+	assert.Equal(t, schemaVersion(), version)
+	// ledger sequence follows dates of legacy rows
+	var seq int64
+	assert.NoError(t, s.db.QueryRow("SELECT seq FROM transactions WHERE id = 1").Scan(&seq))
+	assert.Equal(t, int64(3), seq)
+	assert.Equal(t, int64(4), s.nextSeq())
+}
+
+func TestReplay(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1}))
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 2}))
+	_, err := s.CreateDeposit(context.Background(), &Deposit{ID: 1, UserID: 1, Amount: 100})
+	assert.NoError(t, err)
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 100})
+	assert.NoError(t, err)
+
+	var duplicateError *DuplicateError
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 1, UserID: 1, Amount: 100})
+	if assert.True(t, errors.As(err, &duplicateError)) {
+		assert.Equal(t, Money(100), duplicateError.Balance)
+	}
+	// balance is not enough for new bet, but replay still returns original result
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 100})
+	if assert.True(t, errors.As(err, &duplicateError)) {
+		assert.Equal(t, Money(0), duplicateError.Balance)
+	}
+
+	var conflictError *ConflictError
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 1, UserID: 1, Amount: 200})
+	assert.True(t, errors.As(err, &conflictError))
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 1, UserID: 2, Amount: 100})
+	assert.True(t, errors.As(err, &conflictError))
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Win, Amount: 100})
+	assert.True(t, errors.As(err, &conflictError))
+
+	user, statistic, _ := s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(0), user.Balance)
+	assert.Equal(t, 1, statistic.DepositeCount)
+	assert.Equal(t, 1, statistic.BetCount)
+}
+
+func TestRollback(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1, Balance: 1000}))
+	_, err := s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 300})
+	assert.NoError(t, err)
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 2, UserID: 1, Type: Win, Amount: 50})
+	assert.NoError(t, err)
+
+	balance, err := s.CreateTransaction(context.Background(), &Transaction{ID: 3, UserID: 1, Type: Rollback, ReferenceID: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(1050), balance)
+	_, statistic, _ := s.GetUser(context.Background(), 1)
+	assert.Equal(t, 0, statistic.BetCount)
+	assert.Equal(t, Money(0), statistic.BetSum)
+
+	var duplicateError *DuplicateError
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 3, UserID: 1, Type: Rollback, ReferenceID: 1})
+	assert.True(t, errors.As(err, &duplicateError))
+	var rolledBackError *RolledBackError
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 4, UserID: 1, Type: Rollback, ReferenceID: 1})
+	assert.True(t, errors.As(err, &rolledBackError))
+	var notFoundError *NotFoundError
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 5, UserID: 1, Type: Rollback, ReferenceID: 100})
+	assert.True(t, errors.As(err, &notFoundError))
+	var validationError *ValidationError
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 6, UserID: 1, Type: Rollback, ReferenceID: 2})
+	assert.True(t, errors.As(err, &validationError))
+
+	user, _, _ := s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(1050), user.Balance)
+
+	// statistic loaded from database skips rolled back bets
+	s.initCache()
+	_, statistic, _ = s.GetUser(context.Background(), 1)
+	assert.Equal(t, 0, statistic.BetCount)
+	assert.Equal(t, 1, statistic.WinCount)
+}
+
+func TestWriteThrough(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, cleanup := openTestStore(t, Config{DBName: filepath.Join(dir, "test.db"), Persistence: WriteThrough}, nil)
+	defer cleanup()
+
+	readBalance := func() Money {
+		var balance Money
+		assert.NoError(t, s.db.QueryRow("SELECT balance FROM users WHERE id = 1").Scan(&balance))
+		return balance
+	}
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1}))
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 1, UserID: 1, Amount: 500})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(500), readBalance())
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 200})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(300), readBalance())
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 2, UserID: 1, Type: Rollback, ReferenceID: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(500), readBalance())
+
+	// rejected operation leaves both balances untouched
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 2, UserID: 1, Type: Win, Amount: 1})
+	assert.Error(t, err)
+	user, _, _ := s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(500), user.Balance)
+	assert.Equal(t, Money(500), readBalance())
+}
+
+func TestRecoverBalances(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := Config{DBName: filepath.Join(dir, "test.db")}
+
+	s, cleanup := openTestStore(t, config, nil)
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1}))
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 2, Balance: 100}))
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 1, UserID: 1, Amount: 500})
+	assert.NoError(t, err)
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 200})
+	assert.NoError(t, err)
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 2, UserID: 1, Type: Win, Amount: 50})
+	assert.NoError(t, err)
+	s.saveUpdatedUsers(context.Background())
+	// simulate crash before ticker saved balance
+	_, err = s.db.Exec("UPDATE users SET balance = 0 WHERE id = 1")
+	assert.NoError(t, err)
+	cleanup()
+
+	s, cleanup = openTestStore(t, config, nil)
+	defer cleanup()
+	user, _, err := s.GetUser(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, Money(350), user.Balance)
+	user, _, err = s.GetUser(context.Background(), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, Money(100), user.Balance)
+
+	_, err = s.db.Exec("UPDATE users SET balance = 1 WHERE id = 1")
+	assert.NoError(t, err)
+	s.config.Recovery = RecoveryRefuse
+	assert.Error(t, s.recoverBalances())
+	corrections, err := s.findBalanceCorrections()
+	assert.NoError(t, err)
+	assert.Equal(t, []BalanceCorrection{{UserID: 1, Wallet: "balance", Stored: 1, Ledger: 350}}, corrections)
+}
+
+func TestGetHistory(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1}))
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 2}))
+	_, err := s.CreateDeposit(context.Background(), &Deposit{ID: 1, UserID: 1, Amount: 1000})
+	assert.NoError(t, err)
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 2, UserID: 2, Amount: 1000})
+	assert.NoError(t, err)
+	for i := 1; i <= 5; i++ {
+		_, err = s.CreateTransaction(context.Background(), &Transaction{ID: uint64(i), UserID: 1, Type: Bet, Amount: Money(i * 10)})
+		assert.NoError(t, err)
+	}
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 6, UserID: 1, Type: Win, Amount: 500})
+	assert.NoError(t, err)
+
+	// walk all pages
+	var ids []uint64
+	q := &HistoryQuery{UserID: 1, Limit: 3}
+	for {
+		entries, cursor, err := s.GetHistory(context.Background(), q)
+		assert.NoError(t, err)
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+		if cursor == "" {
+			break
+		}
+		q.Cursor = cursor
+	}
+	assert.Equal(t, []uint64{6, 5, 4, 3, 2, 1, 1}, ids)
+
+	entries, _, err := s.GetHistory(context.Background(), &HistoryQuery{UserID: 1, Types: []TransactionType{DepositType, Win}})
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, Win, entries[0].Type)
+		assert.Equal(t, DepositType, entries[1].Type)
+		assert.Equal(t, Money(1000), entries[1].BalanceAfter)
+	}
+
+	entries, _, err = s.GetHistory(context.Background(), &HistoryQuery{UserID: 1, Types: []TransactionType{Bet}, MinAmount: 20, MaxAmount: 40})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	entries, _, err = s.GetHistory(context.Background(), &HistoryQuery{UserID: 1, To: time.Now().Add(-time.Hour)})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+
+	var validationError *ValidationError
+	_, _, err = s.GetHistory(context.Background(), &HistoryQuery{UserID: 1, Cursor: "bad"})
+	assert.True(t, errors.As(err, &validationError))
+	_, _, err = s.GetHistory(context.Background(), &HistoryQuery{UserID: 1, Types: []TransactionType{"Unknown"}})
+	assert.True(t, errors.As(err, &validationError))
+	var notFoundError *NotFoundError
+	_, _, err = s.GetHistory(context.Background(), &HistoryQuery{UserID: 3})
+	assert.True(t, errors.As(err, &notFoundError))
+}
+
+func TestWithdrawal(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1, Balance: 1000}))
+	balance, err := s.CreateWithdrawal(context.Background(), &Withdrawal{ID: 1, UserID: 1, Amount: 300})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(700), balance)
+	_, err = s.CreateWithdrawal(context.Background(), &Withdrawal{ID: 2, UserID: 1, Amount: 200})
+	assert.NoError(t, err)
+	var validationError *ValidationError
+	_, err = s.CreateWithdrawal(context.Background(), &Withdrawal{ID: 3, UserID: 1, Amount: 600})
+	assert.True(t, errors.As(err, &validationError))
+	var duplicateError *DuplicateError
+	_, err = s.CreateWithdrawal(context.Background(), &Withdrawal{ID: 1, UserID: 1, Amount: 300})
+	assert.True(t, errors.As(err, &duplicateError))
+
+	_, statistic, _ := s.GetUser(context.Background(), 1)
+	assert.Equal(t, 2, statistic.PendingWithdrawalCount)
+	assert.Equal(t, Money(500), statistic.PendingWithdrawalSum)
+
+	w, err := s.ApproveWithdrawal(context.Background(), 1, "cashier")
+	assert.NoError(t, err)
+	assert.Equal(t, WithdrawalApproved, w.Status)
+	w, err = s.RejectWithdrawal(context.Background(), 2, "cashier")
+	assert.NoError(t, err)
+	assert.Equal(t, WithdrawalRejected, w.Status)
+	// repeated resolution is allowed, opposite is not
+	_, err = s.ApproveWithdrawal(context.Background(), 1, "cashier")
+	assert.NoError(t, err)
+	var stateError *StateError
+	_, err = s.RejectWithdrawal(context.Background(), 1, "cashier")
+	assert.True(t, errors.As(err, &stateError))
+	_, err = s.ApproveWithdrawal(context.Background(), 2, "cashier")
+	assert.True(t, errors.As(err, &stateError))
+	var notFoundError *NotFoundError
+	_, err = s.ApproveWithdrawal(context.Background(), 3, "cashier")
+	assert.True(t, errors.As(err, &notFoundError))
+
+	user, statistic, _ := s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(700), user.Balance)
+	assert.Equal(t, 0, statistic.PendingWithdrawalCount)
+	assert.Equal(t, 1, statistic.WithdrawalCount)
+	assert.Equal(t, Money(300), statistic.WithdrawalSum)
+
+	entries, _, err := s.GetHistory(context.Background(), &HistoryQuery{UserID: 1})
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, WithdrawalReturnType, entries[0].Type)
+		assert.Equal(t, Money(700), entries[0].BalanceAfter)
+	}
+	s.saveUpdatedUsers(context.Background())
+	corrections, err := s.findBalanceCorrections()
+	assert.NoError(t, err)
+	assert.Len(t, corrections, 0)
+
+	s.initCache()
+	_, statistic, _ = s.GetUser(context.Background(), 1)
+	assert.Equal(t, 1, statistic.WithdrawalCount)
+	assert.Equal(t, Money(300), statistic.WithdrawalSum)
+}
+
+func TestHold(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1, Balance: 1000}))
+	available, err := s.AuthorizeHold(context.Background(), &Hold{ID: 1, UserID: 1, Amount: 600})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(400), available)
+	user, _, _ := s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(1000), user.Balance)
+
+	// reserved funds can't be spent
+	var validationError *ValidationError
+	_, err = s.AuthorizeHold(context.Background(), &Hold{ID: 2, UserID: 1, Amount: 500})
+	assert.True(t, errors.As(err, &validationError))
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 500})
+	assert.True(t, errors.As(err, &validationError))
+	_, err = s.CreateWithdrawal(context.Background(), &Withdrawal{ID: 1, UserID: 1, Amount: 500})
+	assert.True(t, errors.As(err, &validationError))
+
+	balance, err := s.CaptureHold(context.Background(), &Hold{ID: 1, UserID: 1, TransactionID: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(400), balance)
+	var duplicateError *DuplicateError
+	_, err = s.CaptureHold(context.Background(), &Hold{ID: 1, UserID: 1, TransactionID: 10})
+	assert.True(t, errors.As(err, &duplicateError))
+	var stateError *StateError
+	_, err = s.CaptureHold(context.Background(), &Hold{ID: 1, UserID: 1, TransactionID: 11})
+	assert.True(t, errors.As(err, &stateError))
+	_, statistic, _ := s.GetUser(context.Background(), 1)
+	assert.Equal(t, 1, statistic.BetCount)
+	assert.Equal(t, Money(600), statistic.BetSum)
+	// replayed authorization responds with current status of the hold
+	replayed := &Hold{ID: 1, UserID: 1, Amount: 600}
+	_, err = s.AuthorizeHold(context.Background(), replayed)
+	assert.True(t, errors.As(err, &duplicateError))
+	assert.Equal(t, HoldCaptured, replayed.Status)
+	assert.False(t, replayed.ExpiresAt.IsZero())
+
+	_, err = s.AuthorizeHold(context.Background(), &Hold{ID: 3, UserID: 1, Amount: 100})
+	assert.NoError(t, err)
+	// hold is found only together with its user
+	_, err = s.ReleaseHold(context.Background(), &Hold{ID: 3, UserID: 2})
+	assert.Equal(t, CodeHoldNotFound, CodeOf(err))
+	_, err = s.ReleaseHold(context.Background(), &Hold{ID: 3})
+	assert.Equal(t, CodeHoldNotFound, CodeOf(err))
+	available, err = s.ReleaseHold(context.Background(), &Hold{ID: 3, UserID: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(400), available)
+	_, err = s.CaptureHold(context.Background(), &Hold{ID: 3, UserID: 1, TransactionID: 12})
+	assert.True(t, errors.As(err, &stateError))
+
+	_, err = s.AuthorizeHold(context.Background(), &Hold{ID: 4, UserID: 1, Amount: 100})
+	assert.NoError(t, err)
+	_, err = s.db.Exec("UPDATE holds SET expiresAt = ? WHERE id = 4", time.Now().Add(-time.Second).Unix())
+	assert.NoError(t, err)
+	_, err = s.CaptureHold(context.Background(), &Hold{ID: 4, UserID: 1, TransactionID: 13})
+	assert.True(t, errors.As(err, &stateError))
+	user, _, _ = s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(100), user.Reserved)
+	s.expireHolds()
+	user, _, _ = s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(0), user.Reserved)
+	hold, err := s.readHold(context.Background(), 4)
+	assert.NoError(t, err)
+	assert.Equal(t, HoldExpired, hold.Status)
+
+	// reserved funds are restored from database
+	_, err = s.AuthorizeHold(context.Background(), &Hold{ID: 5, UserID: 1, Amount: 50})
+	assert.NoError(t, err)
+	s.initCache()
+	user, _, _ = s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(50), user.Reserved)
+}
+
+func TestBonus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{DBName: filepath.Join(dir, "test.db"), BonusWagering: 2}
+	s, cleanup := openTestStore(t, config, func() { os.RemoveAll(dir) })
+	defer cleanup()
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1, Balance: 100}))
+	bonusBalance, err := s.GrantBonus(context.Background(), &Bonus{ID: 1, UserID: 1, Amount: 50})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(50), bonusBalance)
+	var duplicateError *DuplicateError
+	_, err = s.GrantBonus(context.Background(), &Bonus{ID: 1, UserID: 1, Amount: 50})
+	assert.True(t, errors.As(err, &duplicateError))
+	var conflictError *ConflictError
+	_, err = s.GrantBonus(context.Background(), &Bonus{ID: 1, UserID: 1, Amount: 60})
+	assert.True(t, errors.As(err, &conflictError))
+
+	// cash is spent first, wins go to bonus wallet while wagering is not met,
+	// even when the bet was paid from cash only
+	balance, err := s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 80})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(20), balance)
+	user, _, _ := s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(50), user.Bonus)
+	balance, err = s.CreateTransaction(context.Background(), &Transaction{ID: 2, UserID: 1, Type: Win, Amount: 30})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(20), balance)
+	user, _, _ = s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(80), user.Bonus)
+	assert.Equal(t, Money(20), user.WageringLeft)
+
+	var validationError *ValidationError
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 3, UserID: 1, Type: Bet, Amount: 101})
+	assert.True(t, errors.As(err, &validationError))
+
+	// wagering is met, the whole bonus converts to cash
+	balance, err = s.CreateTransaction(context.Background(), &Transaction{ID: 4, UserID: 1, Type: Bet, Amount: 40})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(60), balance)
+	user, _, _ = s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(0), user.Bonus)
+	assert.Equal(t, Money(0), user.WageringLeft)
+
+	entries, _, err := s.GetHistory(context.Background(), &HistoryQuery{UserID: 1, Types: []TransactionType{BonusConversionType}})
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, Money(60), entries[0].Amount)
+		assert.Equal(t, Money(60), entries[0].BalanceAfter)
+	}
+
+	s.saveUpdatedUsers(context.Background())
+	corrections, err := s.findBalanceCorrections()
+	assert.NoError(t, err)
+	assert.Empty(t, corrections)
+
+	_, statistic, _ := s.GetUser(context.Background(), 1)
+	expected := *statistic
+	assert.Equal(t, Money(20), expected.BetBonusSum)
+	assert.Equal(t, Money(30), expected.WinBonusSum)
+	assert.Equal(t, Money(50), expected.BonusGrantedSum)
+	assert.Equal(t, Money(60), expected.BonusConvertedSum)
+	s.initCache()
+	_, statistic, _ = s.GetUser(context.Background(), 1)
+	assert.Equal(t, expected, *statistic)
+}
+
+func TestBonusFirstAndExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{DBName: filepath.Join(dir, "test.db"), BonusWagering: 2, BonusBetOrder: BonusFirst}
+	s, cleanup := openTestStore(t, config, func() { os.RemoveAll(dir) })
+	defer cleanup()
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1, Balance: 100}))
+	_, err = s.GrantBonus(context.Background(), &Bonus{ID: 1, UserID: 1, Amount: 50})
+	assert.NoError(t, err)
+	balance, err := s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 30})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(100), balance)
+	user, statistic, _ := s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(20), user.Bonus)
+	assert.Equal(t, Money(70), user.WageringLeft)
+	assert.Equal(t, Money(30), statistic.BetBonusSum)
+
+	// rolled back bet returns to bonus wallet and no longer counts for wagering
+	balance, err = s.CreateTransaction(context.Background(), &Transaction{ID: 2, UserID: 1, Type: Rollback, ReferenceID: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(100), balance)
+	user, statistic, _ = s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(50), user.Bonus)
+	assert.Equal(t, Money(100), user.WageringLeft)
+	assert.Equal(t, Money(0), statistic.BetBonusSum)
+
+	cachedUser(s, 1).BonusExpiresAt = time.Now().Add(-time.Second)
+	s.expireBonuses()
+	user, statistic, _ = s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(0), user.Bonus)
+	assert.Equal(t, Money(0), user.WageringLeft)
+	assert.Equal(t, Money(100), user.Balance)
+	assert.Equal(t, Money(50), statistic.BonusExpiredSum)
+
+	// bonus part of bet rolled back after expiry is forfeited, not converted to cash
+	_, err = s.GrantBonus(context.Background(), &Bonus{ID: 2, UserID: 1, Amount: 50})
+	assert.NoError(t, err)
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 3, UserID: 1, Type: Bet, Amount: 30})
+	assert.NoError(t, err)
+	cachedUser(s, 1).BonusExpiresAt = time.Now().Add(-time.Second)
+	s.expireBonuses()
+	balance, err = s.CreateTransaction(context.Background(), &Transaction{ID: 4, UserID: 1, Type: Rollback, ReferenceID: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(100), balance)
+	user, statistic, _ = s.GetUser(context.Background(), 1)
+	assert.Equal(t, Money(0), user.Bonus)
+	assert.Equal(t, Money(0), user.WageringLeft)
+	assert.Equal(t, Money(0), statistic.BonusConvertedSum)
+	assert.Equal(t, Money(100), statistic.BonusExpiredSum)
+
+	s.saveUpdatedUsers(context.Background())
+	corrections, err := s.findBalanceCorrections()
+	assert.NoError(t, err)
+	assert.Empty(t, corrections)
+}
+
+func TestLimits(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1, Balance: 1000}))
+	var validationError *ValidationError
+	_, err := s.SetLimit(context.Background(), &Limit{UserID: 1, Type: "bets", Period: Daily, Amount: 100})
+	assert.True(t, errors.As(err, &validationError))
+	_, err = s.SetLimit(context.Background(), &Limit{UserID: 1, Type: DepositLimit, Period: "yearly", Amount: 100})
+	assert.True(t, errors.As(err, &validationError))
+
+	var limitError *LimitError
+	limit, err := s.SetLimit(context.Background(), &Limit{UserID: 1, Type: DepositLimit, Period: Daily, Amount: 500})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(500), limit.Amount)
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 1, UserID: 1, Amount: 300})
+	assert.NoError(t, err)
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 2, UserID: 1, Amount: 300})
+	assert.True(t, errors.As(err, &limitError))
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 3, UserID: 1, Amount: 200})
+	assert.NoError(t, err)
+
+	// authorized holds count as bets
+	_, err = s.SetLimit(context.Background(), &Limit{UserID: 1, Type: WagerLimit, Period: Daily, Amount: 400})
+	assert.NoError(t, err)
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 300})
+	assert.NoError(t, err)
+	_, err = s.AuthorizeHold(context.Background(), &Hold{ID: 1, UserID: 1, Amount: 200})
+	assert.True(t, errors.As(err, &limitError))
+	_, err = s.AuthorizeHold(context.Background(), &Hold{ID: 2, UserID: 1, Amount: 100})
+	assert.NoError(t, err)
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 2, UserID: 1, Type: Bet, Amount: 1})
+	assert.True(t, errors.As(err, &limitError))
+	_, err = s.ReleaseHold(context.Background(), &Hold{ID: 2, UserID: 1})
+	assert.NoError(t, err)
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 3, UserID: 1, Type: Bet, Amount: 100})
+	assert.NoError(t, err)
+	// wins are never limited and reduce loss
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 4, UserID: 1, Type: Win, Amount: 100})
+	assert.NoError(t, err)
+
+	// removal waits for cooling-off period
+	_, err = s.SetLimit(context.Background(), &Limit{UserID: 1, Type: LossLimit, Period: Weekly, Amount: 450})
+	assert.NoError(t, err)
+	limit, err = s.SetLimit(context.Background(), &Limit{UserID: 1, Type: WagerLimit, Period: Daily, Amount: 0})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(400), limit.Amount)
+	assert.Equal(t, Money(400), limit.Used)
+	if assert.NotNil(t, limit.PendingAmount) {
+		assert.Equal(t, Money(0), *limit.PendingAmount)
+	}
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 5, UserID: 1, Type: Bet, Amount: 100})
+	assert.True(t, errors.As(err, &limitError))
+	_, err = s.db.Exec("UPDATE limits SET pendingFrom = ? WHERE pendingFrom IS NOT NULL", time.Now().Add(-time.Second).Unix())
+	assert.NoError(t, err)
+	limits, err := s.GetLimits(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Len(t, limits, 2)
+	for _, l := range limits {
+		if l.Type == LossLimit {
+			assert.Equal(t, Money(300), l.Used)
+		}
+	}
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 5, UserID: 1, Type: Bet, Amount: 100})
+	assert.NoError(t, err)
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 6, UserID: 1, Type: Bet, Amount: 100})
+	assert.True(t, errors.As(err, &limitError))
+
+	// decrease applies immediately and cancels pending increase
+	limit, err = s.SetLimit(context.Background(), &Limit{UserID: 1, Type: DepositLimit, Period: Daily, Amount: 1000})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(500), limit.Amount)
+	assert.NotNil(t, limit.PendingAmount)
+	limit, err = s.SetLimit(context.Background(), &Limit{UserID: 1, Type: DepositLimit, Period: Daily, Amount: 400})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(400), limit.Amount)
+	assert.Nil(t, limit.PendingAmount)
+}
+
+func TestAccountStatus(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1, Balance: 1000}))
+	_, err := s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 100})
+	assert.NoError(t, err)
+
+	var validationError *ValidationError
+	var stateError *StateError
+	_, err = s.SetAccountStatus(context.Background(), &StatusChange{UserID: 1, Status: StatusFrozen})
+	assert.True(t, errors.As(err, &validationError))
+	_, err = s.SetAccountStatus(context.Background(), &StatusChange{UserID: 1, Status: StatusSelfExcluded})
+	assert.True(t, errors.As(err, &validationError))
+
+	until := time.Now().Add(time.Hour)
+	user, err := s.SetAccountStatus(context.Background(), &StatusChange{UserID: 1, Status: StatusSelfExcluded, Until: until})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSelfExcluded, user.Status)
+	_, err = s.SetAccountStatus(context.Background(), &StatusChange{UserID: 1, Status: StatusSelfExcluded, Until: until.Add(-time.Minute)})
+	assert.True(t, errors.As(err, &stateError))
+
+	// bets are refused, wins of open rounds are credited
+	var selfExcludedError *SelfExcludedError
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 2, UserID: 1, Type: Bet, Amount: 100})
+	assert.True(t, errors.As(err, &selfExcludedError))
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 1, UserID: 1, Amount: 100})
+	assert.True(t, errors.As(err, &selfExcludedError))
+	balance, err := s.CreateTransaction(context.Background(), &Transaction{ID: 3, UserID: 1, Type: Win, Amount: 200})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(1100), balance)
+	_, err = s.CreateWithdrawal(context.Background(), &Withdrawal{ID: 1, UserID: 1, Amount: 100})
+	assert.NoError(t, err)
+
+	var frozenError *AccountFrozenError
+	_, err = s.SetAccountStatus(context.Background(), &StatusChange{UserID: 1, Status: StatusFrozen, Admin: true})
+	assert.NoError(t, err)
+	_, err = s.CreateWithdrawal(context.Background(), &Withdrawal{ID: 2, UserID: 1, Amount: 100})
+	assert.True(t, errors.As(err, &frozenError))
+	_, err = s.AuthorizeHold(context.Background(), &Hold{ID: 1, UserID: 1, Amount: 100})
+	assert.True(t, errors.As(err, &frozenError))
+	_, err = s.SetAccountStatus(context.Background(), &StatusChange{UserID: 1, Status: StatusClosed})
+	assert.True(t, errors.As(err, &stateError))
+
+	// status is persisted
+	_, err = s.SetAccountStatus(context.Background(), &StatusChange{UserID: 1, Status: StatusClosed, Admin: true})
+	assert.NoError(t, err)
+	s.initCache()
+	var closedError *AccountClosedError
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 4, UserID: 1, Type: Bet, Amount: 100})
+	assert.True(t, errors.As(err, &closedError))
+	_, err = s.SetAccountStatus(context.Background(), &StatusChange{UserID: 1, Status: StatusActive, Admin: true})
+	assert.True(t, errors.As(err, &stateError))
+
+	// self-exclusion ends automatically
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 2, Balance: 1000}))
+	_, err = s.SetAccountStatus(context.Background(), &StatusChange{UserID: 2, Status: StatusSelfExcluded, Until: until})
+	assert.NoError(t, err)
+	cachedUser(s, 2).StatusUntil = time.Now().Add(-time.Second)
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 5, UserID: 2, Type: Bet, Amount: 100})
+	assert.NoError(t, err)
+}
+
+func TestSession(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	var notFoundError *NotFoundError
+	_, err := s.CreateSession(context.Background(), 1)
+	assert.True(t, errors.As(err, &notFoundError))
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1}))
+	session, err := s.CreateSession(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), session.UserID)
+
+	// only hash of token is stored
+	var count int
+	assert.NoError(t, s.db.QueryRow("SELECT count(*) FROM sessions WHERE tokenHash = ?", session.Token).Scan(&count))
+	assert.Equal(t, 0, count)
+
+	principal, err := s.Authenticate(context.Background(), session.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), principal.UserID)
+	assert.True(t, principal.HasScope(ScopeWithdrawalsWrite))
+	assert.False(t, principal.HasScope(ScopeDepositsWrite))
+	assert.False(t, principal.HasScope(ScopeTransactionsWrite))
+	var authenticationError *AuthenticationError
+	_, err = s.Authenticate(context.Background(), "unknown")
+	assert.True(t, errors.As(err, &authenticationError))
+	_, err = s.Authenticate(context.Background(), "")
+	assert.True(t, errors.As(err, &authenticationError))
+
+	refreshed, err := s.RefreshSession(context.Background(), principal)
+	assert.NoError(t, err)
+	_, err = s.Authenticate(context.Background(), session.Token)
+	assert.True(t, errors.As(err, &authenticationError))
+	_, err = s.RefreshSession(context.Background(), principal)
+	assert.True(t, errors.As(err, &authenticationError))
+	principal, err = s.Authenticate(context.Background(), refreshed.Token)
+	assert.NoError(t, err)
+	assert.NoError(t, s.RevokeSession(context.Background(), principal))
+	_, err = s.Authenticate(context.Background(), refreshed.Token)
+	assert.True(t, errors.As(err, &authenticationError))
+
+	session, err = s.CreateSession(context.Background(), 1)
+	assert.NoError(t, err)
+	_, err = s.db.Exec("UPDATE sessions SET expiresAt = ?", time.Now().Add(-time.Second).Unix())
+	assert.NoError(t, err)
+	_, err = s.Authenticate(context.Background(), session.Token)
+	assert.True(t, errors.As(err, &authenticationError))
+	s.expireSessions()
+	assert.NoError(t, s.db.QueryRow("SELECT count(*) FROM sessions").Scan(&count))
+	assert.Equal(t, 0, count)
+}
+
+func TestOperators(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	admin, err := NewAdmin(s.logger, s.config.DBName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	var validationError *ValidationError
+	var notFoundError *NotFoundError
+	assert.NoError(t, admin.CreateOperator("cashier"))
+	err = admin.CreateOperator("cashier")
+	assert.True(t, errors.As(err, &validationError))
+	_, _, err = admin.CreateAPIKey("unknown", []Scope{ScopeAdmin})
+	assert.True(t, errors.As(err, &notFoundError))
+	_, err = ParseScopes("users:read,bets")
+	assert.Error(t, err)
+
+	scopes, err := ParseScopes("users:read, deposits:write")
+	assert.NoError(t, err)
+	key, apiKey, err := admin.CreateAPIKey("cashier", scopes)
+	assert.NoError(t, err)
+	assert.Equal(t, apiKey.Prefix, key[:len(apiKey.Prefix)])
+
+	principal, err := s.Authenticate(context.Background(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, "cashier", principal.Operator)
+	assert.Equal(t, uint64(0), principal.UserID)
+	assert.True(t, principal.HasScope(ScopeDepositsWrite))
+	assert.False(t, principal.HasScope(ScopeTransactionsWrite))
+	_, err = s.RefreshSession(context.Background(), principal)
+	assert.True(t, errors.As(err, &validationError))
+	keys, err := admin.ListAPIKeys("cashier")
+	assert.NoError(t, err)
+	if assert.Len(t, keys, 1) {
+		assert.False(t, keys[0].LastUsedAt.IsZero())
+		assert.Equal(t, scopes, keys[0].Scopes)
+	}
+
+	// ledger rows keep operator name
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1}))
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 1, UserID: 1, Amount: 100, Operator: principal.Operator})
+	assert.NoError(t, err)
+	_, err = s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 10})
+	assert.NoError(t, err)
+	entries, _, err := s.GetHistory(context.Background(), &HistoryQuery{UserID: 1})
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "", entries[0].Operator)
+		assert.Equal(t, "cashier", entries[1].Operator)
+	}
+
+	var authenticationError *AuthenticationError
+	assert.NoError(t, admin.RevokeAPIKey(apiKey.ID))
+	_, err = s.Authenticate(context.Background(), key)
+	assert.True(t, errors.As(err, &authenticationError))
+	err = admin.RevokeAPIKey(apiKey.ID)
+	assert.True(t, errors.As(err, &notFoundError))
+}
+
+func TestCheckHealth(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	assert.Equal(t, []HealthCheck{{Name: "database", OK: true}, {Name: "cache", OK: true}, {Name: "flush", OK: true}},
+		s.CheckHealth(context.Background()))
+
+	s.health.flushed(errors.New("disk I/O error"))
+	s.health.lastFlush = time.Now().Add(-time.Minute)
+	checks := s.CheckHealth(context.Background())
+	assert.False(t, checks[2].OK)
+	assert.Contains(t, checks[2].Error, "disk I/O error")
+
+	s.saveUpdatedUsers(context.Background())
+	assert.True(t, s.CheckHealth(context.Background())[2].OK)
+
+	s.db.Close()
+	checks = s.CheckHealth(context.Background())
+	assert.False(t, checks[0].OK)
+	assert.Equal(t, "sql: database is closed", checks[0].Error)
+}
+
+func TestTracing(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1}))
+	ctx, request := trace.Start(context.Background(), "POST /user/deposit")
+	_, err := s.CreateDeposit(ctx, &Deposit{ID: 1, UserID: 1, Amount: 10})
+	assert.NoError(t, err)
+	request.End()
+
+	spans := recorder.Ended()
+	names := make([]string, len(spans))
+	parents := make(map[string]string)
+	for i, span := range spans {
+		names[i] = span.Name()
+		parents[span.Name()] = span.Parent().SpanID().String()
+		assert.Equal(t, request.SpanContext().TraceID(), span.SpanContext().TraceID())
+	}
+	assert.Equal(t, []string{"user lock wait", "sqlite prepare", "sqlite exec", "store.CreateDeposit", "POST /user/deposit"}, names)
+	deposit := spans[3]
+	assert.Equal(t, request.SpanContext().SpanID(), deposit.Parent().SpanID())
+	for _, name := range names[:3] {
+		assert.Equal(t, deposit.SpanContext().SpanID().String(), parents[name])
+	}
+	if assert.NotEmpty(t, spans[2].Attributes()) {
+		assert.Equal(t, "db.statement", string(spans[2].Attributes()[0].Key))
+		assert.Contains(t, spans[2].Attributes()[0].Value.AsString(), "INSERT INTO deposits")
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	var output bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&output)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	ctx := WithLogger(context.Background(), logger.WithField("requestId", "req-1"))
+
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1}))
+	_, err := s.SetAccountStatus(ctx, &StatusChange{UserID: 1, Status: StatusClosed})
+	assert.NoError(t, err)
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(output.Bytes(), &entry))
+	assert.Equal(t, "req-1", entry["requestId"])
+	assert.Contains(t, entry["msg"], "Account status of user 1 changed")
+}
+
+func TestTimeout(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1}))
+	_, err := s.CreateDeposit(context.Background(), &Deposit{ID: 1, UserID: 1, Amount: 100})
+	assert.NoError(t, err)
+
+	// waiting for lock held by another operation is abandoned at deadline
+	cachedUser(s, 1).Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = s.CreateTransaction(ctx, &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 10})
+	var timeoutError *TimeoutError
+	assert.True(t, errors.As(err, &timeoutError))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, CodeTimeout, CodeOf(err))
+	_, err = s.GetLimits(ctx, 1)
+	assert.Equal(t, CodeTimeout, CodeOf(err))
+	cachedUser(s, 1).Unlock()
+
+	// cancelled context fails before database is touched
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = s.CreateDeposit(ctx, &Deposit{ID: 2, UserID: 1, Amount: 10})
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, CodeCancelled, CodeOf(err))
+	_, err = s.Authenticate(ctx, "tkn")
+	assert.Equal(t, CodeCancelled, CodeOf(err))
+
+	balance, err := s.CreateTransaction(context.Background(), &Transaction{ID: 1, UserID: 1, Type: Bet, Amount: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, Money(90), balance)
+	assert.Panics(t, func() { cachedUser(s, 1).Unlock() })
+}
+
+func TestClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbName := filepath.Join(dir, "test.db")
+	s, cleanup := openTestStore(t, Config{DBName: dbName}, nil)
+	defer cleanup()
+
+	// write-behind balance reaches users table by the final flush
+	assert.NoError(t, s.CreateUser(context.Background(), &User{ID: 1}))
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 1, UserID: 1, Amount: 100})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close(context.Background()))
+	assert.NoError(t, s.Close(context.Background()))
+	assert.False(t, s.CheckHealth(context.Background())[0].OK)
+	db, err := sql.Open("sqlite3", dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var balance Money
+	assert.NoError(t, db.QueryRow("SELECT balance FROM users WHERE id = 1").Scan(&balance))
+	assert.Equal(t, Money(100), balance)
+	db.Close()
+
+	// flush doesn't wait for locked user longer than ctx allows
+	s, cleanup = openTestStore(t, Config{DBName: dbName}, nil)
+	defer cleanup()
+	_, err = s.CreateDeposit(context.Background(), &Deposit{ID: 2, UserID: 1, Amount: 100})
+	assert.NoError(t, err)
+	cachedUser(s, 1).Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = s.Close(ctx)
+	assert.Equal(t, CodeTimeout, CodeOf(err))
+	assert.Equal(t, err, s.Close(context.Background()))
+	cachedUser(s, 1).Unlock()
+}
+
+// Run with -race, operations of the same and different users share the cache
+func TestConcurrentOperations(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	const (
+		users   = 4
+		workers = 8
+		rounds  = 25
+	)
+	for userID := uint64(1); userID <= users; userID++ {
+		assert.NoError(t, s.CreateUser(context.Background(), &User{ID: userID, Balance: 1000}))
+	}
+
+	var wg sync.WaitGroup
+	var createdMu sync.Mutex
+	created := make(map[uint64]int)
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				id := uint64(worker*rounds + round + 1)
+				userID := id%users + 1
+				ctx := context.Background()
+				_, err := s.CreateDeposit(ctx, &Deposit{ID: id, UserID: userID, Amount: 10})
+				assert.NoError(t, err)
+				_, err = s.CreateTransaction(ctx, &Transaction{ID: id, UserID: userID, Type: Bet, Amount: 30})
+				if err != nil {
+					assert.Equal(t, CodeInsufficientFunds, CodeOf(err))
+				}
+				_, err = s.CreateTransaction(ctx, &Transaction{ID: id + 100000, UserID: userID, Type: Win, Amount: 5})
+				assert.NoError(t, err)
+				user, statistic, err := s.GetUser(ctx, userID)
+				assert.NoError(t, err)
+				assert.True(t, user.Balance >= 0)
+				assert.Equal(t, Money(1000)+statistic.DepositSum+statistic.WinSum-statistic.BetSum, user.Balance)
+				// workers race to create the same users
+				newID := uint64(users + round%5 + 1)
+				if err := s.CreateUser(ctx, &User{ID: newID}); err == nil {
+					createdMu.Lock()
+					created[newID]++
+					createdMu.Unlock()
+				} else {
+					assert.Equal(t, CodeUserExists, CodeOf(err))
+				}
+			}
+		}(worker)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				assert.NoError(t, s.saveUpdatedUsers(context.Background()))
+				s.expireBonuses()
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+
+	assert.Equal(t, map[uint64]int{5: 1, 6: 1, 7: 1, 8: 1, 9: 1}, created)
+	assert.Equal(t, users+5, s.users.len())
+	for userID := uint64(1); userID <= users; userID++ {
+		user, statistic, err := s.GetUser(context.Background(), userID)
+		assert.NoError(t, err)
+		assert.Equal(t, workers*rounds/users, statistic.DepositeCount)
+		assert.Equal(t, workers*rounds/users, statistic.WinCount)
+		assert.Equal(t, Money(1000)+statistic.DepositSum+statistic.WinSum-statistic.BetSum, user.Balance)
+	}
+	// flushed balances agree with ledger
+	assert.NoError(t, s.saveUpdatedUsers(context.Background()))
+	corrections, err := s.findBalanceCorrections()
+	assert.NoError(t, err)
+	assert.Empty(t, corrections)
+}
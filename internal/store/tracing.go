@@ -0,0 +1,40 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/dehimb/cake/internal/trace"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Lock user, time spent waiting for other operations of the user is traced.
+// Waiting is abandoned with TimeoutError when ctx is done.
+func lockUser(ctx context.Context, user *User) error {
+	_, span := trace.Start(ctx, "user lock wait")
+	defer span.End()
+	if err := user.LockContext(ctx); err != nil {
+		trace.SetError(span, err)
+		return &TimeoutError{Err: err}
+	}
+	return nil
+}
+
+// Exec statement with prepare and exec traced as separate spans
+func tracedExec(ctx context.Context, tx execer, query string, args ...interface{}) (sql.Result, error) {
+	_, span := trace.Start(ctx, "sqlite prepare")
+	span.SetAttributes(attribute.String("db.statement", query))
+	stmt, err := tx.PrepareContext(ctx, query)
+	trace.SetError(span, err)
+	span.End()
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	_, span = trace.Start(ctx, "sqlite exec")
+	span.SetAttributes(attribute.String("db.statement", query))
+	result, err := stmt.ExecContext(ctx, args...)
+	trace.SetError(span, err)
+	span.End()
+	return result, err
+}
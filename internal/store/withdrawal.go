@@ -0,0 +1,195 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Withdrawal request reserves funds immediately: amount leaves user balance and
+// waits in pending state. Approval finalizes withdrawal, rejection returns funds.
+
+func (s *Store) createWithdrawal(ctx context.Context, w *Withdrawal) (Money, error) {
+	if w.Amount <= 0 {
+		return 0, &ValidationError{Err: errors.New("Withdrawal amount must be greater than zero"), Field: "amount"}
+	}
+	user, ok := s.users.get(w.UserID)
+	if !ok {
+		return 0, &NotFoundError{Err: errors.New("User not found"), Code: CodeUserNotFound}
+	}
+	if err := s.checkWithdrawalReplay(ctx, w); err != nil {
+		return 0, err
+	}
+	if err := lockUser(ctx, user); err != nil {
+		return 0, err
+	}
+	defer user.Unlock()
+	if err := user.checkStatus(operationWithdrawal); err != nil {
+		return 0, err
+	}
+	oldBalance := user.Balance
+	newBalance := oldBalance - w.Amount
+	if newBalance < user.Reserved {
+		return 0, &ValidationError{Err: errors.New("User doesn't have anough funds"), Code: CodeInsufficientFunds}
+	}
+	next := user.state()
+	next.Balance = newBalance
+	err := s.persist(ctx, user, next, func(tx execer) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO withdrawals(id, userId, amount, status, balanceBefore, balanceAfter, date, seq, operator) values(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			w.ID, w.UserID, w.Amount, WithdrawalPending, oldBalance, newBalance, time.Now().Unix(), s.nextSeq(), operatorColumn(w.Operator))
+		if err != nil {
+			return &TransactionError{Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		if isConstraintError(err) {
+			if replayErr := s.checkWithdrawalReplay(ctx, w); replayErr != nil {
+				return 0, replayErr
+			}
+		}
+		return 0, err
+	}
+	w.Status = WithdrawalPending
+	statistic := user.statistic
+	statistic.PendingWithdrawalCount += 1
+	statistic.PendingWithdrawalSum += w.Amount
+	return newBalance, nil
+}
+
+// Finalize pending withdrawal. Approving already approved withdrawal has no effect.
+func (s *Store) approveWithdrawal(ctx context.Context, id uint64, operator string) (*Withdrawal, error) {
+	w, user, err := s.lockWithdrawal(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer user.Unlock()
+	switch w.Status {
+	case WithdrawalApproved:
+		return w, nil
+	case WithdrawalRejected:
+		return nil, &StateError{Err: errors.New("Withdrawal already rejected"), Code: CodeWithdrawalResolved}
+	}
+	_, err = s.db.ExecContext(ctx, "UPDATE withdrawals SET status = ?, resolvedDate = ?, resolvedOperator = ? WHERE id = ?",
+		WithdrawalApproved, time.Now().Unix(), operatorColumn(operator), id)
+	if err != nil {
+		return nil, &TransactionError{Err: err}
+	}
+	w.Status = WithdrawalApproved
+	statistic := user.statistic
+	statistic.PendingWithdrawalCount -= 1
+	statistic.PendingWithdrawalSum -= w.Amount
+	statistic.WithdrawalCount += 1
+	statistic.WithdrawalSum += w.Amount
+	return w, nil
+}
+
+// Return funds of pending withdrawal to the user. Rejecting already rejected withdrawal has no effect.
+func (s *Store) rejectWithdrawal(ctx context.Context, id uint64, operator string) (*Withdrawal, error) {
+	w, user, err := s.lockWithdrawal(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer user.Unlock()
+	switch w.Status {
+	case WithdrawalRejected:
+		return w, nil
+	case WithdrawalApproved:
+		return nil, &StateError{Err: errors.New("Withdrawal already approved"), Code: CodeWithdrawalResolved}
+	}
+	oldBalance := user.Balance
+	newBalance := oldBalance + w.Amount
+	next := user.state()
+	next.Balance = newBalance
+	err = s.persist(ctx, user, next, func(tx execer) error {
+		_, err := tx.ExecContext(ctx, `UPDATE withdrawals SET status = ?, resolvedBalanceBefore = ?, resolvedBalanceAfter = ?, resolvedDate = ?, resolvedSeq = ?,
+			resolvedOperator = ? WHERE id = ?`, WithdrawalRejected, oldBalance, newBalance, time.Now().Unix(), s.nextSeq(), operatorColumn(operator), id)
+		if err != nil {
+			return &TransactionError{Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.Status = WithdrawalRejected
+	statistic := user.statistic
+	statistic.PendingWithdrawalCount -= 1
+	statistic.PendingWithdrawalSum -= w.Amount
+	return w, nil
+}
+
+// Read withdrawal and lock its user. Status is read under the lock,
+// so concurrent approve and reject can't both succeed.
+func (s *Store) lockWithdrawal(ctx context.Context, id uint64) (*Withdrawal, *User, error) {
+	w, err := s.readWithdrawal(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, ok := s.users.get(w.UserID)
+	if !ok {
+		return nil, nil, &NotFoundError{Err: errors.New("User not found"), Code: CodeUserNotFound}
+	}
+	if err = lockUser(ctx, user); err != nil {
+		return nil, nil, err
+	}
+	if w, err = s.readWithdrawal(ctx, id); err != nil {
+		user.Unlock()
+		return nil, nil, err
+	}
+	return w, user, nil
+}
+
+func (s *Store) readWithdrawal(ctx context.Context, id uint64) (*Withdrawal, error) {
+	w := &Withdrawal{ID: id}
+	err := s.db.QueryRowContext(ctx, "SELECT userId, amount, status FROM withdrawals WHERE id = ?", id).Scan(&w.UserID, &w.Amount, &w.Status)
+	if err == sql.ErrNoRows {
+		return nil, &NotFoundError{Err: errors.New("Withdrawal not found"), Code: CodeWithdrawalNotFound}
+	}
+	if err != nil {
+		return nil, &InternalError{Message: "Error when reading withdrawal", Err: err}
+	}
+	return w, nil
+}
+
+func (s *Store) checkWithdrawalReplay(ctx context.Context, w *Withdrawal) error {
+	var userID uint64
+	var amount, balanceAfter Money
+	err := s.db.QueryRowContext(ctx, "SELECT userId, amount, balanceAfter FROM withdrawals WHERE id = ?", w.ID).Scan(&userID, &amount, &balanceAfter)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return &InternalError{Message: "Error when checking withdrawal replay", Err: err}
+	}
+	if userID != w.UserID || amount != w.Amount {
+		return &ConflictError{Err: errors.New("Withdrawal id already used with different payload")}
+	}
+	return &DuplicateError{Balance: balanceAfter}
+}
+
+func (s *Store) loadWithdrawalStatistic(statistic *Statistic) error {
+	rows, err := s.db.Query("SELECT status, COUNT(*), SUM(amount) FROM withdrawals WHERE userId = ? GROUP BY status", statistic.UserID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status WithdrawalStatus
+		var count int
+		var sum Money
+		if err = rows.Scan(&status, &count, &sum); err != nil {
+			return err
+		}
+		switch status {
+		case WithdrawalApproved:
+			statistic.WithdrawalCount = count
+			statistic.WithdrawalSum = sum
+		case WithdrawalPending:
+			statistic.PendingWithdrawalCount = count
+			statistic.PendingWithdrawalSum = sum
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,140 @@
+// Package trace configures OpenTelemetry tracing of the service. Spans are
+// started with Start, trace context is propagated with W3C traceparent header.
+//
+// Tracing is disabled until Setup is called with exporter, until then spans
+// are no-ops of the global OpenTelemetry tracer provider.
+package trace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// Instrumentation scope of all spans of the service
+const instrumentationName = "github.com/dehimb/cake"
+
+const (
+	// Spans are written as JSON to file or stdout, for local use without collector
+	ExporterStdout = "stdout"
+	// Spans are sent to OpenTelemetry collector with OTLP over HTTP
+	ExporterOTLP = "otlp"
+)
+
+type Config struct {
+	// ExporterStdout or ExporterOTLP, tracing is disabled when empty
+	Exporter string
+	// File of stdout exporter, "-" or empty is stdout
+	File string
+	// host:port of OTLP collector. When empty OTEL_EXPORTER_OTLP_* environment
+	// variables are used, see otlptracehttp.
+	Endpoint string
+	// Send spans to OTLP collector over plain HTTP
+	Insecure bool
+	// Fraction of new traces which are recorded, 0 means all.
+	// Traces continued from traceparent header follow sampled flag of caller.
+	SampleRatio float64
+	ServiceName string
+}
+
+// Propagator of W3C trace context, used for incoming and outgoing requests
+var Propagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// Install tracer provider with exporter of config as global one.
+// Returned function flushes pending spans and must be called before exit.
+func Setup(ctx context.Context, config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(Propagator)
+	if config.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, closer, err := newExporter(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	ratio := config.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "cake"
+	}
+	// OTEL_RESOURCE_ATTRIBUTES and OTEL_SERVICE_NAME override defaults
+	res, err := resource.Merge(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)), resource.Default())
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
+
+// Exporter of config and file which must be closed after it, if any
+func newExporter(ctx context.Context, config Config) (sdktrace.SpanExporter, io.Closer, error) {
+	switch config.Exporter {
+	case ExporterStdout:
+		if config.File == "" || config.File == "-" {
+			exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+			return exporter, nil, err
+		}
+		f, err := os.OpenFile(config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return exporter, f, nil
+	case ExporterOTLP:
+		var options []otlptracehttp.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(ctx, options...)
+		return exporter, nil, err
+	}
+	return nil, nil, fmt.Errorf("Unknown trace exporter: %s", config.Exporter)
+}
+
+// Start span which is child of span in ctx. Returned context carries
+// the new span. Span must be ended by End.
+func Start(ctx context.Context, name string, options ...oteltrace.SpanStartOption) (context.Context, oteltrace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, options...)
+}
+
+// Record error on span and mark span as failed, nil error is ignored
+func SetError(span oteltrace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
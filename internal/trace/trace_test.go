@@ -0,0 +1,58 @@
+package trace
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestSetup(t *testing.T) {
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+	dir, err := ioutil.TempDir("", "cake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "spans.json")
+
+	_, err = Setup(context.Background(), Config{Exporter: "zipkin"})
+	assert.Error(t, err)
+
+	shutdown, err := Setup(context.Background(), Config{Exporter: ExporterStdout, File: fileName})
+	assert.NoError(t, err)
+	extract := func(traceparent string) context.Context {
+		header := http.Header{}
+		header.Set("traceparent", traceparent)
+		return Propagator.Extract(context.Background(), propagation.HeaderCarrier(header))
+	}
+
+	// sampling decision of caller is followed
+	ctx, sampled := Start(extract("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"), "sampled")
+	assert.True(t, sampled.IsRecording())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sampled.SpanContext().TraceID().String())
+	_, child := Start(ctx, "child")
+	child.End()
+	sampled.End()
+	_, dropped := Start(extract("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"), "dropped")
+	assert.False(t, dropped.IsRecording())
+	dropped.End()
+	_, root := Start(context.Background(), "root")
+	assert.True(t, root.IsRecording())
+	root.End()
+
+	assert.NoError(t, shutdown(context.Background()))
+	data, err := ioutil.ReadFile(fileName)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"Name":"sampled"`)
+	assert.Contains(t, string(data), `"Name":"child"`)
+	assert.Contains(t, string(data), `"Name":"root"`)
+	assert.NotContains(t, string(data), `"Name":"dropped"`)
+}